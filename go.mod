@@ -2,4 +2,7 @@ module tagger
 
 go 1.25.1
 
-require github.com/mattn/go-sqlite3 v1.14.32 // indirect
+require (
+	github.com/mattn/go-sqlite3 v1.14.32
+	golang.org/x/image v0.45.0
+)
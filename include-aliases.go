@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Tag aliases are checked when they are saved. A category may have several
+// alias groups, but a value can only be in one of them, because searching
+// for it expands to the first group that has it. Categories and values are
+// compared without case, as they are when searching. Values that are not
+// tags yet are allowed, since the tag may be added later, but are listed as
+// a warning in case they are typos.
+
+// cleanTagAliases trims the categories and values of alias groups and
+// checks them, returning the first problem found
+func cleanTagAliases(groups []TagAliasGroup) ([]TagAliasGroup, error) {
+	cleaned := make([]TagAliasGroup, 0, len(groups))
+	seen := make(map[string]int)
+	for i, group := range groups {
+		n := i + 1
+		category := strings.TrimSpace(group.Category)
+		if category == "" {
+			return nil, fmt.Errorf("alias group %d has no category", n)
+		}
+		if len(group.Aliases) < 2 {
+			return nil, fmt.Errorf("alias group %d (%s) needs at least two values", n, category)
+		}
+
+		inGroup := make(map[string]bool)
+		aliases := make([]string, 0, len(group.Aliases))
+		for _, alias := range group.Aliases {
+			alias = strings.TrimSpace(alias)
+			if alias == "" {
+				return nil, fmt.Errorf("alias group %d (%s) has an empty value", n, category)
+			}
+			key := strings.ToLower(category + "\x00" + alias)
+			if inGroup[key] {
+				return nil, fmt.Errorf("alias group %d has %s/%s more than once", n, category, alias)
+			}
+			if other, ok := seen[key]; ok {
+				return nil, fmt.Errorf("%s/%s is in alias groups %d and %d; a value can only be in one group", category, alias, other, n)
+			}
+			inGroup[key] = true
+			seen[key] = n
+			aliases = append(aliases, alias)
+		}
+		cleaned = append(cleaned, TagAliasGroup{Category: category, Aliases: aliases})
+	}
+	return cleaned, nil
+}
+
+// unknownAliasTags lists the aliased values that are not existing tags
+func unknownAliasTags(ctx context.Context, groups []TagAliasGroup) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT c.name, t.value FROM tags t JOIN categories c ON c.id = t.category_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var category, value string
+		if err := rows.Scan(&category, &value); err != nil {
+			return nil, err
+		}
+		existing[strings.ToLower(category+"\x00"+value)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var unknown []string
+	for _, group := range groups {
+		for _, alias := range group.Aliases {
+			if !existing[strings.ToLower(group.Category+"\x00"+alias)] {
+				unknown = append(unknown, group.Category+"/"+alias)
+			}
+		}
+	}
+	return unknown, nil
+}
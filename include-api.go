@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileDetails is everything known about a single file, as returned by the API
+type FileDetails struct {
+	ID           int                 `json:"id"`
+	Filename     string              `json:"filename"`
+	Path         string              `json:"path"`
+	Description  string              `json:"description"`
+	URL          string              `json:"url"`
+	Size         int64               `json:"size"`
+	Modified     *time.Time          `json:"modified,omitempty"`
+	MediaType    string              `json:"media_type"`
+	Codec        string              `json:"codec,omitempty"`
+	Duration     float64             `json:"duration,omitempty"`
+	Width        int                 `json:"width,omitempty"`
+	Height       int                 `json:"height,omitempty"`
+	Tags         map[string][]string `json:"tags"`
+	ThumbnailURL string              `json:"thumbnail_url,omitempty"`
+	Archived     bool                `json:"archived"`
+	Private      bool                `json:"private"`
+	SourceURL    string              `json:"source_url"`
+}
+
+// writeJSON encodes v as the response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Warning: failed to encode JSON response: %v", err)
+	}
+}
+
+// writeJSONError responds with {"error": message}
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// FileListItem is one file in the GET /api/files listing
+type FileListItem struct {
+	ID          int                 `json:"id"`
+	Filename    string              `json:"filename"`
+	Path        string              `json:"path"`
+	Description string              `json:"description"`
+	Tags        map[string][]string `json:"tags"`
+}
+
+// FileListResponse is one page of the GET /api/files listing
+type FileListResponse struct {
+	Files      []FileListItem `json:"files"`
+	Page       int            `json:"page"`
+	TotalPages int            `json:"total_pages"`
+	PerPage    int            `json:"per_page"`
+}
+
+// acceptsJSON reports whether the Accept header allows a JSON response.
+// A missing header accepts anything.
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		switch strings.TrimSpace(mediaType) {
+		case "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+// apiListFilesHandler serves GET /api/files, the files newest first a page
+// at a time, with the same ?page= and ?per_page= as the HTML pages
+func apiListFilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !acceptsJSON(r) {
+		writeJSONError(w, http.StatusNotAcceptable, "this endpoint only responds with application/json")
+		return
+	}
+
+	page := 1
+	if p := r.URL.Query().Get("page"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, "invalid page: "+p)
+			return
+		}
+		page = n
+	}
+	perPage := pageSize(r)
+
+	ctx := r.Context()
+	var total int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM files f WHERE 1=1"+privateFilter(ctx)).Scan(&total); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	files, err := queryFilesWithTags(ctx, `
+		SELECT f.id, f.filename, f.path, COALESCE(f.description, '')
+		FROM files f
+		WHERE 1=1`+privateFilter(ctx)+`
+		ORDER BY f.id DESC
+		LIMIT ? OFFSET ?`, perPage, (page-1)*perPage)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ids := make([]int, len(files))
+	for i, f := range files {
+		ids[i] = f.ID
+	}
+	tags, err := getTagsForFiles(ctx, ids)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	pagination := calculatePagination(page, total, perPage)
+	resp := FileListResponse{
+		Files:      make([]FileListItem, len(files)),
+		Page:       page,
+		TotalPages: pagination.TotalPages,
+		PerPage:    perPage,
+	}
+	for i, f := range files {
+		fileTags := tags[f.ID]
+		if fileTags == nil {
+			fileTags = map[string][]string{}
+		}
+		resp.Files[i] = FileListItem{ID: f.ID, Filename: f.Filename, Path: f.Path, Description: f.Description, Tags: fileTags}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// apiFileHandler serves GET /api/file/{id}, the file and tags shown on its
+// file page
+func apiFileHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ctx := r.Context()
+	var f FileListItem
+	var private bool
+	err := db.QueryRowContext(ctx, "SELECT id, filename, path, COALESCE(description, ''), COALESCE(private, 0) FROM files WHERE id=?", idStr).
+		Scan(&f.ID, &f.Filename, &f.Path, &f.Description, &private)
+	if err != nil || (private && !showPrivate(ctx)) {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	f.Tags, err = getFileTags(ctx, f.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, f)
+}
+
+// FileTagRequest is the body of POST /api/file/{id}/tags. With
+// copy_previous set, value may be empty or "!" for the category's most
+// recent value on another file, or "!N" for the one N back, as in the tag
+// form; otherwise it is used as given.
+type FileTagRequest struct {
+	Category     string `json:"category"`
+	Value        string `json:"value"`
+	CopyPrevious bool   `json:"copy_previous"`
+}
+
+// apiFileTagsHandler serves POST /api/file/{id}/tags, adding one tag to a
+// file. It responds 201 with the tag, or 409 when the file already has it.
+func apiFileTagsHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req FileTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	category := strings.TrimSpace(req.Category)
+	value := strings.TrimSpace(req.Value)
+	if category == "" || (value == "" && !req.CopyPrevious) {
+		writeJSONError(w, http.StatusBadRequest, "category and value are required")
+		return
+	}
+
+	ctx := r.Context()
+	var fileID int
+	var private bool
+	if err := db.QueryRowContext(ctx, "SELECT id, COALESCE(private, 0) FROM files WHERE id=?", idStr).Scan(&fileID, &private); err != nil || (private && !showPrivate(ctx)) {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	if req.CopyPrevious {
+		back := 1
+		if value != "" {
+			n, ok := parseCopyPrevious(value)
+			if !ok {
+				writeJSONError(w, http.StatusBadRequest, `with copy_previous the value must be empty, "!" or "!N"`)
+				return
+			}
+			back = n
+		}
+		previous, err := getPreviousTagValue(ctx, category, fileID, back)
+		if err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		value = previous
+	}
+
+	catID, tagID, err := getOrCreateCategoryAndTag(ctx, category, value)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to create tag: "+err.Error())
+		return
+	}
+	res, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO file_tags(file_id, tag_id) VALUES (?, ?)", fileID, tagID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to add tag: "+err.Error())
+		return
+	}
+	// Categories keep the spelling they were created with
+	db.QueryRowContext(ctx, "SELECT name FROM categories WHERE id=?", catID).Scan(&category)
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusConflict, "file already has the tag "+category+":"+value)
+		return
+	}
+	invalidateCaches()
+	audit(r, "tag-add", fileTarget(fileID), category+":"+value)
+
+	writeJSON(w, http.StatusCreated, TagPair{Category: category, Value: value})
+}
+
+// apiFileTagRemoveHandler serves DELETE /api/file/{id}/tags/{category}/{value},
+// responding 204 when the tag was removed and 404 when the file did not
+// have it. Slashes in the category or value must be escaped as %2F.
+func apiFileTagRemoveHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// The decoded path has already turned %2F into a slash, so the
+	// segments are taken from the escaped one
+	segments := strings.Split(r.URL.EscapedPath(), "/")
+	if len(segments) != 7 {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	category, err := url.PathUnescape(segments[5])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid category: "+err.Error())
+		return
+	}
+	value, err := url.PathUnescape(segments[6])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid value: "+err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	var fileID int
+	var private bool
+	if err := db.QueryRowContext(ctx, "SELECT id, COALESCE(private, 0) FROM files WHERE id=?", idStr).Scan(&fileID, &private); err != nil || (private && !showPrivate(ctx)) {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	tagID, err := lookupTagID(ctx, category, value)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "file does not have the tag "+category+":"+value)
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	removed, err := removeFileTag(ctx, strconv.Itoa(fileID), tagID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !removed {
+		writeJSONError(w, http.StatusNotFound, "file does not have the tag "+category+":"+value)
+		return
+	}
+	invalidateCaches()
+	audit(r, "tag-remove", fileTarget(fileID), category+":"+value)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiFilesRouter dispatches /api/files/{id}/... requests
+func apiFilesRouter(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/files/"), "/"), "/")
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid file ID")
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "full" {
+		apiFileDetailsHandler(w, r, id)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "suggested-tags" {
+		apiSuggestedTagsHandler(w, r, id)
+		return
+	}
+
+	if len(parts) == 3 && parts[1] == "tags" && parts[2] == "toggle" {
+		apiTagToggleHandler(w, r, id)
+		return
+	}
+
+	writeJSONError(w, http.StatusNotFound, "not found")
+}
+
+func apiFileDetailsHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	details, err := getFileDetails(r.Context(), id)
+	if err == errFileNotFound {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, details)
+}
+
+// getFileDetails gathers the database row, tags, file system details and
+// media information for a file. Media probing is best effort, anything that
+// cannot be determined is left empty.
+func getFileDetails(ctx context.Context, id int) (FileDetails, error) {
+	var d FileDetails
+	err := db.QueryRowContext(ctx, "SELECT id, filename, path, COALESCE(description, ''), COALESCE(archived, 0), COALESCE(private, 0), COALESCE(source_url, '') FROM files WHERE id=?", id).
+		Scan(&d.ID, &d.Filename, &d.Path, &d.Description, &d.Archived, &d.Private, &d.SourceURL)
+	if err != nil || (d.Private && !showPrivate(ctx)) {
+		return d, errFileNotFound
+	}
+
+	d.Tags, err = getFileTags(ctx, d.ID)
+	if err != nil {
+		return d, err
+	}
+
+	escaped := url.PathEscape(d.Filename)
+	d.URL = "/uploads/" + escaped
+
+	d.MediaType = mime.TypeByExtension(strings.ToLower(filepath.Ext(d.Filename)))
+	if d.MediaType == "" {
+		d.MediaType = "application/octet-stream"
+	}
+
+	if m, err := probeFileMetadata(d.Path, d.Filename); err == nil {
+		d.Size = m.Size
+		d.Modified = &m.Modified
+		d.Codec = m.Codec
+		d.Duration = m.Duration
+		d.Width = m.Width
+		d.Height = m.Height
+	}
+
+	if _, err := os.Stat(filepath.Join(config.UploadDir, "thumbnails", d.Filename+".jpg")); err == nil {
+		d.ThumbnailURL = "/uploads/thumbnails/" + escaped + ".jpg"
+	}
+
+	return d, nil
+}
+
+// TagQueryValidation describes how a bulk editor tag query would be interpreted
+type TagQueryValidation struct {
+	Valid    bool      `json:"valid"`
+	Error    string    `json:"error,omitempty"`
+	Operator string    `json:"operator,omitempty"`
+	Tags     []TagPair `json:"tags,omitempty"`
+	Count    int       `json:"count"`
+}
+
+// apiTagQueryValidateHandler parses a tag query and counts the files it
+// matches without changing anything
+func apiTagQueryValidateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	operator, tags, err := parseTagQuery(query)
+	if err != nil {
+		writeJSON(w, http.StatusOK, TagQueryValidation{Error: err.Error()})
+		return
+	}
+
+	fileIDs, err := getFileIDsFromTagQuery(r.Context(), query)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TagQueryValidation{
+		Valid:    true,
+		Operator: operator,
+		Tags:     tags,
+		Count:    len(fileIDs),
+	})
+}
+
+// CategoryValue is one value of a category with the number of files tagged with it
+type CategoryValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+var categoryValueSorts = map[string]string{
+	"count": "COUNT(DISTINCT ft.file_id) DESC, t.value",
+	"name":  "t.value",
+}
+
+// apiCategoriesRouter dispatches /api/categories/{name}/... requests
+func apiCategoriesRouter(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/categories/"), "/"), "/")
+
+	if len(parts) == 2 && parts[0] != "" && parts[1] == "values" {
+		apiCategoryValuesHandler(w, r, parts[0])
+		return
+	}
+
+	writeJSONError(w, http.StatusNotFound, "not found")
+}
+
+// apiCategoryValuesHandler lists a category's values with their file counts,
+// counting only files matching the tag query in q when one is given
+func apiCategoryValuesHandler(w http.ResponseWriter, r *http.Request, category string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "count"
+	}
+	order, ok := categoryValueSorts[sortBy]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid sort: "+sortBy)
+		return
+	}
+
+	ctx := r.Context()
+	var categoryID int
+	if err := db.QueryRowContext(ctx, "SELECT id FROM categories WHERE name=?", category).Scan(&categoryID); err != nil {
+		writeJSONError(w, http.StatusNotFound, "category not found")
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if strings.TrimSpace(query) != "" {
+		if _, _, err := parseTagQuery(query); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	values, err := getCategoryValues(ctx, categoryID, query, order)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"category": category,
+		"values":   values,
+	})
+}
+
+// getCategoryValues counts the files tagged with each value of a category,
+// restricted to the files matching query when it is not empty
+func getCategoryValues(ctx context.Context, categoryID int, query, order string) ([]CategoryValue, error) {
+	where := "t.category_id = ?"
+	args := []interface{}{categoryID}
+
+	if strings.TrimSpace(query) != "" {
+		fileIDs, err := getFileIDsFromTagQuery(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		values := []CategoryValue{}
+		if len(fileIDs) == 0 {
+			return values, nil
+		}
+		placeholders := make([]string, len(fileIDs))
+		for i, id := range fileIDs {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		where += " AND ft.file_id IN (" + strings.Join(placeholders, ",") + ")"
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.value, COUNT(DISTINCT ft.file_id)
+		FROM tags t
+		JOIN file_tags ft ON ft.tag_id = t.id
+		JOIN files f ON f.id = ft.file_id
+		WHERE `+where+privateFilter(ctx)+`
+		GROUP BY t.id
+		ORDER BY `+order, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []CategoryValue{}
+	for rows.Next() {
+		var v CategoryValue
+		if err := rows.Scan(&v.Value, &v.Count); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
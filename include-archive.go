@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Archived files have been moved to the archive directory to free space in
+// the upload directory. Their thumbnails, tags and database rows stay where
+// they are, and /uploads/ falls back to the archive directory, so an archived
+// file is still browsable and can be restored at any time.
+
+// inArchive reports whether a file with this name is in the archive directory
+func inArchive(filename string) bool {
+	if config.ArchiveDir == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(config.ArchiveDir, filename))
+	return err == nil
+}
+
+// moveFile renames src to dst, copying and removing when they are on different file systems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := exportFile(src, dst, "copy"); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// setArchived moves a file into or out of the archive directory and records
+// its new path and archived flag
+func setArchived(ctx context.Context, fileID string, archive bool) error {
+	var f File
+	err := db.QueryRowContext(ctx, "SELECT id, filename, path, COALESCE(archived, 0) FROM files WHERE id=?", fileID).
+		Scan(&f.ID, &f.Filename, &f.Path, &f.Archived)
+	if err != nil {
+		return errFileNotFound
+	}
+
+	if f.Archived == archive {
+		return nil
+	}
+	if config.ArchiveDir == "" {
+		return fmt.Errorf("no archive directory is configured")
+	}
+	if err := checkPathAllowed(f.Path); err != nil {
+		return err
+	}
+
+	destDir := config.UploadDir
+	if archive {
+		destDir = config.ArchiveDir
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", destDir, err)
+	}
+
+	destPath := filepath.Join(destDir, f.Filename)
+	if _, err := os.Stat(destPath); !os.IsNotExist(err) {
+		return errFileExists
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE files SET path=?, archived=? WHERE id=?", destPath, archive, f.ID); err != nil {
+		return fmt.Errorf("failed to update database: %v", err)
+	}
+
+	if err := moveFile(f.Path, destPath); err != nil {
+		return fmt.Errorf("failed to move file: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		moveFile(destPath, f.Path)
+		return fmt.Errorf("failed to update database: %v", err)
+	}
+	invalidateCaches()
+
+	return nil
+}
+
+func fileArchiveHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+		return
+	}
+
+	archive := parts[3] == "archive"
+	if err := setArchived(r.Context(), parts[2], archive); err != nil {
+		switch err {
+		case errFileNotFound:
+			renderError(w, "File not found", http.StatusNotFound)
+		case errFileExists:
+			renderError(w, "A file with that name is already in the destination directory", http.StatusConflict)
+		case errPathNotAllowed:
+			renderError(w, "Refusing to move a file outside the allowed directories", http.StatusForbidden)
+		default:
+			renderError(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	audit(r, parts[3], fileTarget(parts[2]), "")
+
+	http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+}
+
+// uploadsHandler serves /uploads/ from the upload directory, falling back to
+// the archive directory for archived files
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	// Shared thumbnails are only served through the links named after each file
+	if strings.HasPrefix(name, "/thumbnails/shared/") {
+		http.NotFound(w, r)
+		return
+	}
+	if !showPrivate(r.Context()) && isPrivateUpload(r.Context(), name) {
+		http.NotFound(w, r)
+		return
+	}
+	ensureLazyThumbnail(r.Context(), name)
+	if serveFallbackThumbnail(w, r, name) {
+		return
+	}
+	dir := config.UploadDir
+	if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); os.IsNotExist(err) && config.ArchiveDir != "" {
+		dir = config.ArchiveDir
+	}
+	http.FileServer(http.Dir(dir)).ServeHTTP(w, r)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// With audit_log enabled every change made through the web interface is
+// recorded as one row in the audit_log table: what was done, to which file
+// or tag, when and from which client address. The address is the direct
+// peer, so behind a reverse proxy it is the proxy's address.
+
+// AuditEntry is one recorded change
+type AuditEntry struct {
+	ID        int
+	CreatedAt string
+	Action    string
+	Target    string
+	Detail    string
+	ClientIP  string
+}
+
+// FileID returns the ID of the file the entry is about, or "" for other targets
+func (e AuditEntry) FileID() string {
+	if !strings.HasPrefix(e.Target, "file:") {
+		return ""
+	}
+	return strings.TrimPrefix(e.Target, "file:")
+}
+
+// auditActions are the actions recorded, in the order offered as filters
+var auditActions = []string{"upload", "delete", "rename", "archive", "restore", "tag-add", "tag-remove", "tag-move", "tag-rename", "tag-merge", "category-rename", "bulk", "config", "db-restore", "private", "public", "redownload"}
+
+// AuditLogData is the data for the audit log page
+type AuditLogData struct {
+	Entries []AuditEntry
+	Actions []string
+	Action  string
+	Target  string
+	IP      string
+	Enabled bool
+}
+
+func createAuditTable() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		action TEXT,
+		target TEXT,
+		detail TEXT,
+		client_ip TEXT
+	);`)
+	return err
+}
+
+// clientIP returns the address of the client that made the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// fileTarget formats a file ID as an audit target
+func fileTarget(id interface{}) string {
+	return fmt.Sprintf("file:%v", id)
+}
+
+// audit records a change when the audit log is enabled. Failing to record
+// is logged but never fails the change itself.
+func audit(r *http.Request, action, target, detail string) {
+	if config.AuditLog {
+		writeAudit(r, action, target, detail)
+	}
+}
+
+func writeAudit(r *http.Request, action, target, detail string) {
+	_, err := db.ExecContext(context.Background(),
+		"INSERT INTO audit_log (action, target, detail, client_ip) VALUES (?, ?, ?, ?)",
+		action, target, detail, clientIP(r))
+	if err != nil {
+		log.Printf("Warning: failed to write audit log: %v", err)
+	}
+}
+
+// getAuditEntries returns one page of audit entries, newest first, filtered
+// by exact action and client address and by a substring of the target
+func getAuditEntries(ctx context.Context, action, target, ip string, page, perPage int) ([]AuditEntry, int, error) {
+	var conditions []string
+	var args []interface{}
+	if action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, action)
+	}
+	if target != "" {
+		conditions = append(conditions, "target LIKE ?")
+		args = append(args, "%"+target+"%")
+	}
+	if ip != "" {
+		conditions = append(conditions, "client_ip = ?")
+		args = append(args, ip)
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM audit_log "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, created_at, COALESCE(action, ''), COALESCE(target, ''), COALESCE(detail, ''), COALESCE(client_ip, '')
+		FROM audit_log `+where+`
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?`, append(args, perPage, (page-1)*perPage)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.Action, &e.Target, &e.Detail, &e.ClientIP); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
+
+func auditLogHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, perPage := reportPage(r)
+
+	data := AuditLogData{
+		Actions: auditActions,
+		Action:  query.Get("action"),
+		Target:  strings.TrimSpace(query.Get("target")),
+		IP:      strings.TrimSpace(query.Get("ip")),
+		Enabled: config.AuditLog,
+	}
+
+	entries, total, err := getAuditEntries(r.Context(), data.Action, data.Target, data.IP, page, perPage)
+	if err != nil {
+		renderError(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	data.Entries = entries
+
+	pageData := buildPageDataWithPagination(r.Context(), "Audit Log", data, page, total, perPage, query)
+	renderTemplate(w, "audit.html", pageData)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// POST /api/bulk applies a bulk edit from a script. The files are picked by
+// exactly one of an ID range, a tag query or a search query, and the edit
+// adds or removes a tag or deletes the files. As a safety check nothing is
+// changed unless confirm_count equals the number of files selected: a
+// request without it only reports that number, and one with a different
+// number is refused with 409 Conflict.
+//
+// A tag edit is all or nothing by default. With "mode": "best_effort" the
+// files that can be changed are, and those that cannot are reported in
+// results with their error. IDs of a range with no file, or with a private
+// file the request may not see, are reported as not found. Deleting is
+// always done file by file. results lists what happened to every file.
+//
+//	{"selection": {"tag_query": "colour:blue"}, "operation": "add", "category": "shade", "value": "dark", "confirm_count": 12}
+
+// BulkSelection picks the files of a bulk API request
+type BulkSelection struct {
+	Range    string `json:"range,omitempty"`
+	TagQuery string `json:"tag_query,omitempty"`
+	Search   string `json:"search,omitempty"`
+}
+
+// BulkRequest is the body of POST /api/bulk
+type BulkRequest struct {
+	Selection    BulkSelection `json:"selection"`
+	Operation    string        `json:"operation"`
+	Category     string        `json:"category,omitempty"`
+	Value        string        `json:"value,omitempty"`
+	Mode         string        `json:"mode,omitempty"`
+	ConfirmCount *int          `json:"confirm_count,omitempty"`
+}
+
+// BulkResponse reports what a bulk API request selected and changed
+type BulkResponse struct {
+	Operation string           `json:"operation"`
+	Selected  int              `json:"selected"`
+	FileIDs   []int            `json:"file_ids"`
+	Applied   bool             `json:"applied"`
+	Affected  int64            `json:"affected"`
+	Failures  []string         `json:"failures,omitempty"`
+	Results   []BulkFileResult `json:"results,omitempty"`
+}
+
+// bulkAPIOperations are the operations POST /api/bulk accepts
+var bulkAPIOperations = map[string]bool{"add": true, "remove": true, "delete": true}
+
+// resolveBulkSelection returns the IDs of the files a selection picks that
+// the context may see. With bestEffort the IDs of a range are returned as
+// they are, to be reported one by one when they have no file the context may
+// see; the operations themselves leave hidden private files alone.
+func resolveBulkSelection(ctx context.Context, s BulkSelection, bestEffort bool) ([]int, error) {
+	given := 0
+	for _, v := range []*string{&s.Range, &s.TagQuery, &s.Search} {
+		if *v = strings.TrimSpace(*v); *v != "" {
+			given++
+		}
+	}
+	if given != 1 {
+		return nil, fmt.Errorf("selection must have exactly one of range, tag_query or search")
+	}
+
+	switch {
+	case s.Range != "":
+		ids, err := parseFileIDRange(s.Range)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file range: %v", err)
+		}
+		if bestEffort {
+			return ids, nil
+		}
+		return visibleFileIDs(ctx, ids)
+	case s.TagQuery != "":
+		ids, err := getFileIDsFromTagQuery(ctx, s.TagQuery)
+		if err != nil {
+			return nil, fmt.Errorf("tag query error: %v", err)
+		}
+		return ids, nil
+	default:
+		files, err := searchFiles(ctx, s.Search, "id")
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]int, len(files))
+		for i, f := range files {
+			ids[i] = f.ID
+		}
+		return ids, nil
+	}
+}
+
+// visibleFileIDs checks every file in ids exists and the context may see it
+func visibleFileIDs(ctx context.Context, ids []int) ([]int, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no file IDs provided")
+	}
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	rows, err := db.QueryContext(ctx, "SELECT f.id FROM files f WHERE f.id IN ("+strings.Join(placeholders, ",")+")"+privateFilter(ctx), args...)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	defer rows.Close()
+
+	found := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		found[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var missing []int
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("file IDs not found: %v", missing)
+	}
+	return ids, nil
+}
+
+// apiBulkHandler serves POST /api/bulk
+func apiBulkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req BulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	req.Category = strings.TrimSpace(req.Category)
+	req.Value = strings.TrimSpace(req.Value)
+
+	if !bulkAPIOperations[req.Operation] {
+		writeJSONError(w, http.StatusBadRequest, "operation must be one of: add, remove, delete")
+		return
+	}
+	if req.Operation != "delete" && req.Category == "" {
+		writeJSONError(w, http.StatusBadRequest, "category cannot be empty")
+		return
+	}
+	if req.Operation == "add" && req.Value == "" {
+		writeJSONError(w, http.StatusBadRequest, "value cannot be empty when adding tags")
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "transactional"
+	}
+	if !bulkModes[req.Mode] {
+		writeJSONError(w, http.StatusBadRequest, "mode must be one of: transactional, best_effort")
+		return
+	}
+	bestEffort := req.Mode == "best_effort"
+
+	ctx := r.Context()
+	fileIDs, err := resolveBulkSelection(ctx, req.Selection, bestEffort)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp := BulkResponse{Operation: req.Operation, Selected: len(fileIDs), FileIDs: fileIDs}
+	if resp.FileIDs == nil {
+		resp.FileIDs = []int{}
+	}
+	if req.ConfirmCount == nil {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	if *req.ConfirmCount != len(fileIDs) {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"error":    fmt.Sprintf("confirm_count is %d but the selection has %d files", *req.ConfirmCount, len(fileIDs)),
+			"selected": len(fileIDs),
+		})
+		return
+	}
+	if len(fileIDs) == 0 {
+		resp.Applied = true
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	if req.Operation == "delete" {
+		for _, id := range fileIDs {
+			f, err := deleteFile(ctx, fmt.Sprint(id))
+			if err != nil {
+				resp.Failures = append(resp.Failures, fmt.Sprintf("%d: %v", id, err))
+				resp.Results = append(resp.Results, BulkFileResult{FileID: id, Error: err.Error()})
+				continue
+			}
+			resp.Affected++
+			resp.Results = append(resp.Results, BulkFileResult{FileID: id, Changed: true})
+			audit(r, "delete", fileTarget(f.ID), f.Filename)
+		}
+	} else {
+		resp.Affected, resp.Results, err = applyBulkTagOperations(ctx, fileIDs, req.Category, req.Value, req.Operation, bestEffort)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "tag operation failed: "+err.Error())
+			return
+		}
+		changed := 0
+		for _, res := range resp.Results {
+			if res.Error != "" {
+				resp.Failures = append(resp.Failures, fmt.Sprintf("%d: %s", res.FileID, res.Error))
+			} else {
+				changed++
+			}
+		}
+		invalidateCaches()
+		audit(r, "bulk", "tag:"+req.Category+":"+req.Value, fmt.Sprintf("%s on %d files via API", req.Operation, changed))
+	}
+	resp.Applied = true
+
+	writeJSON(w, http.StatusOK, resp)
+}
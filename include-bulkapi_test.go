@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBulkDeleteSkipsPrivateFilesWhenLoggedOut(t *testing.T) {
+	newTestDB(t)
+	config.AccessPassword = "pw"
+
+	if err := os.MkdirAll(config.UploadDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	public := addTestFile(t, "public.jpg")
+	private := addTestFile(t, "private.jpg")
+	for _, name := range []string{"public.jpg", "private.jpg"} {
+		if err := os.WriteFile(filepath.Join(config.UploadDir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("UPDATE files SET private = 1 WHERE id = ?", private); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"selection": {"range": "1-2"}, "operation": "delete", "mode": "best_effort", "confirm_count": 2}`
+	w := httptest.NewRecorder()
+	withVisibility(http.HandlerFunc(apiBulkHandler)).ServeHTTP(w, httptest.NewRequest("POST", "/api/bulk", strings.NewReader(body)))
+
+	var resp BulkResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	if resp.Affected != 1 {
+		t.Errorf("deleted %d files, want 1: %+v", resp.Affected, resp.Results)
+	}
+	for _, res := range resp.Results {
+		switch res.FileID {
+		case public:
+			if !res.Changed {
+				t.Errorf("public file was not deleted: %q", res.Error)
+			}
+		case private:
+			if res.Error != errFileNotFound.Error() {
+				t.Errorf("private file result = %+v, want %q", res, errFileNotFound)
+			}
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), visibilityKey{}, true)
+	var n int
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM files WHERE id = ?", private).Scan(&n)
+	if n != 1 {
+		t.Error("private file was deleted by a logged-out request")
+	}
+	if _, err := os.Stat(filepath.Join(config.UploadDir, "private.jpg")); err != nil {
+		t.Errorf("private file on disk: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// The bulk tag editor starts on the configured default operation. With
+// bulk_remember enabled it instead starts on the operation and category used
+// last, kept in session cookies so they last until the browser is closed.
+
+const (
+	bulkOperationCookie = "bulk_operation"
+	bulkCategoryCookie  = "bulk_category"
+)
+
+// bulkOperations are the operations the bulk tag editor can apply
+var bulkOperations = map[string]bool{"add": true, "remove": true}
+
+// restoreBulkForm fills in the operation and category remembered from the
+// last bulk edit in this session
+func restoreBulkForm(r *http.Request, data *BulkTagFormData) {
+	if !config.BulkRemember {
+		return
+	}
+	if c, err := r.Cookie(bulkOperationCookie); err == nil && bulkOperations[c.Value] {
+		data.FormData.Operation = c.Value
+	}
+	if c, err := r.Cookie(bulkCategoryCookie); err == nil {
+		if category, err := url.QueryUnescape(c.Value); err == nil {
+			data.FormData.Category = category
+		}
+	}
+}
+
+// rememberBulkForm keeps the operation and category of a successful bulk
+// edit for the next visit in this session
+func rememberBulkForm(w http.ResponseWriter, operation, category string) {
+	if !config.BulkRemember {
+		return
+	}
+	for name, value := range map[string]string{bulkOperationCookie: operation, bulkCategoryCookie: url.QueryEscape(category)} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     "/bulk-tag",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Caches hold data derived from the database or the upload directory.
+//
+// Invalidation contract: every handler that changes files, tags or categories
+// must call invalidateCaches() once its change has been committed, so no
+// cache serves data from before the change. Caches rebuild lazily on the next
+// read. On shutdown flushCaches() gives caches that persist anything a chance
+// to write it out before the database is closed.
+type cache interface {
+	Invalidate()
+	Flush() error
+}
+
+var (
+	cachesMu sync.Mutex
+	caches   = map[string]cache{}
+)
+
+// registerCache adds a cache to the registry under a unique name
+func registerCache(name string, c cache) {
+	cachesMu.Lock()
+	defer cachesMu.Unlock()
+	caches[name] = c
+}
+
+// invalidateCaches drops the contents of every registered cache
+func invalidateCaches() {
+	cachesMu.Lock()
+	defer cachesMu.Unlock()
+	for _, c := range caches {
+		c.Invalidate()
+	}
+}
+
+// flushCaches persists every registered cache, logging any failures
+func flushCaches() {
+	cachesMu.Lock()
+	defer cachesMu.Unlock()
+	for name, c := range caches {
+		if err := c.Flush(); err != nil {
+			log.Printf("Warning: failed to flush %s cache: %v", name, err)
+		}
+	}
+}
+
+// tagDataCache keeps the tag counts shown in the navigation menu, which
+// would otherwise be recomputed on every page render. Logged-out visitors
+// get counts over public files only, so there is one cache for each.
+type tagDataCache struct {
+	mu      sync.Mutex
+	private bool
+	data    []TagCategory
+}
+
+var (
+	publicTagCache = &tagDataCache{}
+	allTagCache    = &tagDataCache{private: true}
+)
+
+func init() {
+	registerCache("public tag data", publicTagCache)
+	registerCache("tag data", allTagCache)
+}
+
+// tagCacheFor picks the tag data cache for what the request may see
+func tagCacheFor(ctx context.Context) *tagDataCache {
+	if showPrivate(ctx) {
+		return allTagCache
+	}
+	return publicTagCache
+}
+
+func (c *tagDataCache) get() ([]TagCategory, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data != nil {
+		return c.data, nil
+	}
+
+	ctx := context.Background()
+	if c.private {
+		ctx = context.WithValue(ctx, visibilityKey{}, true)
+	}
+	data, err := getTagData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.data = data
+	return data, nil
+}
+
+func (c *tagDataCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = nil
+}
+
+func (c *tagDataCache) Flush() error {
+	return nil
+}
+
+// reportCacheTTL is how long an admin report is reused. Reports scan the
+// upload directory, so paging through one should not rescan it every page.
+const reportCacheTTL = 30 * time.Second
+
+// reportCache keeps the result of an expensive admin report for a short
+// time. Besides expiring, it is dropped by invalidateCaches, so files added
+// or removed through the web interface show up straight away.
+type reportCache[T any] struct {
+	mu    sync.Mutex
+	build func() (T, error)
+	data  T
+	built time.Time
+}
+
+var (
+	orphansReport           = &reportCache[[]string]{build: func() ([]string, error) { return getOrphanedFiles(config.UploadDir) }}
+	missingThumbnailsReport = &reportCache[[]VideoFile]{build: getMissingThumbnailVideos}
+)
+
+func init() {
+	registerCache("orphans report", orphansReport)
+	registerCache("missing thumbnails report", missingThumbnailsReport)
+}
+
+func (c *reportCache[T]) get() (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.built.IsZero() && time.Since(c.built) < reportCacheTTL {
+		return c.data, nil
+	}
+
+	data, err := c.build()
+	if err != nil {
+		return data, err
+	}
+	c.data = data
+	c.built = time.Now()
+	return data, nil
+}
+
+func (c *reportCache[T]) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero T
+	c.data = zero
+	c.built = time.Time{}
+}
+
+func (c *reportCache[T]) Flush() error {
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A card is a PNG summarising a file for sharing where links are not
+// unfurled: the thumbnail on the left, the filename and tags on the right,
+// in the same bitmap font as the placeholders. It is drawn on every request
+// so it always shows the current tags.
+const (
+	cardWidth        = 800
+	cardHeight       = 420
+	cardPadding      = 30
+	cardThumbSize    = cardHeight - 2*cardPadding
+	cardTitleScale   = 3
+	cardTagScale     = 2
+	cardLineSpacing  = 2
+	cardMaxTitleRows = 2
+)
+
+var (
+	cardBackground = color.RGBA{0x22, 0x22, 0x22, 0xff}
+	cardTitleColor = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	cardTagColor   = color.RGBA{0xcc, 0xcc, 0xcc, 0xff}
+)
+
+// truncateText shortens text to at most max characters, marking the cut with "..."
+func truncateText(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	if max <= 3 {
+		return string(runes[:max])
+	}
+	return string(runes[:max-3]) + "..."
+}
+
+// wrapText splits text into at most rows lines of width characters, the
+// last one truncated if the text does not fit
+func wrapText(text string, width, rows int) []string {
+	runes := []rune(text)
+	var lines []string
+	for len(runes) > 0 && len(lines) < rows-1 && len(runes) > width {
+		lines = append(lines, string(runes[:width]))
+		runes = runes[width:]
+	}
+	if len(runes) > 0 {
+		lines = append(lines, truncateText(string(runes), width))
+	}
+	return lines
+}
+
+// cardThumbnail returns the image shown on a file's card: the image itself,
+// its generated thumbnail, or the placeholder for its extension
+func cardThumbnail(f File) image.Image {
+	candidates := []string{filepath.Join(config.UploadDir, "thumbnails", f.Filename+".jpg")}
+	if ext := strings.ToLower(filepath.Ext(f.Filename)); ext == ".jpg" || ext == ".jpeg" || ext == ".png" {
+		candidates = append([]string{f.Path}, candidates...)
+	}
+
+	for _, path := range candidates {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		img, _, err := image.Decode(file)
+		file.Close()
+		if err != nil {
+			log.Printf("Card: Failed to decode %s: %v", path, err)
+			continue
+		}
+		return img
+	}
+	return generatePlaceholder(placeholderExt(f.Filename))
+}
+
+// generateCard draws the card for a file with the given tags
+func generateCard(f File, tags map[string][]string) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, cardWidth, cardHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{cardBackground}, image.Point{}, draw.Src)
+
+	thumb := resizeImage(cardThumbnail(f), cardThumbSize, cardThumbSize)
+	b := thumb.Bounds()
+	drawImage(img, thumb, cardPadding+(cardThumbSize-b.Dx())/2, cardPadding+(cardThumbSize-b.Dy())/2)
+
+	x := 2*cardPadding + cardThumbSize
+	y := cardPadding
+	textWidth := cardWidth - x - cardPadding
+
+	titleChars := (textWidth/cardTitleScale + 1) / 6
+	for _, line := range wrapText(f.Filename, titleChars, cardMaxTitleRows) {
+		drawBitmapText(img, line, x, y, cardTitleScale, cardTitleColor)
+		y += (7 + cardLineSpacing) * cardTitleScale
+	}
+	y += 3 * cardTagScale * cardLineSpacing
+
+	categories := make([]string, 0, len(tags))
+	for cat := range tags {
+		categories = append(categories, cat)
+	}
+	sort.Strings(categories)
+
+	// Leave room for the "+N more" line whenever the tags do not all fit
+	tagChars := (textWidth/cardTagScale + 1) / 6
+	lineHeight := (7 + cardLineSpacing) * cardTagScale
+	maxLines := (cardHeight - cardPadding - y) / lineHeight
+	for i, cat := range categories {
+		if maxLines == 1 && i < len(categories)-1 {
+			drawBitmapText(img, fmt.Sprintf("+%d more", len(categories)-i), x, y, cardTagScale, cardTagColor)
+			break
+		}
+		if maxLines == 0 {
+			break
+		}
+		line := truncateText(cat+": "+strings.Join(tags[cat], ", "), tagChars)
+		drawBitmapText(img, line, x, y, cardTagScale, cardTagColor)
+		y += lineHeight
+		maxLines--
+	}
+
+	return img
+}
+
+// fileCardHandler serves /file/{id}/card.png
+func fileCardHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	ctx := r.Context()
+	var f File
+	err := db.QueryRowContext(ctx, "SELECT id, filename, path, COALESCE(private, 0) FROM files WHERE id=?", parts[2]).
+		Scan(&f.ID, &f.Filename, &f.Path, &f.Private)
+	if err != nil {
+		renderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if f.Private && !showPrivate(ctx) {
+		requireLogin(w, r)
+		return
+	}
+
+	tags, err := getFileTags(ctx, f.ID)
+	if err != nil {
+		renderError(w, "Failed to load tags", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, generateCard(f, tags)); err != nil {
+		renderError(w, "Failed to encode card", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Category names are matched without case, so "Colour" and "colour" are the
+// same category. The name column is declared COLLATE NOCASE, which makes
+// every lookup by name case-insensitive, and a category keeps the spelling
+// it was first created with. Databases from older versions may already hold
+// case variants of a category. When the column is upgraded they are merged
+// into the variant tagged on the most files, or the oldest on a tie, and
+// that spelling is the one shown from then on.
+
+// migrateCategoryCase merges case variants of categories and rebuilds the
+// categories table with a case-insensitive name, once
+func migrateCategoryCase(ctx context.Context) error {
+	var schema string
+	if err := db.QueryRowContext(ctx, "SELECT sql FROM sqlite_master WHERE type='table' AND name='categories'").Scan(&schema); err != nil {
+		return err
+	}
+	if strings.Contains(strings.ToUpper(schema), "COLLATE NOCASE") {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	merged, err := mergeCategoryCaseVariants(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range []string{
+		"CREATE TABLE categories_nocase (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT UNIQUE COLLATE NOCASE)",
+		"INSERT INTO categories_nocase(id, name) SELECT id, name FROM categories",
+		"DROP TABLE categories",
+		"ALTER TABLE categories_nocase RENAME TO categories",
+	} {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to make category names case-insensitive: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %v", err)
+	}
+	for _, m := range merged {
+		log.Printf("Merged category %s", m)
+	}
+	return nil
+}
+
+// mergeCategoryCaseVariants moves the tags of every case variant of a
+// category into the variant that is kept, and describes each merge
+func mergeCategoryCaseVariants(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	// Variants come most used first within each lowercased name
+	rows, err := tx.QueryContext(ctx, `
+		SELECT c.id, c.name
+		FROM categories c
+		LEFT JOIN tags t ON t.category_id = c.id
+		LEFT JOIN file_tags ft ON ft.tag_id = t.id
+		WHERE LOWER(c.name) IN (
+			SELECT LOWER(name) FROM categories GROUP BY LOWER(name) HAVING COUNT(*) > 1
+		)
+		GROUP BY c.id
+		ORDER BY LOWER(c.name), COUNT(ft.file_id) DESC, c.id`)
+	if err != nil {
+		return nil, err
+	}
+	type category struct {
+		id   int64
+		name string
+	}
+	var variants []category
+	for rows.Next() {
+		var c category
+		if err := rows.Scan(&c.id, &c.name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		variants = append(variants, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var merged []string
+	var keep category
+	for _, c := range variants {
+		if keep.name == "" || !strings.EqualFold(keep.name, c.name) {
+			keep = c
+			continue
+		}
+
+		tags, err := tx.QueryContext(ctx, "SELECT id, value FROM tags WHERE category_id=?", c.id)
+		if err != nil {
+			return nil, err
+		}
+		type tag struct {
+			id    int
+			value string
+		}
+		var moving []tag
+		for tags.Next() {
+			var t tag
+			if err := tags.Scan(&t.id, &t.value); err != nil {
+				tags.Close()
+				return nil, err
+			}
+			moving = append(moving, t)
+		}
+		tags.Close()
+		if err := tags.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, t := range moving {
+			if _, err := moveTagInTx(ctx, tx, t.id, t.value, keep.id); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM categories WHERE id=?", c.id); err != nil {
+			return nil, fmt.Errorf("failed to remove category %s: %v", c.name, err)
+		}
+		merged = append(merged, fmt.Sprintf("%s into %s (%d tags)", c.name, keep.name, len(moving)))
+	}
+	return merged, nil
+}
@@ -4,14 +4,21 @@ import (
 	"archive/zip"
 	"fmt"
 	"image"
+	"image/color"
 	"image/jpeg"
+	_ "image/png"
+	"io"
 	"log"
+	"mime"
 	"net/http"
-	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
 )
 
 // generateCBZThumbnail creates a 2x2 collage thumbnail from a CBZ file
@@ -24,6 +31,10 @@ func generateCBZThumbnail(cbzPath, uploadDir, filename string) error {
 	}
 
 	thumbPath := filepath.Join(thumbDir, filename+".jpg")
+	hash := thumbnailHash(cbzPath)
+	if linkSharedThumbnail(hash, thumbPath, ".jpg") {
+		return nil
+	}
 
 	// Open the CBZ (ZIP) file
 	r, err := zip.OpenReader(cbzPath)
@@ -32,26 +43,13 @@ func generateCBZThumbnail(cbzPath, uploadDir, filename string) error {
 	}
 	defer r.Close()
 
-	// Get list of image files from the archive
-	var imageFiles []*zip.File
-	for _, f := range r.File {
-		if !f.FileInfo().IsDir() {
-			ext := strings.ToLower(filepath.Ext(f.Name))
-			if ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".webp" {
-				imageFiles = append(imageFiles, f)
-			}
-		}
-	}
+	// Get sorted list of image files from the archive
+	imageFiles := getCBZImageFiles(&r.Reader)
 
 	if len(imageFiles) == 0 {
 		return fmt.Errorf("no images found in CBZ")
 	}
 
-	// Sort files by name to get consistent ordering
-	sort.Slice(imageFiles, func(i, j int) bool {
-		return imageFiles[i].Name < imageFiles[j].Name
-	})
-
 	// Select up to 4 images evenly distributed
 	var selectedFiles []*zip.File
 	if len(imageFiles) <= 4 {
@@ -92,6 +90,7 @@ func generateCBZThumbnail(cbzPath, uploadDir, filename string) error {
 	collage := createCollage(images, 400) // 400px target width
 
 	// Save as JPEG
+	unshareThumbnail(thumbPath)
 	outFile, err := os.Create(thumbPath)
 	if err != nil {
 		return fmt.Errorf("failed to create thumbnail file: %v", err)
@@ -102,10 +101,28 @@ func generateCBZThumbnail(cbzPath, uploadDir, filename string) error {
 		return fmt.Errorf("failed to encode JPEG: %v", err)
 	}
 
+	shareThumbnail(hash, thumbPath, ".jpg")
 	return nil
 }
 
-// createCollage creates a 2x2 grid from up to 4 images
+// parseHexColor parses a #rgb or #rrggbb colour
+func parseHexColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if !strings.HasPrefix(s, "#") || (len(hex) != 3 && len(hex) != 6) {
+		return color.RGBA{}, fmt.Errorf("%q is not a #rgb or #rrggbb colour", s)
+	}
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("%q is not a #rgb or #rrggbb colour", s)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, nil
+}
+
+// createCollage creates a 2x2 grid from up to 4 images, each letterboxed
+// and centred in its cell on the configured thumbnail background
 func createCollage(images []image.Image, targetWidth int) image.Image {
 	// Calculate cell size (half of target width)
 	cellSize := targetWidth / 2
@@ -113,10 +130,13 @@ func createCollage(images []image.Image, targetWidth int) image.Image {
 	// Create output image
 	collageImg := image.NewRGBA(image.Rect(0, 0, targetWidth, targetWidth))
 
-	// Fill with white background
+	background, err := parseHexColor(config.ThumbnailBackground)
+	if err != nil {
+		background = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	}
 	for y := 0; y < targetWidth; y++ {
 		for x := 0; x < targetWidth; x++ {
-			collageImg.Set(x, y, image.White)
+			collageImg.Set(x, y, background)
 		}
 	}
 
@@ -137,9 +157,10 @@ func createCollage(images []image.Image, targetWidth int) image.Image {
 		// Resize image to fit cell
 		resized := resizeImage(img, cellSize, cellSize)
 
-		// Draw at position
+		// Draw centred in its cell so every cell is the same size
 		pos := positions[i]
-		drawImage(collageImg, resized, pos.X, pos.Y)
+		b := resized.Bounds()
+		drawImage(collageImg, resized, pos.X+(cellSize-b.Dx())/2, pos.Y+(cellSize-b.Dy())/2)
 	}
 
 	return collageImg
@@ -162,17 +183,17 @@ func resizeImage(img image.Image, maxWidth, maxHeight int) image.Image {
 	newWidth := int(float64(srcWidth) * scale)
 	newHeight := int(float64(srcHeight) * scale)
 
+	// Nothing to resample when the size does not change
+	if newWidth == srcWidth && newHeight == srcHeight {
+		return img
+	}
+
 	// Create new image
 	dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
 
-	// Simple nearest-neighbor scaling
-	for y := 0; y < newHeight; y++ {
-		for x := 0; x < newWidth; x++ {
-			srcX := int(float64(x) / scale)
-			srcY := int(float64(y) / scale)
-			dst.Set(x, y, img.At(srcX+bounds.Min.X, srcY+bounds.Min.Y))
-		}
-	}
+	// Catmull-Rom resampling, which keeps line art smooth where
+	// nearest-neighbour scaling left it jagged
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
 
 	return dst
 }
@@ -187,6 +208,70 @@ func drawImage(dst *image.RGBA, src image.Image, x, y int) {
 	}
 }
 
+// getCBZImageFiles returns the image entries of a CBZ archive in natural
+// name order, so that page2.jpg comes before page10.jpg
+func getCBZImageFiles(r *zip.Reader) []*zip.File {
+	var imageFiles []*zip.File
+	for _, f := range r.File {
+		if !f.FileInfo().IsDir() {
+			ext := strings.ToLower(filepath.Ext(f.Name))
+			if ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".webp" {
+				imageFiles = append(imageFiles, f)
+			}
+		}
+	}
+
+	sort.Slice(imageFiles, func(i, j int) bool {
+		return naturalLess(imageFiles[i].Name, imageFiles[j].Name)
+	})
+
+	return imageFiles
+}
+
+// naturalLess compares two names in runs of digits and non-digits, with the
+// digit runs compared as numbers, so page9 < page10 and page09 < page10.
+// Names that only differ in zero padding fall back to plain order.
+func naturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		ca, cb := a[i], b[j]
+		if !isDigit(ca) || !isDigit(cb) {
+			if ca != cb {
+				return ca < cb
+			}
+			i++
+			j++
+			continue
+		}
+
+		// Compare the numbers without their leading zeros: a longer run is
+		// larger, and runs of the same length compare as strings
+		si, sj := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		na := strings.TrimLeft(a[si:i], "0")
+		nb := strings.TrimLeft(b[sj:j], "0")
+		if len(na) != len(nb) {
+			return len(na) < len(nb)
+		}
+		if na != nb {
+			return na < nb
+		}
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
 // CBZImage represents a single image within a CBZ file
 type CBZImage struct {
 	Filename string
@@ -202,26 +287,11 @@ func getCBZImages(cbzPath string) ([]CBZImage, error) {
 	defer r.Close()
 
 	var images []CBZImage
-	for i, f := range r.File {
-		if !f.FileInfo().IsDir() {
-			ext := strings.ToLower(filepath.Ext(f.Name))
-			if ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".webp" {
-				images = append(images, CBZImage{
-					Filename: f.Name,
-					Index:    i,
-				})
-			}
-		}
-	}
-
-	// Sort by filename for consistent ordering
-	sort.Slice(images, func(i, j int) bool {
-		return images[i].Filename < images[j].Filename
-	})
-
-	// Re-index after sorting
-	for i := range images {
-		images[i].Index = i
+	for i, f := range getCBZImageFiles(&r.Reader) {
+		images = append(images, CBZImage{
+			Filename: f.Name,
+			Index:    i,
+		})
 	}
 
 	return images, nil
@@ -236,19 +306,7 @@ func serveCBZImage(w http.ResponseWriter, cbzPath string, imageIndex int) error
 	defer r.Close()
 
 	// Get sorted list of images
-	var imageFiles []*zip.File
-	for _, f := range r.File {
-		if !f.FileInfo().IsDir() {
-			ext := strings.ToLower(filepath.Ext(f.Name))
-			if ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".webp" {
-				imageFiles = append(imageFiles, f)
-			}
-		}
-	}
-
-	sort.Slice(imageFiles, func(i, j int) bool {
-		return imageFiles[i].Name < imageFiles[j].Name
-	})
+	imageFiles := getCBZImageFiles(&r.Reader)
 
 	if imageIndex < 0 || imageIndex >= len(imageFiles) {
 		return fmt.Errorf("image index out of range")
@@ -267,6 +325,11 @@ func serveCBZImage(w http.ResponseWriter, cbzPath string, imageIndex int) error
 		w.Header().Set("Content-Type", "image/webp")
 	}
 
+	// Name the page after the comic so saving it gives e.g. "Comic-p007.jpg"
+	comicName := strings.TrimSuffix(filepath.Base(cbzPath), filepath.Ext(cbzPath))
+	pageName := fmt.Sprintf("%s-p%0*d%s", comicName, len(strconv.Itoa(len(imageFiles))), imageIndex+1, ext)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": pageName}))
+
 	rc, err := targetFile.Open()
 	if err != nil {
 		return err
@@ -277,6 +340,117 @@ func serveCBZImage(w http.ResponseWriter, cbzPath string, imageIndex int) error
 	return err
 }
 
+// cbzPDFPage holds what is needed to place one CBZ image on a PDF page
+type cbzPDFPage struct {
+	file        *zip.File
+	width       int
+	height      int
+	passthrough bool // JPEG data can be embedded without re-encoding
+	colorSpace  string
+}
+
+// serveCBZAsPDF streams every image in a CBZ file as a PDF download, one image per page.
+// Pages are read and written one at a time so large archives are never held in memory.
+// Every page is checked before anything is sent, so an error can still be answered
+// with an error page; one after the PDF has started, such as a closed connection,
+// is only logged.
+func serveCBZAsPDF(w http.ResponseWriter, cbzPath, pdfName string) error {
+	r, err := zip.OpenReader(cbzPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Check every page up front so the page count is known and no page fails
+	// after the PDF has started
+	var pages []cbzPDFPage
+	for _, f := range getCBZImageFiles(&r.Reader) {
+		rc, err := f.Open()
+		if err != nil {
+			log.Printf("CBZ PDF: Failed to open %s: %v", f.Name, err)
+			continue
+		}
+		cfg, format, err := image.DecodeConfig(rc)
+		rc.Close()
+		if err != nil {
+			log.Printf("CBZ PDF: Skipping %s: %v", f.Name, err)
+			continue
+		}
+
+		page := cbzPDFPage{file: f, width: cfg.Width, height: cfg.Height, colorSpace: "DeviceRGB"}
+		if format == "jpeg" {
+			switch cfg.ColorModel {
+			case color.YCbCrModel:
+				page.passthrough = true
+			case color.GrayModel:
+				page.passthrough = true
+				page.colorSpace = "DeviceGray"
+			}
+		}
+		if !page.passthrough {
+			if err := decodeCBZPage(f); err != nil {
+				log.Printf("CBZ PDF: Skipping %s: %v", f.Name, err)
+				continue
+			}
+		}
+		pages = append(pages, page)
+	}
+
+	if len(pages) == 0 {
+		return fmt.Errorf("no readable images found in CBZ")
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": pdfName}))
+
+	pdf, err := newPDFWriter(w, len(pages))
+	if err != nil {
+		log.Printf("CBZ PDF: Failed to write %s: %v", pdfName, err)
+		return nil
+	}
+
+	for _, page := range pages {
+		err := pdf.writeImagePage(page.width, page.height, page.colorSpace, func(out io.Writer) error {
+			rc, err := page.file.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			if page.passthrough {
+				_, err = io.Copy(out, rc)
+				return err
+			}
+
+			img, _, err := image.Decode(rc)
+			if err != nil {
+				return fmt.Errorf("failed to decode %s: %v", page.file.Name, err)
+			}
+			return jpeg.Encode(out, img, &jpeg.Options{Quality: 90})
+		})
+		if err != nil {
+			log.Printf("CBZ PDF: Failed to write %s: %v", pdfName, err)
+			return nil
+		}
+	}
+
+	if err := pdf.close(); err != nil {
+		log.Printf("CBZ PDF: Failed to write %s: %v", pdfName, err)
+	}
+	return nil
+}
+
+// decodeCBZPage checks a page of a CBZ file decodes as a whole, not just its header
+func decodeCBZPage(f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, _, err = image.Decode(rc)
+	return err
+}
+
 // cbzViewerHandler handles the CBZ gallery viewer
 func cbzViewerHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract file ID from URL
@@ -290,12 +464,16 @@ func cbzViewerHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get the file from database
 	var f File
-	err := db.QueryRow("SELECT id, filename, path, COALESCE(description, '') FROM files WHERE id = ?", fileID).
-		Scan(&f.ID, &f.Filename, &f.Path, &f.Description)
+	err := db.QueryRowContext(r.Context(), "SELECT id, filename, path, COALESCE(description, ''), COALESCE(private, 0) FROM files WHERE id = ?", fileID).
+		Scan(&f.ID, &f.Filename, &f.Path, &f.Description, &f.Private)
 	if err != nil {
 		renderError(w, "File not found", http.StatusNotFound)
 		return
 	}
+	if f.Private && !showPrivate(r.Context()) {
+		requireLogin(w, r)
+		return
+	}
 
 	cbzPath := filepath.Join(config.UploadDir, f.Filename)
 
@@ -310,6 +488,16 @@ func cbzViewerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check if requesting the whole archive as a PDF
+	if len(parts) >= 2 && parts[1] == "pdf" {
+		pdfName := strings.TrimSuffix(f.Filename, filepath.Ext(f.Filename)) + ".pdf"
+		if err := serveCBZAsPDF(w, cbzPath, pdfName); err != nil {
+			log.Printf("CBZ PDF: Failed to export %s: %v", f.Filename, err)
+			renderError(w, "Failed to export PDF", http.StatusInternalServerError)
+		}
+		return
+	}
+
 	// Get list of images
 	images, err := getCBZImages(cbzPath)
 	if err != nil {
@@ -323,6 +511,11 @@ func cbzViewerHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Sscanf(parts[1], "%d", &currentIndex)
 	}
 
+	if r.Method == http.MethodPost {
+		cbzPageNoteHandler(w, r, f, currentIndex, len(images))
+		return
+	}
+
 	if currentIndex < 0 {
 		currentIndex = 0
 	}
@@ -330,6 +523,17 @@ func cbzViewerHandler(w http.ResponseWriter, r *http.Request) {
 		currentIndex = len(images) - 1
 	}
 
+	notes, err := getCBZPageNotes(r.Context(), f.ID)
+	if err != nil {
+		renderError(w, "Failed to load page notes", http.StatusInternalServerError)
+		return
+	}
+	f.Tags, err = getFileTags(r.Context(), f.ID)
+	if err != nil {
+		renderError(w, "Failed to load tags", http.StatusInternalServerError)
+		return
+	}
+
 	// Prepare data for template
 	type CBZViewData struct {
 		File         File
@@ -338,6 +542,8 @@ func cbzViewerHandler(w http.ResponseWriter, r *http.Request) {
 		TotalImages  int
 		HasPrev      bool
 		HasNext      bool
+		PageNote     CBZPageNote
+		PageNotes    map[int]CBZPageNote
 	}
 
 	viewData := CBZViewData{
@@ -347,9 +553,11 @@ func cbzViewerHandler(w http.ResponseWriter, r *http.Request) {
 		TotalImages:  len(images),
 		HasPrev:      currentIndex > 0,
 		HasNext:      currentIndex < len(images)-1,
+		PageNote:     notes[currentIndex],
+		PageNotes:    notes,
 	}
 
-	pageData := buildPageData(f.Filename, viewData)
+	pageData := buildPageData(r.Context(), f.Filename, viewData)
 
 	renderTemplate(w, "cbz_viewer.html", pageData)
 }
\ No newline at end of file
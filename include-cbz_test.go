@@ -0,0 +1,61 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServeCBZAsPDFSkipsBrokenPages(t *testing.T) {
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(out) })
+
+	var page bytes.Buffer
+	if err := png.Encode(&page, image.NewRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second page has a valid header but is cut short, so it only fails
+	// once it is decoded
+	cbzPath := filepath.Join(t.TempDir(), "comic.cbz")
+	f, err := os.Create(cbzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, data := range map[string][]byte{
+		"01.png": page.Bytes(),
+		"02.png": page.Bytes()[:page.Len()/2],
+	} {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	w := httptest.NewRecorder()
+	if err := serveCBZAsPDF(w, cbzPath, "comic.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "%PDF-") || !strings.HasSuffix(strings.TrimSpace(body), "%%EOF") {
+		t.Fatalf("response is not a whole PDF: %.40q ... %.40q", body, body[max(0, len(body)-40):])
+	}
+	if !strings.Contains(body, "/Count 1 ") {
+		t.Error("the broken page was not left out of the PDF")
+	}
+}
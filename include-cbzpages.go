@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Pages of a CBZ can carry their own note and tags, keyed by the file and
+// the page's index in the viewer. Page tags are free text labels rather
+// than category tags, and the viewer shows them next to the tags the page
+// inherits from its comic. Notes and page tags are searchable.
+
+// maxPageNoteLength is the longest note a page can have
+const maxPageNoteLength = 2048
+
+// CBZPageNote is the note and tags of one CBZ page
+type CBZPageNote struct {
+	FileID int
+	Page   int
+	Note   string
+	Tags   []string
+}
+
+func createCBZPagesTable() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS cbz_pages (
+		file_id INTEGER,
+		page_index INTEGER,
+		note TEXT DEFAULT '',
+		tags TEXT DEFAULT '',
+		PRIMARY KEY (file_id, page_index)
+	);`)
+	return err
+}
+
+// parsePageTags splits a comma separated list of page tags, dropping
+// duplicates and blanks
+func parsePageTags(list string) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, tag := range parseList(list) {
+		if key := strings.ToLower(tag); !seen[key] {
+			seen[key] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// getCBZPageNotes returns the annotated pages of a file by page index
+func getCBZPageNotes(ctx context.Context, fileID int) (map[int]CBZPageNote, error) {
+	rows, err := db.QueryContext(ctx, "SELECT page_index, note, tags FROM cbz_pages WHERE file_id=?", fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := make(map[int]CBZPageNote)
+	for rows.Next() {
+		n := CBZPageNote{FileID: fileID}
+		var tags string
+		if err := rows.Scan(&n.Page, &n.Note, &tags); err != nil {
+			return nil, err
+		}
+		n.Tags = parsePageTags(tags)
+		notes[n.Page] = n
+	}
+	return notes, rows.Err()
+}
+
+// saveCBZPageNote stores a page's note and tags, removing the page's entry
+// when both are empty
+func saveCBZPageNote(ctx context.Context, n CBZPageNote) error {
+	if n.Note == "" && len(n.Tags) == 0 {
+		_, err := db.ExecContext(ctx, "DELETE FROM cbz_pages WHERE file_id=? AND page_index=?", n.FileID, n.Page)
+		return err
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO cbz_pages (file_id, page_index, note, tags) VALUES (?, ?, ?, ?)
+		ON CONFLICT(file_id, page_index) DO UPDATE SET note=excluded.note, tags=excluded.tags`,
+		n.FileID, n.Page, n.Note, strings.Join(n.Tags, ", "))
+	return err
+}
+
+// CBZPageResult is a CBZ page matched by a search
+type CBZPageResult struct {
+	CBZPageNote
+	Filename string
+}
+
+// searchCBZPages returns the pages whose note or tags match query, where *
+// and ? are wildcards as in searchFiles
+func searchCBZPages(ctx context.Context, query string) ([]CBZPageResult, error) {
+	sqlPattern := "%" + strings.ReplaceAll(strings.ReplaceAll(strings.ToLower(query), "*", "%"), "?", "_") + "%"
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.file_id, p.page_index, p.note, p.tags, f.filename
+		FROM cbz_pages p
+		JOIN files f ON f.id = p.file_id
+		WHERE (LOWER(p.note) LIKE ? OR LOWER(p.tags) LIKE ?)`+privateFilter(ctx)+`
+		ORDER BY f.filename, f.id, p.page_index`, sqlPattern, sqlPattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []CBZPageResult
+	for rows.Next() {
+		var res CBZPageResult
+		var tags string
+		if err := rows.Scan(&res.FileID, &res.Page, &res.Note, &tags, &res.Filename); err != nil {
+			return nil, err
+		}
+		res.Tags = parsePageTags(tags)
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// cbzPageNoteHandler saves the note and tags posted for /cbz/{id}/{page}
+func cbzPageNoteHandler(w http.ResponseWriter, r *http.Request, f File, page, totalPages int) {
+	if page < 0 || page >= totalPages {
+		renderError(w, "Page not found", http.StatusNotFound)
+		return
+	}
+
+	note := strings.TrimSpace(r.FormValue("note"))
+	if len(note) > maxPageNoteLength {
+		note = note[:maxPageNoteLength]
+	}
+	n := CBZPageNote{FileID: f.ID, Page: page, Note: note, Tags: parsePageTags(r.FormValue("page_tags"))}
+	if err := saveCBZPageNote(r.Context(), n); err != nil {
+		renderError(w, fmt.Sprintf("Failed to save page note: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/cbz/"+strconv.Itoa(f.ID)+"/"+strconv.Itoa(page), http.StatusSeeOther)
+}
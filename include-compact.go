@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Compact mode makes browsing lighter on a slow connection. It is switched
+// on with ?compact=1 or the compact cookie, which the link in the menu sets,
+// and ?compact=0 turns it off for one request. Galleries then show small
+// cached JPEG previews instead of full size images and thumbnails, pages
+// hold fewer files unless ?per_page= asks otherwise, and videos on the file
+// page are not loaded until played.
+
+// compactCookie is the cookie that keeps compact mode on between visits
+const compactCookie = "compact"
+
+// compactItemsPerPage is the largest default page size in compact mode
+const compactItemsPerPage = 20
+
+// compactThumbnailSize is the largest width and height of a compact preview
+const compactThumbnailSize = 160
+
+// compactMode reports whether the request asked for compact pages
+func compactMode(r *http.Request) bool {
+	if v := r.URL.Query().Get("compact"); v != "" {
+		return v == "1"
+	}
+	c, err := r.Cookie(compactCookie)
+	return err == nil && c.Value == "1"
+}
+
+// galleryThumbnailURL picks the preview shown for a file in a gallery
+func galleryThumbnailURL(f File, compact bool) string {
+	escaped := url.PathEscape(f.Filename)
+	switch {
+	case compact:
+		return "/compact/" + escaped + ".jpg"
+	case isGalleryImage(f.Filename) && !hasImageThumbnail(f.Filename):
+		return "/uploads/" + escaped
+	default:
+		return "/uploads/thumbnails/" + escaped + ".jpg"
+	}
+}
+
+// isGalleryImage reports whether a gallery shows a file as itself rather
+// than through its thumbnail
+func isGalleryImage(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return true
+	}
+	return false
+}
+
+// compactThumbnailPath is where the compact preview of a file is cached
+func compactThumbnailPath(filename string) string {
+	return filepath.Join(config.UploadDir, "thumbnails", "compact", filename+".jpg")
+}
+
+// compactThumbnailSource returns the image a compact preview is made from:
+// the file itself for images, otherwise its thumbnail
+func compactThumbnailSource(ctx context.Context, path, filename string) string {
+	if isGalleryImage(filename) {
+		return path
+	}
+	ensureLazyThumbnail(ctx, "/thumbnails/"+filename+".jpg")
+	return filepath.Join(config.UploadDir, "thumbnails", filename+".jpg")
+}
+
+// decodeImageFile reads and fully decodes an image file, so a truncated
+// file is an error rather than a partial image
+func decodeImageFile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	return img, nil
+}
+
+// makeCompactThumbnail writes a downscaled JPEG copy of src to dst
+func makeCompactThumbnail(src, dst string) error {
+	img, err := decodeImageFile(src)
+	if err != nil {
+		return err
+	}
+	if b := img.Bounds(); b.Dx() > compactThumbnailSize || b.Dy() > compactThumbnailSize {
+		img = resizeImage(img, compactThumbnailSize, compactThumbnailSize)
+	}
+
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create compact thumbnails directory: %v", err)
+	}
+
+	// Write to a temporary file first so concurrent requests never serve a partial image
+	tmp, err := os.CreateTemp(dir, "compact.*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create compact thumbnail: %v", err)
+	}
+	if err := jpeg.Encode(tmp, img, &jpeg.Options{Quality: 70}); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to encode compact thumbnail: %v", err)
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to save compact thumbnail: %v", err)
+	}
+	return nil
+}
+
+// compactThumbnailHandler serves /compact/{filename}.jpg. Files that cannot
+// be decoded are redirected to their usual preview.
+func compactThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/compact/"), ".jpg")
+	if !ok || filename == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	var path string
+	var private bool
+	err := db.QueryRowContext(ctx, "SELECT path, COALESCE(private, 0) FROM files WHERE filename=?", filename).Scan(&path, &private)
+	if err != nil || (private && !showPrivate(ctx)) {
+		http.NotFound(w, r)
+		return
+	}
+
+	dst, err := ensureCompactThumbnail(ctx, path, filename)
+	if err != nil {
+		http.Redirect(w, r, galleryThumbnailURL(File{Filename: filename}, false), http.StatusFound)
+		return
+	}
+
+	http.ServeFile(w, r, dst)
+}
+
+// ensureCompactThumbnail returns the compact preview of a file, making it
+// when it is missing or older than its source
+func ensureCompactThumbnail(ctx context.Context, path, filename string) (string, error) {
+	src := compactThumbnailSource(ctx, path, filename)
+	dst := compactThumbnailPath(filename)
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if dstInfo, err := os.Stat(dst); err != nil || dstInfo.ModTime().Before(srcInfo.ModTime()) {
+		if err := makeCompactThumbnail(src, dst); err != nil {
+			return "", err
+		}
+	}
+	return dst, nil
+}
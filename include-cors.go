@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// corsMethods are the methods that may be listed in cors_allowed_methods
+var corsMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true,
+}
+
+// parseList splits a comma separated setting, dropping empty entries
+func parseList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validateCORSConfig checks the CORS origins are "*" or a bare scheme://host[:port]
+// and the methods are ones the API understands
+func validateCORSConfig(origins, methods []string) error {
+	for _, origin := range origins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("CORS origin %q must be * or look like https://example.com", origin)
+		}
+	}
+	if len(origins) > 0 && len(methods) == 0 {
+		return fmt.Errorf("at least one CORS method is required when CORS origins are set")
+	}
+	for _, method := range methods {
+		if !corsMethods[method] {
+			return fmt.Errorf("CORS method %q is not supported", method)
+		}
+	}
+	return nil
+}
+
+// corsOriginAllowed reports whether cross-origin requests from origin are allowed
+func corsOriginAllowed(origin string) bool {
+	origin = strings.TrimSuffix(origin, "/")
+	for _, allowed := range config.CORSOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS adds CORS headers for allowed origins and answers preflight
+// requests. With no origins configured only same-origin requests work.
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		allowed := origin != "" && corsOriginAllowed(origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !allowed {
+				writeJSONError(w, http.StatusForbidden, "origin not allowed")
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(config.CORSMethods, ", "))
+			if len(config.CORSHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(config.CORSHeaders, ", "))
+			}
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// /dashboard gives an overview of the library: how many files there are and
+// how many still need tags, how many categories and tags are in use, and the
+// files added most recently. Logged-out visitors only see public files
+// counted. It can be the home page through the default_view setting.
+
+// dashboardRecentFiles is how many recently added files are shown
+const dashboardRecentFiles = 12
+
+// DashboardData is the data for the dashboard page
+type DashboardData struct {
+	Files      int
+	Tagged     int
+	Untagged   int
+	Categories int
+	Tags       int
+	Recent     []File
+}
+
+// getDashboardData counts the library and loads the most recent files
+func getDashboardData(ctx context.Context) (DashboardData, error) {
+	var d DashboardData
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(EXISTS (SELECT 1 FROM file_tags ft WHERE ft.file_id = f.id)), 0)
+		FROM files f
+		WHERE 1=1`+privateFilter(ctx)).Scan(&d.Files, &d.Tagged)
+	if err != nil {
+		return d, err
+	}
+	d.Untagged = d.Files - d.Tagged
+
+	if err := db.QueryRowContext(ctx, "SELECT (SELECT COUNT(*) FROM categories), (SELECT COUNT(*) FROM tags)").
+		Scan(&d.Categories, &d.Tags); err != nil {
+		return d, err
+	}
+
+	d.Recent, err = queryFilesWithTags(ctx, `
+		SELECT f.id, f.filename, f.path, COALESCE(f.description, '') as description
+		FROM files f
+		WHERE 1=1`+privateFilter(ctx)+`
+		ORDER BY f.id DESC
+		LIMIT ?`, dashboardRecentFiles)
+	return d, err
+}
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := getDashboardData(r.Context())
+	if err != nil {
+		renderError(w, "Failed to load dashboard: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pageData := buildPageData(r.Context(), "Dashboard", data)
+	prepareGallery(&pageData, r, data.Recent)
+	renderTemplate(w, "dashboard.html", pageData)
+}
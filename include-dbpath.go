@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Changing database_path only takes effect on restart, so until then the
+// server keeps reading and writing the database it opened. Backups, vacuum
+// and restore work on that open database rather than the configured path,
+// and the admin page says which one is in use. Nothing is copied between
+// the two files.
+
+// openDatabasePath is the path of the database behind db
+var openDatabasePath string
+
+// databasePathChange describes what happens when the database path is
+// changed to newPath, or returns "" when it is the open database
+func databasePathChange(newPath string) string {
+	if newPath == openDatabasePath {
+		return ""
+	}
+	next := "a new, empty database will be created there"
+	if _, err := os.Stat(newPath); err == nil {
+		next = "the database already there will be used"
+	}
+	return fmt.Sprintf("The server is still using the database at %s. After a restart it will use %s instead and %s. "+
+		"Files and tags recorded in the database are not copied; copy %s there first to keep them.",
+		openDatabasePath, newPath, next, openDatabasePath)
+}
+
+// databasePathWarning is shown on the admin page while the configured
+// database path differs from the open one
+func databasePathWarning() string {
+	return databasePathChange(config.DatabasePath)
+}
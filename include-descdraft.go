@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+)
+
+// description_drafts keeps what is typed into a file's description box as a
+// draft while it is being edited, so navigating away does not lose it. The
+// draft is stored in its own column next to the description and only
+// replaces it when the description is saved. The file page offers to
+// restore or discard a draft left from an earlier visit. Saving or
+// cancelling the edit clears it.
+//
+// /file/{id}/draft takes the draft as a POST with a description field and
+// answers with JSON, GET returns the stored draft, and a POST with
+// action=discard clears it and returns to the file page.
+
+// getDescriptionDraft returns a file's draft, or "" when it has none
+func getDescriptionDraft(ctx context.Context, fileID string) (string, error) {
+	var draft sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT description_draft FROM files WHERE id=?", fileID).Scan(&draft)
+	return draft.String, err
+}
+
+// saveDescriptionDraft stores text as a file's draft, clearing it when
+// text is the same as the saved description
+func saveDescriptionDraft(ctx context.Context, fileID, text string) error {
+	if len(text) > maxDescriptionLength {
+		text = text[:maxDescriptionLength]
+	}
+	_, err := db.ExecContext(ctx, `
+		UPDATE files
+		SET description_draft = CASE WHEN ? = COALESCE(description, '') THEN NULL ELSE ? END
+		WHERE id=?`, text, text, fileID)
+	return err
+}
+
+// clearDescriptionDraft removes a file's draft
+func clearDescriptionDraft(ctx context.Context, fileID string) error {
+	_, err := db.ExecContext(ctx, "UPDATE files SET description_draft = NULL WHERE id=?", fileID)
+	return err
+}
+
+// fileDraftHandler saves, returns and discards the description draft of a file
+func fileDraftHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	ctx := r.Context()
+	if !config.DescriptionDrafts {
+		writeJSONError(w, http.StatusNotFound, "description drafts are turned off")
+		return
+	}
+
+	var private bool
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(private, 0) FROM files WHERE id=?", parts[2]).Scan(&private)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if private && !showPrivate(ctx) {
+		writeJSONError(w, http.StatusForbidden, "log in to edit this file")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		draft, err := getDescriptionDraft(ctx, parts[2])
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"draft": draft, "has_draft": draft != ""})
+	case http.MethodPost:
+		if r.FormValue("action") == "discard" {
+			if err := clearDescriptionDraft(ctx, parts[2]); err != nil {
+				renderError(w, "Failed to discard draft", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+			return
+		}
+		if err := saveDescriptionDraft(ctx, parts[2], r.FormValue("description")); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"saved": true})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "use GET or POST")
+	}
+}
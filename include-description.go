@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// New files get their description from the description_template setting,
+// e.g. "Imported on {date} from {source}". An empty template leaves new
+// files without a description.
+
+// maxDescriptionLength is the longest description a file can have
+const maxDescriptionLength = 2048
+
+// Sources a file can be added from, as substituted for {source}
+const (
+	sourceUpload = "upload"
+	sourceURL    = "url"
+	sourceYtdlp  = "yt-dlp"
+	sourceScan   = "scan"
+)
+
+// fileOrigin describes where a newly added file came from
+type fileOrigin struct {
+	Source       string
+	OriginalName string
+	URL          string
+}
+
+// descriptionPlaceholders are the placeholders a description template may use
+var descriptionPlaceholders = map[string]func(o fileOrigin) string{
+	"date":     func(fileOrigin) string { return time.Now().Format("2006-01-02") },
+	"source":   func(o fileOrigin) string { return o.Source },
+	"filename": func(o fileOrigin) string { return o.OriginalName },
+}
+
+var descriptionPlaceholderPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// validateDescriptionTemplate rejects placeholders that would never be replaced
+func validateDescriptionTemplate(template string) error {
+	for _, m := range descriptionPlaceholderPattern.FindAllStringSubmatch(template, -1) {
+		if _, ok := descriptionPlaceholders[m[1]]; !ok {
+			return fmt.Errorf("unknown placeholder {%s}, use {date}, {source} or {filename}", m[1])
+		}
+	}
+	if len(template) > maxDescriptionLength {
+		return fmt.Errorf("must be at most %d characters", maxDescriptionLength)
+	}
+	return nil
+}
+
+// defaultDescription fills in the description template for a new file
+func defaultDescription(o fileOrigin) string {
+	description := descriptionPlaceholderPattern.ReplaceAllStringFunc(config.DescriptionTemplate, func(p string) string {
+		if fn, ok := descriptionPlaceholders[strings.Trim(p, "{}")]; ok {
+			return fn(o)
+		}
+		return p
+	})
+	if len(description) > maxDescriptionLength {
+		description = description[:maxDescriptionLength]
+	}
+	return description
+}
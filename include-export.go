@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExportResult is one value folder created by a tag export
+type ExportResult struct {
+	Category string
+	Value    string
+	Dir      string
+	Files    int
+}
+
+// exportTagTree materialises the given categories as exportDir/category/value/
+// folders, linking or copying every file into each value folder it is tagged with
+func exportTagTree(ctx context.Context, categories []string, exportDir, mode string) ([]ExportResult, error) {
+	if len(categories) == 0 {
+		return nil, fmt.Errorf("no categories given")
+	}
+	if mode != "symlink" && mode != "copy" {
+		return nil, fmt.Errorf("invalid export mode: %s (must be 'symlink' or 'copy')", mode)
+	}
+
+	placeholders := make([]string, len(categories))
+	args := make([]interface{}, len(categories))
+	for i, c := range categories {
+		placeholders[i] = "?"
+		args[i] = c
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT c.name, t.value, f.filename, f.path
+		FROM file_tags ft
+		JOIN tags t ON t.id = ft.tag_id
+		JOIN categories c ON c.id = t.category_id
+		JOIN files f ON f.id = ft.file_id
+		WHERE c.name IN (%s)
+		ORDER BY c.name, t.value, f.filename`, strings.Join(placeholders, ",")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []ExportResult
+	for rows.Next() {
+		var category, value, filename, path string
+		if err := rows.Scan(&category, &value, &filename, &path); err != nil {
+			return results, err
+		}
+
+		if len(results) == 0 || results[len(results)-1].Category != category || results[len(results)-1].Value != value {
+			dir := filepath.Join(exportDir, sanitizeFilename(category), sanitizeFilename(value))
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return results, fmt.Errorf("failed to create %s: %v", dir, err)
+			}
+			results = append(results, ExportResult{Category: category, Value: value, Dir: dir})
+		}
+
+		current := &results[len(results)-1]
+		if err := exportFile(path, filepath.Join(current.Dir, filename), mode); err != nil {
+			return results, fmt.Errorf("failed to export %s: %v", filename, err)
+		}
+		current.Files++
+	}
+
+	return results, rows.Err()
+}
+
+// exportFile places a symlink to or a copy of src at dst, replacing anything already there
+func exportFile(src, dst, mode string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	}
+
+	if mode == "symlink" {
+		absSrc, err := filepath.Abs(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(absSrc, dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func handleExportTags(w http.ResponseWriter, r *http.Request) {
+	categoryList := strings.TrimSpace(r.FormValue("export_categories"))
+	mode := r.FormValue("export_mode")
+	if mode == "" {
+		mode = config.ExportMode
+	}
+
+	var categories []string
+	for _, c := range strings.Split(categoryList, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			categories = append(categories, c)
+		}
+	}
+
+	results, err := exportTagTree(r.Context(), categories, config.ExportDir, mode)
+
+	adminData := AdminData{
+		Config:           config,
+		Error:            errorString(err),
+		ExportCategories: categoryList,
+		ExportResults:    results,
+	}
+	if err == nil {
+		total := 0
+		for _, res := range results {
+			total += res.Files
+		}
+		adminData.Success = fmt.Sprintf("Exported %d entries into %d folders under %s", total, len(results), config.ExportDir)
+	}
+
+	renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+}
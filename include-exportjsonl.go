@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// /admin/export.jsonl streams every file as JSON Lines, one object per line,
+// for libraries too large to export as a single document. Files are read
+// in batches of exportBatchSize by ID, with the tags of each batch loaded in
+// one query, and each batch is flushed to the client before the next is
+// read. Metadata is what is stored in the database; nothing is probed.
+//
+//	{"id": 1, "filename": "a.jpg", "path": "uploads/a.jpg", ..., "tags": {"artist": ["Someone"]}}
+
+// exportBatchSize is how many files are read and written at a time
+const exportBatchSize = 500
+
+// FileExportLine is one line of the JSON Lines export
+type FileExportLine struct {
+	ID          int                 `json:"id"`
+	Filename    string              `json:"filename"`
+	Path        string              `json:"path"`
+	Description string              `json:"description"`
+	Hash        string              `json:"hash,omitempty"`
+	SourceURL   string              `json:"source_url,omitempty"`
+	Size        int64               `json:"size,omitempty"`
+	Modified    string              `json:"modified,omitempty"`
+	Codec       string              `json:"codec,omitempty"`
+	Width       int                 `json:"width,omitempty"`
+	Height      int                 `json:"height,omitempty"`
+	Duration    float64             `json:"duration,omitempty"`
+	Archived    bool                `json:"archived"`
+	Private     bool                `json:"private"`
+	Tags        map[string][]string `json:"tags"`
+}
+
+// getTagsForFiles returns the tag values of several files grouped by
+// category, loaded in one query
+func getTagsForFiles(ctx context.Context, fileIDs []int) (map[int]map[string][]string, error) {
+	tags := make(map[int]map[string][]string, len(fileIDs))
+	if len(fileIDs) == 0 {
+		return tags, nil
+	}
+
+	placeholders := make([]string, len(fileIDs))
+	args := make([]interface{}, len(fileIDs))
+	for i, id := range fileIDs {
+		placeholders[i] = "?"
+		args[i] = id
+		tags[id] = make(map[string][]string)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT ft.file_id, c.name, t.value
+		FROM tags t
+		JOIN categories c ON c.id = t.category_id
+		JOIN file_tags ft ON ft.tag_id = t.id
+		WHERE ft.file_id IN (`+strings.Join(placeholders, ",")+`)
+		ORDER BY ft.file_id, `+fileTagOrder, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var cat, val string
+		if err := rows.Scan(&id, &cat, &val); err != nil {
+			return nil, err
+		}
+		tags[id][cat] = append(tags[id][cat], val)
+	}
+	return tags, rows.Err()
+}
+
+// getExportBatch returns up to exportBatchSize files with IDs above afterID
+func getExportBatch(ctx context.Context, afterID int) ([]FileExportLine, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT f.id, f.filename, f.path, COALESCE(f.description, ''), COALESCE(f.hash, ''),
+		       COALESCE(f.source_url, ''), COALESCE(f.size, 0), COALESCE(f.modified, ''),
+		       COALESCE(f.codec, ''), COALESCE(f.width, 0), COALESCE(f.height, 0),
+		       COALESCE(f.duration, 0), COALESCE(f.archived, 0), COALESCE(f.private, 0)
+		FROM files f
+		WHERE f.id > ?`+privateFilter(ctx)+`
+		ORDER BY f.id
+		LIMIT ?`, afterID, exportBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []FileExportLine
+	for rows.Next() {
+		var l FileExportLine
+		if err := rows.Scan(&l.ID, &l.Filename, &l.Path, &l.Description, &l.Hash,
+			&l.SourceURL, &l.Size, &l.Modified, &l.Codec, &l.Width, &l.Height,
+			&l.Duration, &l.Archived, &l.Private); err != nil {
+			return nil, err
+		}
+		batch = append(batch, l)
+	}
+	return batch, rows.Err()
+}
+
+// writeExportJSONL writes every file the context may see to w as JSON
+// Lines, calling flush after each batch. It returns how many files were
+// written, which is short of the total when it fails.
+func writeExportJSONL(ctx context.Context, w io.Writer, flush func() error) (int, error) {
+	enc := json.NewEncoder(w)
+	afterID, written := 0, 0
+	for {
+		batch, err := getExportBatch(ctx, afterID)
+		if err != nil || len(batch) == 0 {
+			return written, err
+		}
+
+		ids := make([]int, len(batch))
+		for i, l := range batch {
+			ids[i] = l.ID
+		}
+		tags, err := getTagsForFiles(ctx, ids)
+		if err != nil {
+			return written, err
+		}
+
+		for _, l := range batch {
+			l.Tags = tags[l.ID]
+			if err := enc.Encode(l); err != nil {
+				return written, err
+			}
+			written++
+		}
+		if err := flush(); err != nil {
+			return written, err
+		}
+		afterID = batch[len(batch)-1].ID
+	}
+}
+
+// handleExportJSONL serves /admin/export.jsonl
+func handleExportJSONL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		renderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="files-%s.jsonl"`, time.Now().Format("20060102-150405")))
+
+	// Once a line is written the status is sent, so a later failure can
+	// only cut the export short
+	written, err := writeExportJSONL(r.Context(), w, http.NewResponseController(w).Flush)
+	if err != nil {
+		if written == 0 {
+			w.Header().Del("Content-Disposition")
+			renderError(w, "Failed to export files: "+err.Error(), http.StatusInternalServerError)
+		}
+		log.Printf("Warning: JSON Lines export stopped after %d files: %v", written, err)
+	}
+}
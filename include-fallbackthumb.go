@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A thumbnail that failed to generate, or has not been made yet, is
+// answered with a fallback tile for the file's media type instead of a
+// broken image. The built-in tiles are drawn like the placeholders, with
+// the type's name on its colour, and cached next to the thumbnails.
+// fallback_thumbnails maps a media type to an image of the user's own to
+// use instead. For audio, PDF and other files, which never get a thumbnail,
+// a configured image also replaces their placeholder.
+
+// fallbackThumbnailTypes are the media types a fallback can be set for, in
+// the order the settings list them
+var fallbackThumbnailTypes = []string{"video", "image", "comic", "audio", "pdf", "other"}
+
+// fallbackThumbnailColors are the tile colours of the built-in fallbacks
+var fallbackThumbnailColors = map[string]color.RGBA{
+	"video": {0x8e, 0x3a, 0x3a, 0xff},
+	"image": {0x3a, 0x8e, 0x5c, 0xff},
+	"comic": {0x8e, 0x7a, 0x3a, 0xff},
+	"audio": {0x6c, 0x3a, 0x8e, 0xff},
+	"pdf":   {0x3a, 0x6c, 0x8e, 0xff},
+	"other": placeholderDefaultColor,
+}
+
+// audioExtensions are the extensions of the audio media type
+var audioExtensions = []string{".mp3", ".m4a", ".flac", ".wav", ".ogg", ".opus", ".aac"}
+
+// mediaType returns which fallback a file uses
+func mediaType(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch {
+	case isVideoFile(filename):
+		return "video"
+	case ext == ".cbz":
+		return "comic"
+	case ext == ".pdf":
+		return "pdf"
+	case isGalleryImage(filename):
+		return "image"
+	}
+	for _, audio := range audioExtensions {
+		if ext == audio {
+			return "audio"
+		}
+	}
+	return "other"
+}
+
+// mediaTypeExtensions lists the extensions of a media type, or nil for
+// "other", which covers every extension not listed elsewhere
+func mediaTypeExtensions(kind string) []string {
+	switch kind {
+	case "video":
+		return config.VideoExtensions
+	case "image":
+		return []string{".jpg", ".jpeg", ".png", ".gif", ".webp"}
+	case "comic":
+		return []string{".cbz"}
+	case "pdf":
+		return []string{".pdf"}
+	case "audio":
+		return audioExtensions
+	}
+	return nil
+}
+
+// generateFallbackThumbnail draws the built-in fallback of a media type:
+// its name on the type's colour inside a lighter frame
+func generateFallbackThumbnail(kind string) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, placeholderWidth, placeholderHeight))
+	c := fallbackThumbnailColors[kind]
+	draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+
+	frame := color.RGBA{uint8((int(c.R) + 0xff) / 2), uint8((int(c.G) + 0xff) / 2), uint8((int(c.B) + 0xff) / 2), 0xff}
+	const inset, thickness = 16, 4
+	outer := image.Rect(inset, inset, placeholderWidth-inset, placeholderHeight-inset)
+	draw.Draw(img, outer, &image.Uniform{frame}, image.Point{}, draw.Src)
+	draw.Draw(img, outer.Inset(thickness), &image.Uniform{c}, image.Point{}, draw.Src)
+
+	label := strings.ToUpper(kind)
+	scale := placeholderWidth / 2 / bitmapTextWidth(len(label), 1)
+	if scale > 8 {
+		scale = 8
+	}
+	x0 := (placeholderWidth - bitmapTextWidth(len(label), scale)) / 2
+	y0 := (placeholderHeight - 7*scale) / 2
+	drawBitmapText(img, label, x0, y0, scale, color.White)
+
+	return img
+}
+
+// fallbackThumbnailPath returns the fallback of a media type: the
+// configured image when there is one, otherwise the built-in tile,
+// generating it if needed
+func fallbackThumbnailPath(kind string) (string, error) {
+	if custom := config.FallbackThumbnails[kind]; custom != "" {
+		if _, err := os.Stat(custom); err == nil {
+			return custom, nil
+		}
+		log.Printf("Warning: fallback thumbnail for %s not found: %s", kind, custom)
+	}
+
+	dir := filepath.Join(config.UploadDir, "thumbnails", "placeholders")
+	path := filepath.Join(dir, "fallback-"+kind+".png")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create placeholders directory: %v", err)
+	}
+
+	// Write to a temporary file first so concurrent requests never serve a partial image
+	tmp, err := os.CreateTemp(dir, "fallback-"+kind+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create fallback thumbnail: %v", err)
+	}
+	if err := png.Encode(tmp, generateFallbackThumbnail(kind)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to encode fallback thumbnail: %v", err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to save fallback thumbnail: %v", err)
+	}
+	return path, nil
+}
+
+// serveFallbackThumbnail answers a request for the missing thumbnail name,
+// a path under the uploads directory, with the fallback for its file's
+// type. It reports false for anything that is not a thumbnail or exists.
+func serveFallbackThumbnail(w http.ResponseWriter, r *http.Request, name string) bool {
+	filename, ok := strings.CutPrefix(name, "/thumbnails/")
+	if !ok || strings.Contains(filename, "/") {
+		return false
+	}
+	filename, ok = strings.CutSuffix(filename, ".jpg")
+	if !ok || filename == "" || strings.HasSuffix(filename, ".sprite") {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(config.UploadDir, "thumbnails", filename+".jpg")); err == nil {
+		return false
+	}
+	if config.ArchiveDir != "" {
+		if _, err := os.Stat(filepath.Join(config.ArchiveDir, "thumbnails", filename+".jpg")); err == nil {
+			return false
+		}
+	}
+
+	path, err := fallbackThumbnailPath(mediaType(filename))
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return false
+	}
+	// The real thumbnail may be made later, so the fallback is never cached
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, path)
+	return true
+}
+
+// fallbackThumbnailsFromForm reads the fallback image of each media type
+// from the settings form, leaving out the ones left empty
+func fallbackThumbnailsFromForm(r *http.Request) map[string]string {
+	var fallbacks map[string]string
+	for _, kind := range fallbackThumbnailTypes {
+		if path := strings.TrimSpace(r.FormValue("fallback_thumbnail_" + kind)); path != "" {
+			if fallbacks == nil {
+				fallbacks = make(map[string]string)
+			}
+			fallbacks[kind] = path
+		}
+	}
+	return fallbacks
+}
+
+// validateFallbackThumbnails checks every configured fallback is an image
+// the server can read
+func validateFallbackThumbnails(c Config) error {
+	for kind, path := range c.FallbackThumbnails {
+		if path == "" {
+			continue
+		}
+		if _, ok := fallbackThumbnailColors[kind]; !ok {
+			return fmt.Errorf("unknown fallback thumbnail type: %s", kind)
+		}
+		if _, err := decodeImageFile(path); err != nil {
+			return fmt.Errorf("fallback thumbnail for %s is not a readable image: %v", kind, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// gallery_fields lists the details shown under each file in a gallery:
+// its path, size, date, type and tags. None are shown by default. The
+// gallery_fields cookie, set from the "Show" links on the browse page,
+// replaces the configured list for one browser, and an empty cookie shows
+// nothing. Size and date come from the stored metadata, so files added
+// before it existed show them once the backfill_metadata job has run.
+
+// galleryFieldNames are the accepted gallery fields, in the order shown
+var galleryFieldNames = []string{"path", "size", "date", "type", "tags"}
+
+// galleryFieldsCookie overrides gallery_fields for one browser
+const galleryFieldsCookie = "gallery_fields"
+
+// parseGalleryFields reads a comma separated list of gallery fields
+func parseGalleryFields(list string) (map[string]bool, error) {
+	fields := make(map[string]bool)
+	for _, name := range parseList(list) {
+		name = strings.ToLower(name)
+		known := false
+		for _, n := range galleryFieldNames {
+			if n == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown gallery field %q, expected some of: %s", name, strings.Join(galleryFieldNames, ", "))
+		}
+		fields[name] = true
+	}
+	return fields, nil
+}
+
+// galleryFields returns the fields a request wants shown, from the cookie
+// when it is set and otherwise the configuration
+func galleryFields(r *http.Request) map[string]bool {
+	if c, err := r.Cookie(galleryFieldsCookie); err == nil {
+		if fields, err := parseGalleryFields(c.Value); err == nil {
+			return fields
+		}
+	}
+	fields, _ := parseGalleryFields(config.GalleryFields)
+	return fields
+}
+
+// toggledGalleryFields is the cookie value that turns one field on or off
+func toggledGalleryFields(fields map[string]bool, name string) string {
+	var list []string
+	for _, n := range galleryFieldNames {
+		if fields[n] != (n == name) {
+			list = append(list, n)
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+// fileTypeLabel is the type shown for a file, its extension in capitals
+func fileTypeLabel(filename string) string {
+	return strings.ToUpper(strings.TrimPrefix(filepath.Ext(filename), "."))
+}
+
+// formatBytes shows a size in bytes with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// prepareGallery sets the display preferences of a gallery page and loads
+// the details its fields need into the files shown
+func prepareGallery(pd *PageData, r *http.Request, lists ...[]File) {
+	pd.Compact = compactMode(r)
+	pd.GalleryFields = galleryFields(r)
+	pd.HoverPreviews = config.HoverPreviews && !pd.Compact
+	for _, files := range lists {
+		if err := loadGalleryFields(r.Context(), files, pd.GalleryFields); err != nil {
+			log.Printf("Warning: failed to load gallery details: %v", err)
+		}
+		if pd.HoverPreviews {
+			loadHoverPreviews(files)
+		}
+	}
+}
+
+// loadGalleryFields fills in the size, date and tags of files when the
+// fields ask for them
+func loadGalleryFields(ctx context.Context, files []File, fields map[string]bool) error {
+	if len(files) == 0 {
+		return nil
+	}
+	ids := make([]int, len(files))
+	placeholders := make([]string, len(files))
+	args := make([]interface{}, len(files))
+	for i, f := range files {
+		ids[i] = f.ID
+		placeholders[i] = "?"
+		args[i] = f.ID
+	}
+
+	if fields["size"] || fields["date"] {
+		rows, err := db.QueryContext(ctx, `
+			SELECT id, COALESCE(size, 0), SUBSTR(COALESCE(modified, ''), 1, 10)
+			FROM files
+			WHERE id IN (`+strings.Join(placeholders, ",")+`)`, args...)
+		if err != nil {
+			return err
+		}
+		type metadata struct {
+			size     int64
+			modified string
+		}
+		byID := make(map[int]metadata, len(files))
+		for rows.Next() {
+			var id int
+			var m metadata
+			if err := rows.Scan(&id, &m.size, &m.modified); err != nil {
+				rows.Close()
+				return err
+			}
+			byID[id] = m
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for i := range files {
+			files[i].Size = byID[files[i].ID].size
+			files[i].Modified = byID[files[i].ID].modified
+		}
+	}
+
+	if fields["tags"] {
+		tags, err := getTagsForFiles(ctx, ids)
+		if err != nil {
+			return err
+		}
+		for i := range files {
+			files[i].Tags = tags[files[i].ID]
+		}
+	}
+	return nil
+}
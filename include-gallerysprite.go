@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GET /api/gallery-sprite?ids=3,2,1 stitches the compact previews of a page
+// of files into one JPEG sprite sheet, so a gallery on a slow connection
+// can draw every tile from a single image request. The response gives the
+// sheet's URL and where each file's tile is on it. Files without a preview,
+// such as text files, are left out and keep their own image.
+//
+// A sheet is cached under a signature of the file IDs and the times their
+// previews were made, so it is rebuilt when any of them changes. Only the
+// most recently built sheets are kept.
+
+// gallerySpriteColumns is how many tiles are put side by side on a sheet
+const gallerySpriteColumns = 10
+
+// gallerySpriteCacheSize is how many sheets are kept on disk
+const gallerySpriteCacheSize = 200
+
+// gallerySpriteNamePattern matches a cached sheet's file name
+var gallerySpriteNamePattern = regexp.MustCompile(`^[0-9a-f]{32}\.jpg$`)
+
+// GallerySpriteTile is where one file's preview is on a sprite sheet
+type GallerySpriteTile struct {
+	ID     int `json:"id"`
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// GallerySprite is the response of GET /api/gallery-sprite
+type GallerySprite struct {
+	URL    string              `json:"url"`
+	Width  int                 `json:"width"`
+	Height int                 `json:"height"`
+	Tiles  []GallerySpriteTile `json:"tiles"`
+}
+
+// gallerySpriteDir is where sprite sheets are cached
+func gallerySpriteDir() string {
+	return filepath.Join(config.UploadDir, "thumbnails", "gallery")
+}
+
+// parseGallerySpriteIDs reads the comma separated file IDs of ?ids=,
+// dropping repeats and keeping their order
+func parseGallerySpriteIDs(list string) ([]int, error) {
+	seen := make(map[int]bool)
+	var ids []int
+	for _, s := range parseList(list) {
+		id, err := strconv.Atoi(s)
+		if err != nil || id < 1 {
+			return nil, fmt.Errorf("invalid file ID: %s", s)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no file IDs provided")
+	}
+	if config.MaxItemsPerPage > 0 && len(ids) > config.MaxItemsPerPage {
+		return nil, fmt.Errorf("at most %d file IDs can be requested", config.MaxItemsPerPage)
+	}
+	return ids, nil
+}
+
+// apiGallerySpriteHandler serves GET /api/gallery-sprite
+func apiGallerySpriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ids, err := parseGallerySpriteIDs(r.URL.Query().Get("ids"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	files, err := queryFilesWithTags(ctx, `
+		SELECT f.id, f.filename, f.path, COALESCE(f.description, '')
+		FROM files f
+		WHERE f.id IN (`+strings.Join(placeholders, ",")+`)`+privateFilter(ctx), args...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	byID := make(map[int]File, len(files))
+	for _, f := range files {
+		byID[f.ID] = f
+	}
+
+	// The signature covers each preview's file and age, so a changed
+	// preview gives a new sheet
+	type preview struct {
+		id   int
+		path string
+	}
+	var previews []preview
+	hash := sha256.New()
+	for _, id := range ids {
+		f, ok := byID[id]
+		if !ok || !(isGalleryImage(f.Filename) || isVideoFile(f.Filename) || strings.HasSuffix(strings.ToLower(f.Filename), ".cbz")) {
+			continue
+		}
+		path, err := ensureCompactThumbnail(ctx, f.Path, f.Filename)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(hash, "%d:%d\n", id, info.ModTime().UnixNano())
+		previews = append(previews, preview{id, path})
+	}
+	if len(previews) == 0 {
+		writeJSON(w, http.StatusOK, GallerySprite{Tiles: []GallerySpriteTile{}})
+		return
+	}
+
+	name := hex.EncodeToString(hash.Sum(nil))[:32]
+	jsonPath := filepath.Join(gallerySpriteDir(), name+".json")
+	if data, err := os.ReadFile(jsonPath); err == nil {
+		var sprite GallerySprite
+		if json.Unmarshal(data, &sprite) == nil {
+			if _, err := os.Stat(filepath.Join(gallerySpriteDir(), name+".jpg")); err == nil {
+				writeJSON(w, http.StatusOK, sprite)
+				return
+			}
+		}
+	}
+
+	cell := compactThumbnailSize
+	columns := gallerySpriteColumns
+	if len(previews) < columns {
+		columns = len(previews)
+	}
+	rows := (len(previews) + columns - 1) / columns
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*cell, rows*cell))
+	sprite := GallerySprite{
+		URL:    "/gallery-sprites/" + name + ".jpg",
+		Width:  columns * cell,
+		Height: rows * cell,
+		Tiles:  []GallerySpriteTile{},
+	}
+	for _, p := range previews {
+		f, err := os.Open(p.path)
+		if err != nil {
+			continue
+		}
+		img, err := jpeg.Decode(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		n := len(sprite.Tiles)
+		tile := GallerySpriteTile{
+			ID:     p.id,
+			X:      n % columns * cell,
+			Y:      n / columns * cell,
+			Width:  img.Bounds().Dx(),
+			Height: img.Bounds().Dy(),
+		}
+		draw.Draw(sheet, image.Rect(tile.X, tile.Y, tile.X+tile.Width, tile.Y+tile.Height), img, img.Bounds().Min, draw.Src)
+		sprite.Tiles = append(sprite.Tiles, tile)
+	}
+
+	if err := saveGallerySprite(name, sheet, sprite); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, sprite)
+}
+
+// saveGallerySprite writes a sheet and its tile positions to the cache and
+// drops the oldest sheets beyond gallerySpriteCacheSize
+func saveGallerySprite(name string, sheet image.Image, sprite GallerySprite) error {
+	dir := gallerySpriteDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create gallery sprite directory: %v", err)
+	}
+
+	// Write to a temporary file first so concurrent requests never serve a partial image
+	tmp, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create gallery sprite: %v", err)
+	}
+	if err := jpeg.Encode(tmp, sheet, &jpeg.Options{Quality: 70}); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to encode gallery sprite: %v", err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name+".jpg")); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to save gallery sprite: %v", err)
+	}
+
+	data, err := json.Marshal(sprite)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), data, 0644); err != nil {
+		return fmt.Errorf("failed to save gallery sprite: %v", err)
+	}
+
+	pruneGallerySprites(dir)
+	return nil
+}
+
+// pruneGallerySprites removes all but the newest gallerySpriteCacheSize sheets
+func pruneGallerySprites(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type sheet struct {
+		name    string
+		modTime int64
+	}
+	var sheets []sheet
+	for _, e := range entries {
+		if !gallerySpriteNamePattern.MatchString(e.Name()) {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			sheets = append(sheets, sheet{strings.TrimSuffix(e.Name(), ".jpg"), info.ModTime().UnixNano()})
+		}
+	}
+	if len(sheets) <= gallerySpriteCacheSize {
+		return
+	}
+	sort.Slice(sheets, func(i, j int) bool { return sheets[i].modTime > sheets[j].modTime })
+	for _, s := range sheets[gallerySpriteCacheSize:] {
+		for _, ext := range []string{".jpg", ".json"} {
+			if err := os.Remove(filepath.Join(dir, s.name+ext)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Warning: failed to remove gallery sprite %s: %v", s.name+ext, err)
+			}
+		}
+	}
+}
+
+// gallerySpriteHandler serves /gallery-sprites/{name}.jpg from the cache
+func gallerySpriteHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/gallery-sprites/")
+	if !gallerySpriteNamePattern.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+	// The name changes whenever the sheet does, but it may hold private files
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, filepath.Join(gallerySpriteDir(), name))
+}
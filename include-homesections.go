@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// The browse page lists tagged and untagged files in two sections, each
+// with its file count. A section can be collapsed, which is remembered in a
+// cookie, or hidden altogether with the home_sections setting or ?show=,
+// for example to see only untagged files while tagging. Hidden sections are
+// not queried. Each section is paged on its own: the tagged files follow
+// ?page= and, when both are shown, the untagged files ?untagged_page=.
+
+// untaggedPageParam pages the untagged section when both sections are shown
+const untaggedPageParam = "untagged_page"
+
+// collapseCookiePrefix is followed by the section name in the cookies
+// remembering collapsed sections
+const collapseCookiePrefix = "collapse_"
+
+// homeSections maps the home_sections setting and ?show= to which sections
+// are shown, tagged then untagged
+var homeSections = map[string][2]bool{
+	"both":     {true, true},
+	"tagged":   {true, false},
+	"untagged": {false, true},
+}
+
+// ListSections describes the sections of the browse page
+type ListSections struct {
+	ShowTagged        bool
+	ShowUntagged      bool
+	TaggedCount       int
+	UntaggedCount     int
+	TaggedCollapsed   bool
+	UntaggedCollapsed bool
+}
+
+// listSections reads which sections to show from the query string, falling
+// back to the home_sections setting, and which the visitor has collapsed
+func listSections(r *http.Request) (*ListSections, bool) {
+	show := r.URL.Query().Get("show")
+	if show == "" {
+		show = config.HomeSections
+	}
+	shown, ok := homeSections[show]
+	if !ok {
+		return nil, false
+	}
+	return &ListSections{
+		ShowTagged:        shown[0],
+		ShowUntagged:      shown[1],
+		TaggedCollapsed:   sectionCollapsed(r, "tagged"),
+		UntaggedCollapsed: sectionCollapsed(r, "untagged"),
+	}, true
+}
+
+// sectionPage reads the page number of a section from param
+func sectionPage(r *http.Request, param string) int {
+	if p, err := strconv.Atoi(r.URL.Query().Get(param)); err == nil && p > 0 {
+		return p
+	}
+	return 1
+}
+
+// sectionPagination pages one section of the browse page, with its page
+// number in param
+func sectionPagination(r *http.Request, param string, page, total, perPage int) *Pagination {
+	p := calculatePagination(page, total, perPage)
+	p.Params = r.URL.Query()
+	p.Param = param
+	return p
+}
+
+// sectionCollapsed reports whether the visitor collapsed a section
+func sectionCollapsed(r *http.Request, section string) bool {
+	c, err := r.Cookie(collapseCookiePrefix + section)
+	return err == nil && c.Value == "1"
+}
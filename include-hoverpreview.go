@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// hover_previews plays a short muted clip of a video while the pointer is
+// over its gallery tile. The clip is made with ffmpeg next to the thumbnail
+// and preview sprite, at the same time as them, and galleries link it from
+// each video's list data. Videos added before the setting was turned on get
+// their clips from the job on the admin page. Compact mode never loads them.
+
+// Preview clips are a few seconds of small, silent H.264
+const (
+	hoverPreviewSeconds = 3
+	hoverPreviewWidth   = 320
+)
+
+// hoverPreviewPath is where the preview clip of a video is stored
+func hoverPreviewPath(uploadDir, filename string) string {
+	return filepath.Join(uploadDir, "thumbnails", filename+".preview.mp4")
+}
+
+// hoverPreviewStart picks where a clip starts: a quarter of the way in, or
+// the beginning of a video too short to have a clip after that
+func hoverPreviewStart(videoPath string) float64 {
+	duration, err := getVideoDuration(videoPath)
+	if err != nil {
+		return 0
+	}
+	start := duration / 4
+	if start+hoverPreviewSeconds > duration {
+		return 0
+	}
+	return start
+}
+
+// generateHoverPreview cuts the preview clip of a video
+func generateHoverPreview(videoPath, uploadDir, filename string) error {
+	thumbDir := filepath.Join(uploadDir, "thumbnails")
+	if err := os.MkdirAll(thumbDir, 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnails directory: %v", err)
+	}
+
+	// Write to a temporary file first so concurrent requests never serve a partial clip
+	tmp, err := os.CreateTemp(thumbDir, filename+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create preview clip: %v", err)
+	}
+	tmp.Close()
+
+	cmd := exec.Command("ffmpeg", "-y", "-v", "error",
+		"-ss", strconv.FormatFloat(hoverPreviewStart(videoPath), 'f', 2, 64), "-i", videoPath,
+		"-t", strconv.Itoa(hoverPreviewSeconds), "-an",
+		"-vf", fmt.Sprintf("scale=%d:-2", hoverPreviewWidth),
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "30", "-pix_fmt", "yuv420p",
+		"-movflags", "+faststart", "-f", "mp4", tmp.Name())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to generate preview clip: %v: %s", err, out)
+	}
+	if err := os.Rename(tmp.Name(), hoverPreviewPath(uploadDir, filename)); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to save preview clip: %v", err)
+	}
+	return nil
+}
+
+// loadHoverPreviews sets the preview clip URL of the videos among files
+// that have one
+func loadHoverPreviews(files []File) {
+	for i, f := range files {
+		if !isVideoFile(f.Filename) {
+			continue
+		}
+		if _, err := os.Stat(hoverPreviewPath(config.UploadDir, f.Filename)); err == nil {
+			files[i].HoverPreview = "/uploads/thumbnails/" + url.PathEscape(f.Filename) + ".preview.mp4"
+		}
+	}
+}
+
+// generateHoverPreviews makes the missing preview clips of every video in
+// the upload directory
+func generateHoverPreviews(j *Job) (string, error) {
+	ctx := context.Background()
+
+	dbGate.RLock()
+	rows, err := db.QueryContext(ctx, "SELECT id, filename, path FROM files ORDER BY id")
+	if err != nil {
+		dbGate.RUnlock()
+		return "", err
+	}
+	var videos []File
+	for rows.Next() {
+		var f File
+		if err := rows.Scan(&f.ID, &f.Filename, &f.Path); err != nil {
+			rows.Close()
+			dbGate.RUnlock()
+			return "", err
+		}
+		if !isVideoFile(f.Filename) {
+			continue
+		}
+		if _, err := os.Stat(hoverPreviewPath(config.UploadDir, f.Filename)); err == nil {
+			continue
+		}
+		videos = append(videos, f)
+	}
+	rows.Close()
+	dbGate.RUnlock()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	j.SetTotal(len(videos))
+	made := 0
+	for _, f := range videos {
+		if err := generateHoverPreview(f.Path, config.UploadDir, f.Filename); err != nil {
+			j.Fail(f.Filename, err)
+		} else {
+			made++
+		}
+		j.Step()
+	}
+
+	return fmt.Sprintf("Made preview clips for %d of %d videos", made, len(videos)), nil
+}
+
+// removeHoverPreview deletes the preview clip of a video, if it has one
+func removeHoverPreview(filename string) {
+	if err := os.Remove(hoverPreviewPath(config.UploadDir, filename)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Failed to delete preview clip of %s: %v", filename, err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Images get a thumbnail like videos and CBZ files, so a gallery does not
+// load every picture at full size. It is made when an image is added or
+// replaced, whatever thumbnail_mode is, since decoding an image is quick,
+// and images added before this can be given one with "Generate All Missing
+// Thumbnails". Galleries show the image itself until it has a thumbnail.
+// Only formats the server can decode are covered, so WebP is left as it is.
+
+// imageThumbnailWidth matches the width ffmpeg scales video thumbnails to
+const imageThumbnailWidth = 400
+
+// isThumbnailImage reports whether an image gets a thumbnail of its own
+func isThumbnailImage(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+// hasImageThumbnail reports whether an image's thumbnail has been made
+func hasImageThumbnail(filename string) bool {
+	if !isThumbnailImage(filename) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(config.UploadDir, "thumbnails", filename+".jpg"))
+	return err == nil
+}
+
+// generateImageThumbnail writes a JPEG thumbnail of an image, scaled down to
+// imageThumbnailWidth when it is wider. Transparent areas are filled with
+// the thumbnail background.
+func generateImageThumbnail(imagePath, uploadDir, filename string) error {
+	thumbPath := filepath.Join(uploadDir, "thumbnails", filename+".jpg")
+	hash := thumbnailHash(imagePath)
+	if linkSharedThumbnail(hash, thumbPath, ".jpg") {
+		return nil
+	}
+
+	img, err := decodeImageFile(imagePath)
+	if err != nil {
+		return err
+	}
+	if b := img.Bounds(); b.Dx() > imageThumbnailWidth {
+		img = resizeImage(img, imageThumbnailWidth, b.Dy())
+	}
+
+	background, err := parseHexColor(config.ThumbnailBackground)
+	if err != nil {
+		background = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	}
+	b := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, b.Min, draw.Over)
+
+	thumbDir := filepath.Join(uploadDir, "thumbnails")
+	if err := os.MkdirAll(thumbDir, 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnails directory: %v", err)
+	}
+
+	// Write to a temporary file first so a gallery never shows a partial image
+	tmp, err := os.CreateTemp(thumbDir, "thumbnail.*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create thumbnail: %v", err)
+	}
+	if err := jpeg.Encode(tmp, flat, &jpeg.Options{Quality: 80}); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to encode thumbnail: %v", err)
+	}
+	tmp.Close()
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		log.Printf("Warning: failed to set thumbnail permissions: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), thumbPath); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to save thumbnail: %v", err)
+	}
+	shareThumbnail(hash, thumbPath, ".jpg")
+	return nil
+}
+
+// makeImageThumbnail makes the thumbnail of a newly stored image, logging
+// rather than failing, as the image itself can still be shown
+func makeImageThumbnail(path string) {
+	filename := filepath.Base(path)
+	if !isThumbnailImage(filename) {
+		return
+	}
+	if err := generateImageThumbnail(path, config.UploadDir, filename); err != nil {
+		log.Printf("Warning: could not generate thumbnail for %s: %v", filename, err)
+	}
+}
+
+// getMissingThumbnailImages returns the images that have no thumbnail yet
+func getMissingThumbnailImages() ([]File, error) {
+	rows, err := db.Query("SELECT id, filename, path FROM files ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var missing []File
+	for rows.Next() {
+		var f File
+		if err := rows.Scan(&f.ID, &f.Filename, &f.Path); err != nil {
+			return nil, err
+		}
+		if isThumbnailImage(f.Filename) && !hasImageThumbnail(f.Filename) {
+			missing = append(missing, f)
+		}
+	}
+	return missing, rows.Err()
+}
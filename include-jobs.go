@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Jobs run long maintenance work in the background so the request that
+// starts one returns straight away. A job reports how many items it has to
+// process and how many are done, and collects per-item errors instead of
+// stopping at the first one. Recent jobs are kept in memory only.
+//
+// Jobs run outside any request, so they hold dbGate for reading around their
+// database work, one item at a time, to keep clear of a backup restore.
+
+// maxJobErrors caps the errors kept per job; later ones are only counted
+const maxJobErrors = 100
+
+// maxJobs is how many finished jobs are remembered
+const maxJobs = 20
+
+// Job is a running or finished background job
+type Job struct {
+	mu         sync.Mutex
+	id         int
+	name       string
+	status     string
+	started    time.Time
+	finished   time.Time
+	total      int
+	done       int
+	errors     []string
+	errorCount int
+	counts     map[string]int
+	message    string
+}
+
+// JobStatus is a snapshot of a job, as returned by the API
+type JobStatus struct {
+	ID         int            `json:"id"`
+	Name       string         `json:"name"`
+	Status     string         `json:"status"`
+	Started    time.Time      `json:"started"`
+	Finished   *time.Time     `json:"finished,omitempty"`
+	Total      int            `json:"total"`
+	Done       int            `json:"done"`
+	Errors     []string       `json:"errors"`
+	ErrorCount int            `json:"error_count"`
+	Counts     map[string]int `json:"counts,omitempty"`
+	Message    string         `json:"message,omitempty"`
+}
+
+var (
+	jobsMu    sync.Mutex
+	jobs      = map[int]*Job{}
+	nextJobID = 1
+)
+
+// startJob runs fn in the background as a job named name and returns it. If
+// a job with the same name is still running that job is returned instead.
+// fn returns a summary message, or an error if the job as a whole failed.
+func startJob(name string, fn func(j *Job) (string, error)) *Job {
+	jobsMu.Lock()
+	for _, j := range jobs {
+		if j.name == name && j.Status().Status == "running" {
+			jobsMu.Unlock()
+			return j
+		}
+	}
+	j := &Job{id: nextJobID, name: name, status: "running", started: time.Now()}
+	jobs[j.id] = j
+	nextJobID++
+	pruneJobs()
+	jobsMu.Unlock()
+
+	go func() {
+		message, err := fn(j)
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.finished = time.Now()
+		j.message = message
+		if err != nil {
+			j.status = "failed"
+			j.message = err.Error()
+			log.Printf("Job %d (%s) failed: %v", j.id, j.name, err)
+		} else {
+			j.status = "done"
+		}
+	}()
+
+	return j
+}
+
+// pruneJobs forgets the oldest finished jobs beyond maxJobs. jobsMu must be held.
+func pruneJobs() {
+	var finished []int
+	for id, j := range jobs {
+		if j.Status().Status != "running" {
+			finished = append(finished, id)
+		}
+	}
+	sort.Ints(finished)
+	for len(finished) > maxJobs {
+		delete(jobs, finished[0])
+		finished = finished[1:]
+	}
+}
+
+// SetTotal records how many items the job will process
+func (j *Job) SetTotal(n int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.total = n
+}
+
+// Step records that one more item has been processed
+func (j *Job) Step() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done++
+}
+
+// Count adds one to a named counter, for jobs that report more than how
+// many items are done, such as a scan that skips some of what it finds
+func (j *Job) Count(name string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.counts == nil {
+		j.counts = map[string]int{}
+	}
+	j.counts[name]++
+}
+
+// Fail records an error for one item without stopping the job
+func (j *Job) Fail(item string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.errorCount++
+	if len(j.errors) < maxJobErrors {
+		j.errors = append(j.errors, fmt.Sprintf("%s: %v", item, err))
+	}
+}
+
+// Status returns a snapshot of the job
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := JobStatus{
+		ID:         j.id,
+		Name:       j.name,
+		Status:     j.status,
+		Started:    j.started,
+		Total:      j.total,
+		Done:       j.done,
+		Errors:     append([]string{}, j.errors...),
+		ErrorCount: j.errorCount,
+		Message:    j.message,
+	}
+	if j.counts != nil {
+		s.Counts = make(map[string]int, len(j.counts))
+		for name, n := range j.counts {
+			s.Counts[name] = n
+		}
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		s.Finished = &finished
+	}
+	return s
+}
+
+// Percent is how far through its items the job is
+func (s JobStatus) Percent() int {
+	if s.Total == 0 {
+		if s.Status == "running" {
+			return 0
+		}
+		return 100
+	}
+	return s.Done * 100 / s.Total
+}
+
+// listJobs returns a snapshot of every remembered job, newest first
+func listJobs() []JobStatus {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		statuses = append(statuses, j.Status())
+	}
+	sort.Slice(statuses, func(a, b int) bool { return statuses[a].ID > statuses[b].ID })
+	return statuses
+}
+
+func getJob(id int) (*Job, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j, ok := jobs[id]
+	return j, ok
+}
+
+// apiJobsHandler serves /api/jobs and /api/jobs/{id}
+func apiJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/")
+	if idStr == "" {
+		writeJSON(w, http.StatusOK, listJobs())
+		return
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid job ID")
+		return
+	}
+	j, ok := getJob(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, j.Status())
+}
+
+// JobsPageData is the data for the jobs page
+type JobsPageData struct {
+	Jobs    []JobStatus
+	Running bool
+}
+
+func jobsPageHandler(w http.ResponseWriter, r *http.Request) {
+	data := JobsPageData{Jobs: listJobs()}
+	for _, j := range data.Jobs {
+		if j.Status == "running" {
+			data.Running = true
+		}
+	}
+	renderTemplate(w, "jobs.html", buildPageData(r.Context(), "Jobs", data))
+}
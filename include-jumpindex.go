@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// The browse and tag pages can be sorted newest first or by filename. When
+// sorted by filename they show an A-Z jump index linking to the page where
+// each initial letter starts, with # standing for digits and symbols. The
+// pages come from one grouped count of the listed files by initial.
+
+var listSorts = map[string]string{
+	"newest": "f.id DESC",
+	"name":   "f.filename COLLATE NOCASE, f.id",
+}
+
+// JumpLink is one entry of the jump index. Page is 0 when no listed file
+// starts with the letter.
+type JumpLink struct {
+	Label string
+	Page  int
+}
+
+// listSort returns the sort asked for in the query string, falling back to
+// the list_sort setting, and its ORDER BY clause
+func listSort(r *http.Request) (string, string, bool) {
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = config.ListSort
+	}
+	order, ok := listSorts[sortBy]
+	return sortBy, order, ok
+}
+
+// sortURL links to the first page of the current listing in another order,
+// keeping the other query parameters
+func sortURL(p *Pagination, sortBy string) string {
+	params := url.Values{}
+	for key, values := range p.Params {
+		if key != "page" && key != untaggedPageParam {
+			params[key] = values
+		}
+	}
+	params.Set("sort", sortBy)
+	return "?" + params.Encode()
+}
+
+// getJumpIndex computes the jump index of a filename sorted list. from is
+// the FROM and WHERE part of the list's query, with f as the files alias.
+func getJumpIndex(ctx context.Context, from string, args []interface{}, perPage int) ([]JumpLink, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT LOWER(SUBSTR(f.filename, 1, 1)) AS initial, COUNT(DISTINCT f.id)
+		`+from+`
+		GROUP BY initial
+		ORDER BY initial`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	index := []JumpLink{{Label: "#"}}
+	for c := 'A'; c <= 'Z'; c++ {
+		index = append(index, JumpLink{Label: string(c)})
+	}
+
+	// Filenames sort case-insensitively, so each initial's files follow on
+	// from the ones before it and its first file is at their running total
+	offset := 0
+	for rows.Next() {
+		var initial string
+		var count int
+		if err := rows.Scan(&initial, &count); err != nil {
+			return nil, err
+		}
+		i := 0
+		if len(initial) == 1 && initial[0] >= 'a' && initial[0] <= 'z' {
+			i = int(initial[0]-'a') + 1
+		}
+		if index[i].Page == 0 {
+			index[i].Page = offset/perPage + 1
+		}
+		offset += count
+	}
+	return index, rows.Err()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Maintenance mode keeps the library readable while a backup or migration
+// runs, by refusing every request that could change it with a 503. Pages,
+// files and the read-only API keep working, and every page shows a banner.
+// Logging in and out, turning the mode off again and the admin tools that
+// only read the library, such as taking a backup, are exempt. It is switched
+// from the database tab of the admin page and lasts until the server
+// restarts.
+// Background jobs already running are not stopped.
+
+var maintenance atomic.Bool
+
+// maintenanceMode reports whether maintenance mode is on
+func maintenanceMode() bool {
+	return maintenance.Load()
+}
+
+// maintenanceActions are the admin page actions allowed during maintenance:
+// the switch itself and the tools that do not change the library
+var maintenanceActions = map[string]bool{
+	"maintenance":    true,
+	"backup":         true,
+	"export_tags":    true,
+	"rename_preview": true,
+	"scan_empty":     true,
+	"check_paths":    true,
+}
+
+// maintenanceExempt reports whether a request may be posted during maintenance
+func maintenanceExempt(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/login", "/logout":
+		return true
+	case "/admin":
+		return maintenanceActions[r.FormValue("action")]
+	}
+	return false
+}
+
+// withMaintenance rejects requests that could write while maintenance mode is on
+func withMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maintenanceMode() && !maintenanceExempt(r) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				w.Header().Set("Retry-After", "300")
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					writeJSONError(w, http.StatusServiceUnavailable, "maintenance in progress")
+					return
+				}
+				renderError(w, "Maintenance in progress, changes are disabled until it finishes", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	on := r.FormValue("maintenance") == "on"
+	maintenance.Store(on)
+
+	adminData := AdminData{
+		Config: config,
+	}
+	if on {
+		audit(r, "config", "", "maintenance mode on")
+		adminData.Success = "Maintenance mode is on, changes are refused until it is turned off"
+	} else {
+		audit(r, "config", "", "maintenance mode off")
+		adminData.Success = "Maintenance mode is off"
+	}
+
+	renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Merging a tag into another of the same category gives every file with
+// the source tag the target instead, keeping where the source was ordered
+// among the file's tags, and deletes the source. Files that already have
+// both keep the target where it is, and are counted as skipped.
+
+// mergeTags merges category:sourceValue into category:targetValue in one
+// transaction. It returns how many files were given the target tag and how
+// many already had it.
+func mergeTags(ctx context.Context, category, sourceValue, targetValue string) (int64, int64, error) {
+	category = strings.TrimSpace(category)
+	sourceValue = strings.TrimSpace(sourceValue)
+	targetValue = strings.TrimSpace(targetValue)
+	if category == "" || sourceValue == "" || targetValue == "" {
+		return 0, 0, fmt.Errorf("category, value and target value are required")
+	}
+	if sourceValue == targetValue {
+		return 0, 0, fmt.Errorf("a tag cannot be merged into itself")
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	ids := make([]int, 2)
+	for i, value := range []string{sourceValue, targetValue} {
+		err := tx.QueryRowContext(ctx, `
+			SELECT t.id
+			FROM tags t
+			JOIN categories c ON c.id = t.category_id
+			WHERE c.name = ? AND t.value = ?`, category, value).Scan(&ids[i])
+		if err == sql.ErrNoRows {
+			return 0, 0, fmt.Errorf("tag %s:%s not found", category, value)
+		} else if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	updated, skipped, err := mergeTagInTx(ctx, tx, ids[0], ids[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit: %v", err)
+	}
+	invalidateCaches()
+
+	return updated, skipped, nil
+}
+
+// mergeTagInTx repoints the files of the tag sourceID to targetID and
+// deletes the source tag. It returns how many files were repointed and how
+// many already had the target.
+func mergeTagInTx(ctx context.Context, tx *sql.Tx, sourceID, targetID int) (int64, int64, error) {
+	res, err := tx.ExecContext(ctx, `
+		INSERT OR IGNORE INTO file_tags(file_id, tag_id, position)
+		SELECT file_id, ?, position FROM file_tags WHERE tag_id = ?`, targetID, sourceID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to merge tag: %v", err)
+	}
+	updated, _ := res.RowsAffected()
+
+	res, err = tx.ExecContext(ctx, "DELETE FROM file_tags WHERE tag_id=?", sourceID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to merge tag: %v", err)
+	}
+	total, _ := res.RowsAffected()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id=?", sourceID); err != nil {
+		return 0, 0, fmt.Errorf("failed to merge tag: %v", err)
+	}
+	return updated, total - updated, nil
+}
+
+func handleMergeTags(w http.ResponseWriter, r *http.Request) {
+	category := strings.TrimSpace(r.FormValue("category"))
+	value := strings.TrimSpace(r.FormValue("value"))
+	target := strings.TrimSpace(r.FormValue("target_value"))
+
+	adminData := AdminData{
+		Config: config,
+	}
+
+	updated, skipped, err := mergeTags(r.Context(), category, value, target)
+	if err != nil {
+		adminData.Error = "Failed to merge tags: " + err.Error()
+	} else {
+		audit(r, "tag-merge", "tag:"+category+":"+value, fmt.Sprintf("into %s, %d files updated, %d already tagged", target, updated, skipped))
+		adminData.Success = fmt.Sprintf("Merged %s:%s into %s:%s, updating %d files; %d already had %s", category, value, category, target, updated, skipped, target)
+	}
+
+	renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+}
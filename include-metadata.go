@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File metadata is stored in the files table when a file is added so it can
+// be shown and sorted on without touching the disk. Files added before the
+// columns existed are filled in by the backfill_metadata job. A value that
+// could not be determined is left NULL.
+
+// FileMetadata is what can be read about a file from the file system and its contents
+type FileMetadata struct {
+	Size     int64
+	Modified time.Time
+	Codec    string
+	Width    int
+	Height   int
+	Duration float64
+}
+
+// metadataColumns are added to files by initSchema
+var metadataColumns = [][2]string{
+	{"size", "INTEGER"},
+	{"modified", "DATETIME"},
+	{"codec", "TEXT"},
+	{"width", "INTEGER"},
+	{"height", "INTEGER"},
+	{"duration", "REAL"},
+}
+
+// probeFileMetadata stats a file and reads its codec, resolution and
+// duration. Media probing is best effort; only a missing file is an error.
+func probeFileMetadata(path, filename string) (FileMetadata, error) {
+	var m FileMetadata
+	info, err := os.Stat(path)
+	if err != nil {
+		return m, err
+	}
+	m.Size = info.Size()
+	m.Modified = info.ModTime()
+
+	if isVideoFile(filename) {
+		if probe, err := probeVideo(path); err == nil {
+			m.Codec = probe.Codec
+			m.Duration = probe.Duration
+			m.Width = probe.Width
+			m.Height = probe.Height
+		}
+	} else if strings.HasPrefix(mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))), "image/") {
+		if f, err := os.Open(path); err == nil {
+			if cfg, format, err := image.DecodeConfig(f); err == nil {
+				m.Codec = format
+				m.Width = cfg.Width
+				m.Height = cfg.Height
+			}
+			f.Close()
+		}
+	}
+	return m, nil
+}
+
+// nullIfZero stores unknown metadata as NULL
+func nullIfZero(v interface{}) interface{} {
+	switch x := v.(type) {
+	case string:
+		if x == "" {
+			return nil
+		}
+	case int:
+		if x == 0 {
+			return nil
+		}
+	case float64:
+		if x == 0 {
+			return nil
+		}
+	}
+	return v
+}
+
+// storeFileMetadata fills in whichever metadata columns of a file are still NULL
+func storeFileMetadata(ctx context.Context, fileID int64, m FileMetadata) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE files SET
+			size = COALESCE(size, ?),
+			modified = COALESCE(modified, ?),
+			codec = COALESCE(codec, ?),
+			width = COALESCE(width, ?),
+			height = COALESCE(height, ?),
+			duration = COALESCE(duration, ?)
+		WHERE id = ?`,
+		m.Size, m.Modified.UTC().Format("2006-01-02 15:04:05"),
+		nullIfZero(m.Codec), nullIfZero(m.Width), nullIfZero(m.Height), nullIfZero(m.Duration),
+		fileID)
+	if err != nil {
+		return fmt.Errorf("failed to store metadata: %v", err)
+	}
+	return nil
+}
+
+// backfillMetadata probes every file that has no stored metadata or hash
+// yet. Files missing from disk are reported as errors and left unchanged.
+func backfillMetadata(j *Job) (string, error) {
+	ctx := context.Background()
+
+	dbGate.RLock()
+	rows, err := db.QueryContext(ctx, "SELECT id, filename, path, hash IS NULL FROM files WHERE size IS NULL OR hash IS NULL ORDER BY id")
+	if err != nil {
+		dbGate.RUnlock()
+		return "", err
+	}
+	type pending struct {
+		File
+		needsHash bool
+	}
+	var files []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.ID, &p.Filename, &p.Path, &p.needsHash); err != nil {
+			rows.Close()
+			dbGate.RUnlock()
+			return "", err
+		}
+		files = append(files, p)
+	}
+	rows.Close()
+	dbGate.RUnlock()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	j.SetTotal(len(files))
+	updated, missing := 0, 0
+	for _, f := range files {
+		m, err := probeFileMetadata(f.Path, f.Filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				missing++
+				err = fmt.Errorf("missing on disk")
+			}
+			j.Fail(f.Filename, err)
+			j.Step()
+			continue
+		}
+
+		var hash string
+		if f.needsHash {
+			if hash, err = fileHash(f.Path); err != nil {
+				j.Fail(f.Filename, err)
+			}
+		}
+
+		dbGate.RLock()
+		err = storeFileMetadata(ctx, int64(f.ID), m)
+		if err == nil && hash != "" {
+			_, err = db.ExecContext(ctx, "UPDATE files SET hash=? WHERE id=?", hash, f.ID)
+		}
+		dbGate.RUnlock()
+
+		if err != nil {
+			j.Fail(f.Filename, err)
+		} else {
+			updated++
+		}
+		j.Step()
+	}
+
+	return fmt.Sprintf("Updated %d of %d files, %d missing on disk", updated, len(files), missing), nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// moveTagToCategory moves the tag category:value to target, repointing the
+// tag when target has no tag with that value and otherwise merging it into
+// the existing one. It returns how many files carry the tag and whether it
+// was merged.
+func moveTagToCategory(ctx context.Context, category, value, target string) (int, bool, error) {
+	result, err := moveTagsToCategory(ctx, category, []string{value}, target)
+	if err != nil {
+		return 0, false, err
+	}
+	return result.Files, result.Merged > 0, nil
+}
+
+// MoveTagsResult reports what moving tags to another category did
+type MoveTagsResult struct {
+	Moved  int // tags repointed to the target category
+	Merged int // tags merged into a tag the target already had
+	Files  int // files carrying any of the tags
+}
+
+// moveTagsToCategory moves several values of one category to target in a
+// single transaction, each as moveTagToCategory does. Nothing is moved if
+// any of the values is not a tag.
+func moveTagsToCategory(ctx context.Context, category string, values []string, target string) (MoveTagsResult, error) {
+	var result MoveTagsResult
+	category = strings.TrimSpace(category)
+	target = strings.TrimSpace(target)
+	seen := make(map[string]bool)
+	var cleaned []string
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value != "" && !seen[value] {
+			seen[value] = true
+			cleaned = append(cleaned, value)
+		}
+	}
+	if category == "" || len(cleaned) == 0 || target == "" {
+		return result, fmt.Errorf("category, value and target category are required")
+	}
+	if strings.EqualFold(category, target) {
+		if len(cleaned) == 1 {
+			return result, fmt.Errorf("the tag is already in %s", target)
+		}
+		return result, fmt.Errorf("the tags are already in %s", target)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	tagIDs := make([]int, len(cleaned))
+	placeholders := make([]string, len(cleaned))
+	args := make([]interface{}, len(cleaned))
+	for i, value := range cleaned {
+		err = tx.QueryRowContext(ctx, `
+			SELECT t.id
+			FROM tags t
+			JOIN categories c ON c.id = t.category_id
+			WHERE c.name = ? AND t.value = ?`, category, value).Scan(&tagIDs[i])
+		if err == sql.ErrNoRows {
+			return result, fmt.Errorf("tag %s:%s not found", category, value)
+		} else if err != nil {
+			return result, err
+		}
+		placeholders[i] = "?"
+		args[i] = tagIDs[i]
+	}
+
+	var targetID int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM categories WHERE name=?", target).Scan(&targetID)
+	if err == sql.ErrNoRows {
+		res, err := tx.ExecContext(ctx, "INSERT INTO categories(name) VALUES(?)", target)
+		if err != nil {
+			return result, fmt.Errorf("failed to create category %s: %v", target, err)
+		}
+		targetID, _ = res.LastInsertId()
+	} else if err != nil {
+		return result, err
+	}
+
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(DISTINCT file_id) FROM file_tags WHERE tag_id IN ("+strings.Join(placeholders, ",")+")", args...).Scan(&result.Files); err != nil {
+		return result, err
+	}
+
+	for i, value := range cleaned {
+		merged, err := moveTagInTx(ctx, tx, tagIDs[i], value, targetID)
+		if err != nil {
+			return result, err
+		}
+		if merged {
+			result.Merged++
+		} else {
+			result.Moved++
+		}
+	}
+
+	if err := autoPruneUnusedTags(ctx, tx); err != nil {
+		return result, err
+	}
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit: %v", err)
+	}
+	invalidateCaches()
+
+	return result, nil
+}
+
+// moveTagInTx moves the tag tagID with the given value to the category
+// targetID, merging it into the tag already there with the same value. It
+// reports whether it was merged.
+func moveTagInTx(ctx context.Context, tx *sql.Tx, tagID int, value string, targetID int64) (bool, error) {
+	var existingID int
+	err := tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE category_id=? AND value=?", targetID, value).Scan(&existingID)
+	merged := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	// Positions order a file's tags within one category, so moved tags go
+	// to the end of the target category
+	if merged {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO file_tags(file_id, tag_id)
+			SELECT file_id, ? FROM file_tags WHERE tag_id = ?`, existingID, tagID); err != nil {
+			return false, fmt.Errorf("failed to merge tag: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM file_tags WHERE tag_id=?", tagID); err != nil {
+			return false, fmt.Errorf("failed to merge tag: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id=?", tagID); err != nil {
+			return false, fmt.Errorf("failed to merge tag: %v", err)
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, "UPDATE tags SET category_id=? WHERE id=?", targetID, tagID); err != nil {
+			return false, fmt.Errorf("failed to move tag: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE file_tags SET position=NULL WHERE tag_id=?", tagID); err != nil {
+			return false, fmt.Errorf("failed to move tag: %v", err)
+		}
+	}
+	return merged, nil
+}
+
+func handleMoveTag(w http.ResponseWriter, r *http.Request) {
+	category := r.FormValue("category")
+	value := r.FormValue("value")
+	target := r.FormValue("target_category")
+
+	adminData := AdminData{
+		Config: config,
+	}
+
+	files, merged, err := moveTagToCategory(r.Context(), category, value, target)
+	if err != nil {
+		adminData.Error = "Failed to move tag: " + err.Error()
+	} else if merged {
+		adminData.Success = fmt.Sprintf("Merged %s:%s into the existing %s:%s, affecting %d files", category, value, target, value, files)
+	} else {
+		adminData.Success = fmt.Sprintf("Moved %s:%s to %s:%s, affecting %d files", category, value, target, value, files)
+	}
+
+	renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+}
+
+// tagsMoveHandler serves the move form of the tags page, moving the checked
+// values of a category to another
+func tagsMoveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/tags?move=1", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		renderError(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	category := r.FormValue("category")
+	values := r.Form["value"]
+	target := r.FormValue("target_category")
+
+	result, err := moveTagsToCategory(r.Context(), category, values, target)
+	if err != nil {
+		http.Redirect(w, r, "/tags?move=1&error="+url.QueryEscape("Failed to move tags: "+err.Error()), http.StatusSeeOther)
+		return
+	}
+	audit(r, "tag-move", "category:"+strings.TrimSpace(category), fmt.Sprintf("%s to %s, affecting %d files", strings.Join(values, ", "), strings.TrimSpace(target), result.Files))
+
+	message := fmt.Sprintf("Moved %d and merged %d tags from %s into %s, affecting %d files", result.Moved, result.Merged, strings.TrimSpace(category), strings.TrimSpace(target), result.Files)
+	http.Redirect(w, r, "/tags?move=1&success="+url.QueryEscape(message), http.StatusSeeOther)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Paginated pages show items_per_page items unless the request asks for a
+// different page size with ?per_page=. A requested size is clamped to
+// max_items_per_page, so no client can pull the whole library in one query.
+// Compact mode lowers the default to compactItemsPerPage.
+
+// defaultMaxItemsPerPage is the largest page size unless configured otherwise
+const defaultMaxItemsPerPage = 500
+
+// configuredPageSize is items_per_page, or 50 when it is not a positive number
+func configuredPageSize() int {
+	if pp, err := strconv.Atoi(config.ItemsPerPage); err == nil && pp > 0 {
+		return pp
+	}
+	return 50
+}
+
+// pageSize returns the page size asked for with ?per_page=, at most
+// max_items_per_page, or the configured one
+func pageSize(r *http.Request) int {
+	perPage := configuredPageSize()
+	if compactMode(r) && perPage > compactItemsPerPage {
+		perPage = compactItemsPerPage
+	}
+	if pp, err := strconv.Atoi(r.URL.Query().Get("per_page")); err == nil && pp > 0 {
+		perPage = pp
+	}
+	if config.MaxItemsPerPage > 0 && perPage > config.MaxItemsPerPage {
+		perPage = config.MaxItemsPerPage
+	}
+	return perPage
+}
+
+// validatePageSizes checks the maximum page size is positive and not below
+// the configured page size
+func validatePageSizes(c Config) error {
+	if c.MaxItemsPerPage < 1 {
+		return fmt.Errorf("maximum items per page must be at least 1")
+	}
+	if pp, err := strconv.Atoi(c.ItemsPerPage); err == nil && pp > c.MaxItemsPerPage {
+		return fmt.Errorf("items per page (%d) cannot be more than the maximum items per page (%d)", pp, c.MaxItemsPerPage)
+	}
+	return nil
+}
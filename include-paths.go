@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File paths are stored in the database as given, so anything that deletes
+// or moves files on disk first checks the stored path is inside an allowed
+// root: the upload or archive directory or one of the configured allowed_roots.
+
+var errPathNotAllowed = errors.New("file path is outside the allowed directories")
+
+// resolvePath makes a path absolute and resolves symlinks in as much of it as exists
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		return filepath.Join(dir, filepath.Base(abs)), nil
+	}
+	return abs, nil
+}
+
+// checkPathAllowed returns errPathNotAllowed unless path is inside an allowed root
+func checkPathAllowed(path string) error {
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return errPathNotAllowed
+	}
+
+	roots := append([]string{config.UploadDir}, config.AllowedRoots...)
+	if config.ArchiveDir != "" {
+		roots = append(roots, config.ArchiveDir)
+	}
+	for _, root := range roots {
+		rootPath, err := resolvePath(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(rootPath, resolved)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return errPathNotAllowed
+}
+
+// getPathViolations returns every file whose stored path is outside the allowed roots
+func getPathViolations(ctx context.Context) ([]File, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, filename, path FROM files ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var violations []File
+	for rows.Next() {
+		var f File
+		if err := rows.Scan(&f.ID, &f.Filename, &f.Path); err != nil {
+			return nil, err
+		}
+		if checkPathAllowed(f.Path) != nil {
+			violations = append(violations, f)
+		}
+	}
+	return violations, rows.Err()
+}
+
+// logPathViolations warns about stored paths outside the allowed roots at startup
+func logPathViolations() {
+	violations, err := getPathViolations(context.Background())
+	if err != nil {
+		log.Printf("Warning: failed to check file paths: %v", err)
+		return
+	}
+	for _, f := range violations {
+		log.Printf("Warning: file %d (%s) has a path outside the allowed directories: %s", f.ID, f.Filename, f.Path)
+	}
+}
+
+// validateAllowedRoots checks every configured root is an existing directory
+func validateAllowedRoots(roots []string) error {
+	for _, root := range roots {
+		info, err := os.Stat(root)
+		if err != nil {
+			return fmt.Errorf("allowed root %s: %v", root, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("allowed root %s is not a directory", root)
+		}
+	}
+	return nil
+}
+
+func handleCheckPaths(w http.ResponseWriter, r *http.Request) {
+	violations, err := getPathViolations(r.Context())
+
+	adminData := AdminData{
+		Config:         config,
+		Error:          errorString(err),
+		PathViolations: violations,
+		PathsChecked:   err == nil,
+	}
+
+	renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPathAllowed(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "uploads")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "in.jpg"), filepath.Join(outside, "out.jpg")} {
+		if err := os.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "out.jpg"), filepath.Join(root, "link.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "linkdir")); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfig := config
+	t.Cleanup(func() { config = oldConfig })
+	config.UploadDir = root
+	config.AllowedRoots = nil
+	config.ArchiveDir = ""
+
+	tests := []struct {
+		name    string
+		path    string
+		allowed bool
+	}{
+		{"file in root", filepath.Join(root, "in.jpg"), true},
+		{"new file in root", filepath.Join(root, "new.jpg"), true},
+		{"root itself", root, false},
+		{"absolute path outside", filepath.Join(outside, "out.jpg"), false},
+		{"dot-dot escape", root + "/../outside/out.jpg", false},
+		{"dot-dot staying inside", root + "/sub/../in.jpg", true},
+		{"symlink to a file outside", filepath.Join(root, "link.jpg"), false},
+		{"file under a symlinked directory outside", filepath.Join(root, "linkdir", "out.jpg"), false},
+		{"sibling sharing the root's prefix", root + "-other/in.jpg", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPathAllowed(tt.path)
+			if tt.allowed && err != nil {
+				t.Errorf("checkPathAllowed(%q) = %v, want allowed", tt.path, err)
+			}
+			if !tt.allowed && err != errPathNotAllowed {
+				t.Errorf("checkPathAllowed(%q) = %v, want errPathNotAllowed", tt.path, err)
+			}
+		})
+	}
+}
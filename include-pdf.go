@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// A4 page size in PDF points, with a small margin around each image
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+	pdfPageMargin = 18.0
+)
+
+// pdfWriter streams a minimal PDF document with one JPEG image per page.
+// Object numbers are fixed up front so pages can be written as they are read:
+// 1 is the catalog, 2 the page tree, then four objects per page
+// (page, image, image length, content stream).
+type pdfWriter struct {
+	w         io.Writer
+	offset    int64
+	offsets   []int64
+	pageCount int
+	pagesDone int
+}
+
+// countingWriter tracks how many bytes have passed through it
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// newPDFWriter writes the PDF header, catalog and page tree for pageCount pages
+func newPDFWriter(w io.Writer, pageCount int) (*pdfWriter, error) {
+	p := &pdfWriter{
+		w:         w,
+		offsets:   make([]int64, 2+4*pageCount),
+		pageCount: pageCount,
+	}
+
+	if err := p.printf("%%PDF-1.4\n%%\xE2\xE3\xCF\xD3\n"); err != nil {
+		return nil, err
+	}
+
+	if err := p.writeObject(1, "<< /Type /Catalog /Pages 2 0 R >>"); err != nil {
+		return nil, err
+	}
+
+	kids := ""
+	for i := 0; i < pageCount; i++ {
+		kids += fmt.Sprintf("%d 0 R ", pdfPageObject(i))
+	}
+	if err := p.writeObject(2, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids, pageCount)); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// pdfPageObject returns the object number of the page at index i
+func pdfPageObject(i int) int {
+	return 3 + 4*i
+}
+
+func (p *pdfWriter) printf(format string, args ...interface{}) error {
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.offset += int64(n)
+	return err
+}
+
+func (p *pdfWriter) writeObject(num int, body string) error {
+	p.offsets[num-1] = p.offset
+	return p.printf("%d 0 obj\n%s\nendobj\n", num, body)
+}
+
+// writeImagePage adds a page showing a JPEG image scaled to fit the page.
+// writeJPEG must write the encoded JPEG data to the supplied writer.
+func (p *pdfWriter) writeImagePage(width, height int, colorSpace string, writeJPEG func(io.Writer) error) error {
+	if p.pagesDone >= p.pageCount {
+		return fmt.Errorf("all %d pages already written", p.pageCount)
+	}
+
+	pageObj := pdfPageObject(p.pagesDone)
+	imageObj := pageObj + 1
+	lengthObj := pageObj + 2
+	contentObj := pageObj + 3
+
+	// Scale to fit inside the margins and centre on the page
+	maxWidth := pdfPageWidth - 2*pdfPageMargin
+	maxHeight := pdfPageHeight - 2*pdfPageMargin
+	scale := maxWidth / float64(width)
+	if s := maxHeight / float64(height); s < scale {
+		scale = s
+	}
+	drawWidth := float64(width) * scale
+	drawHeight := float64(height) * scale
+	x := (pdfPageWidth - drawWidth) / 2
+	y := (pdfPageHeight - drawHeight) / 2
+
+	page := fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+		pdfPageWidth, pdfPageHeight, imageObj, contentObj)
+	if err := p.writeObject(pageObj, page); err != nil {
+		return err
+	}
+
+	// The image length is written as a separate object afterwards so the
+	// JPEG data can be streamed without knowing its size in advance
+	p.offsets[imageObj-1] = p.offset
+	if err := p.printf("%d 0 obj\n<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /DCTDecode /Length %d 0 R >>\nstream\n",
+		imageObj, width, height, colorSpace, lengthObj); err != nil {
+		return err
+	}
+	cw := &countingWriter{w: p.w}
+	err := writeJPEG(cw)
+	p.offset += cw.count
+	if err != nil {
+		return err
+	}
+	if err := p.printf("\nendstream\nendobj\n"); err != nil {
+		return err
+	}
+	if err := p.writeObject(lengthObj, fmt.Sprintf("%d", cw.count)); err != nil {
+		return err
+	}
+
+	content := fmt.Sprintf("q %.2f 0 0 %.2f %.2f %.2f cm /Im0 Do Q", drawWidth, drawHeight, x, y)
+	if err := p.writeObject(contentObj, fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content)); err != nil {
+		return err
+	}
+
+	p.pagesDone++
+	return nil
+}
+
+// close writes the cross-reference table and trailer
+func (p *pdfWriter) close() error {
+	if p.pagesDone != p.pageCount {
+		return fmt.Errorf("only %d of %d pages written", p.pagesDone, p.pageCount)
+	}
+
+	xrefOffset := p.offset
+	if err := p.printf("xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1); err != nil {
+		return err
+	}
+	for _, off := range p.offsets {
+		if err := p.printf("%010d 00000 n \n", off); err != nil {
+			return err
+		}
+	}
+	return p.printf("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.offsets)+1, xrefOffset)
+}
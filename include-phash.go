@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// With perceptual_hash enabled every uploaded image gets a 64 bit
+// difference hash (dHash) in files.phash. Unlike the SHA-256 in files.hash
+// it barely changes when an image is resized or re-encoded, so two images
+// whose hashes differ in at most duplicate_threshold bits are reported as
+// likely duplicates. Images added before hashing was enabled are hashed by
+// the phash_images job.
+
+// phashExtensions are the image formats that can be decoded for hashing
+var phashExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
+
+func canPerceptualHash(filename string) bool {
+	return phashExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
+// perceptualHash computes the dHash of an image: it is shrunk to 9x8
+// grayscale cells and each bit records whether a cell is brighter than the
+// cell to its right
+func perceptualHash(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	var cells [8][9]float64
+	b := img.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return 0, fmt.Errorf("image is empty")
+	}
+	for row := 0; row < 8; row++ {
+		for col := 0; col < 9; col++ {
+			cells[row][col] = cellLuminance(img, b.Min.X+col*b.Dx()/9, b.Min.Y+row*b.Dy()/8,
+				b.Min.X+(col+1)*b.Dx()/9, b.Min.Y+(row+1)*b.Dy()/8)
+		}
+	}
+
+	var hash uint64
+	for row := 0; row < 8; row++ {
+		for col := 0; col < 8; col++ {
+			hash <<= 1
+			if cells[row][col] > cells[row][col+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// cellLuminance averages the luminance over a rectangle of an image,
+// sampling at most 16x16 pixels so large images stay quick to hash
+func cellLuminance(img image.Image, x0, y0, x1, y1 int) float64 {
+	if x1 <= x0 {
+		x1 = x0 + 1
+	}
+	if y1 <= y0 {
+		y1 = y0 + 1
+	}
+	stepX := (x1-x0)/16 + 1
+	stepY := (y1-y0)/16 + 1
+
+	var sum float64
+	var n int
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
+
+// storePerceptualHash hashes an image file and records the hash
+func storePerceptualHash(ctx context.Context, fileID int64, path string) error {
+	hash, err := perceptualHash(path)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "UPDATE files SET phash=? WHERE id=?", int64(hash), fileID)
+	return err
+}
+
+// hashNewImage hashes a newly added image when perceptual hashing is enabled
+// and returns a warning naming any near duplicates already in the library
+func hashNewImage(ctx context.Context, fileID int64, path, filename string) string {
+	if !config.PerceptualHash || !canPerceptualHash(filename) {
+		return ""
+	}
+	if err := storePerceptualHash(ctx, fileID, path); err != nil {
+		return fmt.Sprintf("%s could not be checked for duplicates: %v", filename, err)
+	}
+
+	dupes, err := findNearDuplicates(ctx, fileID)
+	if err != nil || len(dupes) == 0 {
+		return ""
+	}
+	names := make([]string, len(dupes))
+	for i, d := range dupes {
+		names[i] = d.Filename
+	}
+	return fmt.Sprintf("%s looks like a near duplicate of %s", filename, strings.Join(names, ", "))
+}
+
+// hashedImage is an image with a perceptual hash
+type hashedImage struct {
+	ID       int
+	Filename string
+	Hash     uint64
+}
+
+func getHashedImages(ctx context.Context) ([]hashedImage, error) {
+	rows, err := db.QueryContext(ctx, "SELECT f.id, f.filename, f.phash FROM files f WHERE f.phash IS NOT NULL"+privateFilter(ctx)+" ORDER BY f.id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []hashedImage
+	for rows.Next() {
+		var img hashedImage
+		var hash int64
+		if err := rows.Scan(&img.ID, &img.Filename, &hash); err != nil {
+			return nil, err
+		}
+		img.Hash = uint64(hash)
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+// findNearDuplicates returns the other images within the duplicate
+// threshold of a file's perceptual hash
+func findNearDuplicates(ctx context.Context, fileID int64) ([]hashedImage, error) {
+	var hash sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT phash FROM files WHERE id=?", fileID).Scan(&hash); err != nil || !hash.Valid {
+		return nil, err
+	}
+
+	images, err := getHashedImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var dupes []hashedImage
+	for _, img := range images {
+		if int64(img.ID) != fileID && bits.OnesCount64(img.Hash^uint64(hash.Int64)) <= config.DuplicateThreshold {
+			dupes = append(dupes, img)
+		}
+	}
+	return dupes, nil
+}
+
+// DuplicateImage is one image in a group of likely duplicates
+type DuplicateImage struct {
+	ID              int
+	Filename        string
+	EscapedFilename string
+	Distance        int
+}
+
+// groupNearDuplicates groups images whose hashes are within threshold bits
+// of each other, directly or through other images in the group. Groups are
+// ordered by their first image, images within a group by ID.
+func groupNearDuplicates(images []hashedImage, threshold int) [][]DuplicateImage {
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			if bits.OnesCount64(images[i].Hash^images[j].Hash) <= threshold {
+				if a, b := find(i), find(j); a != b {
+					parent[b] = a
+				}
+			}
+		}
+	}
+
+	members := map[int][]int{}
+	for i := range images {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+
+	var groups [][]DuplicateImage
+	for _, idx := range members {
+		if len(idx) < 2 {
+			continue
+		}
+		sort.Ints(idx)
+		first := images[idx[0]]
+		group := make([]DuplicateImage, len(idx))
+		for k, i := range idx {
+			group[k] = DuplicateImage{
+				ID:              images[i].ID,
+				Filename:        images[i].Filename,
+				EscapedFilename: url.PathEscape(images[i].Filename),
+				Distance:        bits.OnesCount64(first.Hash ^ images[i].Hash),
+			}
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(a, b int) bool { return groups[a][0].ID < groups[b][0].ID })
+	return groups
+}
+
+// phashImages hashes every image that has no perceptual hash yet
+func phashImages(j *Job) (string, error) {
+	ctx := context.Background()
+
+	dbGate.RLock()
+	rows, err := db.QueryContext(ctx, "SELECT id, filename, path FROM files WHERE phash IS NULL ORDER BY id")
+	if err != nil {
+		dbGate.RUnlock()
+		return "", err
+	}
+	var files []File
+	for rows.Next() {
+		var f File
+		if err := rows.Scan(&f.ID, &f.Filename, &f.Path); err != nil {
+			rows.Close()
+			dbGate.RUnlock()
+			return "", err
+		}
+		if canPerceptualHash(f.Filename) {
+			files = append(files, f)
+		}
+	}
+	rows.Close()
+	dbGate.RUnlock()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	j.SetTotal(len(files))
+	hashed := 0
+	for _, f := range files {
+		hash, err := perceptualHash(f.Path)
+		if err == nil {
+			dbGate.RLock()
+			_, err = db.ExecContext(ctx, "UPDATE files SET phash=? WHERE id=?", int64(hash), f.ID)
+			dbGate.RUnlock()
+		}
+		if err != nil {
+			j.Fail(f.Filename, err)
+		} else {
+			hashed++
+		}
+		j.Step()
+	}
+
+	return fmt.Sprintf("Hashed %d of %d images", hashed, len(files)), nil
+}
+
+// DuplicatesData is the data for the duplicates report
+type DuplicatesData struct {
+	Groups    [][]DuplicateImage
+	Hashed    int
+	Threshold int
+	Enabled   bool
+}
+
+func duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		startJob("phash_images", phashImages)
+		http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+		return
+	}
+
+	images, err := getHashedImages(r.Context())
+	if err != nil {
+		renderError(w, "Failed to load image hashes", http.StatusInternalServerError)
+		return
+	}
+
+	data := DuplicatesData{
+		Groups:    groupNearDuplicates(images, config.DuplicateThreshold),
+		Hashed:    len(images),
+		Threshold: config.DuplicateThreshold,
+		Enabled:   config.PerceptualHash,
+	}
+	renderTemplate(w, "duplicates.html", buildPageData(r.Context(), "Near Duplicates", data))
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Placeholders are the gallery tiles for files with no preview of their own.
+// One is generated per extension on first use and cached next to the thumbnails.
+const (
+	placeholderWidth  = 320
+	placeholderHeight = 240
+)
+
+var placeholderExtPattern = regexp.MustCompile(`^[a-z0-9]{1,8}$`)
+
+// placeholderGroups picks the tile colour for related extensions
+var placeholderGroups = []struct {
+	Color      color.RGBA
+	Extensions []string
+}{
+	{color.RGBA{0x8e, 0x6c, 0x3a, 0xff}, []string{"zip", "rar", "7z", "tar", "gz", "bz2", "xz"}},
+	{color.RGBA{0x3a, 0x6c, 0x8e, 0xff}, []string{"pdf", "txt", "md", "doc", "docx", "odt", "rtf", "epub"}},
+	{color.RGBA{0x6c, 0x3a, 0x8e, 0xff}, []string{"mp3", "m4a", "flac", "wav", "ogg", "opus", "aac"}},
+	{color.RGBA{0x3a, 0x8e, 0x5c, 0xff}, []string{"svg", "bmp", "tif", "tiff", "psd", "heic"}},
+}
+
+var placeholderDefaultColor = color.RGBA{0x66, 0x66, 0x66, 0xff}
+
+// placeholderFont is a 5x7 bitmap font, each row of a glyph is the low 5 bits
+var placeholderFont = map[rune][7]uint8{
+	'0':  {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1':  {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2':  {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3':  {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4':  {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5':  {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6':  {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7':  {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8':  {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9':  {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	'A':  {0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'B':  {0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e},
+	'C':  {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e},
+	'D':  {0x1c, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1c},
+	'E':  {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f},
+	'F':  {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10},
+	'G':  {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f},
+	'H':  {0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'I':  {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'J':  {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c},
+	'K':  {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L':  {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f},
+	'M':  {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N':  {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O':  {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'P':  {0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10},
+	'Q':  {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d},
+	'R':  {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11},
+	'S':  {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e},
+	'T':  {0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U':  {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'V':  {0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04},
+	'W':  {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a},
+	'X':  {0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11},
+	'Y':  {0x11, 0x11, 0x11, 0x0a, 0x04, 0x04, 0x04},
+	'Z':  {0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f},
+	' ':  {},
+	'.':  {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c},
+	',':  {0x00, 0x00, 0x00, 0x00, 0x0c, 0x04, 0x08},
+	':':  {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00},
+	'-':  {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	'_':  {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f},
+	'+':  {0x00, 0x04, 0x04, 0x1f, 0x04, 0x04, 0x00},
+	'=':  {0x00, 0x00, 0x1f, 0x00, 0x1f, 0x00, 0x00},
+	'/':  {0x01, 0x01, 0x02, 0x04, 0x08, 0x10, 0x10},
+	'(':  {0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02},
+	')':  {0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08},
+	'[':  {0x0e, 0x08, 0x08, 0x08, 0x08, 0x08, 0x0e},
+	']':  {0x0e, 0x02, 0x02, 0x02, 0x02, 0x02, 0x0e},
+	'\'': {0x04, 0x04, 0x08, 0x00, 0x00, 0x00, 0x00},
+	'!':  {0x04, 0x04, 0x04, 0x04, 0x04, 0x00, 0x04},
+	'?':  {0x0e, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04},
+	'&':  {0x0c, 0x12, 0x14, 0x08, 0x15, 0x12, 0x0d},
+	'#':  {0x0a, 0x0a, 0x1f, 0x0a, 0x1f, 0x0a, 0x0a},
+}
+
+// bitmapTextWidth is the width in pixels of n glyphs drawn at scale. Each
+// glyph is 5 pixels wide with 1 pixel of spacing.
+func bitmapTextWidth(n, scale int) int {
+	if n == 0 {
+		return 0
+	}
+	return (n*6 - 1) * scale
+}
+
+// drawBitmapText draws text in upper case with its top left corner at x, y.
+// Characters the font has no glyph for are drawn as a question mark.
+func drawBitmapText(img *image.RGBA, text string, x, y, scale int, c color.Color) {
+	src := &image.Uniform{c}
+	for i, ch := range []rune(strings.ToUpper(text)) {
+		glyph, ok := placeholderFont[ch]
+		if !ok {
+			glyph = placeholderFont['?']
+		}
+		for row, bits := range glyph {
+			for col := 0; col < 5; col++ {
+				if bits&(1<<uint(4-col)) == 0 {
+					continue
+				}
+				px := x + (i*6+col)*scale
+				py := y + row*scale
+				draw.Draw(img, image.Rect(px, py, px+scale, py+scale), src, image.Point{}, draw.Src)
+			}
+		}
+	}
+}
+
+// placeholderExt returns the extension a file's placeholder is keyed on
+func placeholderExt(filename string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	if !placeholderExtPattern.MatchString(ext) {
+		return "file"
+	}
+	return ext
+}
+
+func placeholderColor(ext string) color.RGBA {
+	for _, group := range placeholderGroups {
+		for _, e := range group.Extensions {
+			if e == ext {
+				return group.Color
+			}
+		}
+	}
+	return placeholderDefaultColor
+}
+
+// generatePlaceholder draws the extension in large letters on its group colour
+func generatePlaceholder(ext string) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, placeholderWidth, placeholderHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{placeholderColor(ext)}, image.Point{}, draw.Src)
+
+	label := strings.ToUpper(ext)
+
+	// Scale the label to fill at most three quarters of the width
+	scale := placeholderWidth * 3 / 4 / bitmapTextWidth(len(label), 1)
+	if scale > 12 {
+		scale = 12
+	}
+	x0 := (placeholderWidth - bitmapTextWidth(len(label), scale)) / 2
+	y0 := (placeholderHeight - 7*scale) / 2
+	drawBitmapText(img, label, x0, y0, scale, color.White)
+
+	return img
+}
+
+// placeholderPath returns the cached placeholder for an extension, generating it if needed
+func placeholderPath(ext string) (string, error) {
+	dir := filepath.Join(config.UploadDir, "thumbnails", "placeholders")
+	path := filepath.Join(dir, ext+".png")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create placeholders directory: %v", err)
+	}
+
+	// Write to a temporary file first so concurrent requests never serve a partial image
+	tmp, err := os.CreateTemp(dir, ext+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create placeholder: %v", err)
+	}
+	if err := png.Encode(tmp, generatePlaceholder(ext)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to encode placeholder: %v", err)
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to save placeholder: %v", err)
+	}
+	return path, nil
+}
+
+// placeholderHandler serves /placeholder/{ext}.png
+func placeholderHandler(w http.ResponseWriter, r *http.Request) {
+	ext := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/placeholder/"), ".png")
+	if !placeholderExtPattern.MatchString(ext) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A configured fallback replaces the extension tile of its type
+	if custom := config.FallbackThumbnails[mediaType("file."+ext)]; custom != "" {
+		if _, err := os.Stat(custom); err == nil {
+			http.ServeFile(w, r, custom)
+			return
+		}
+	}
+
+	path, err := placeholderPath(ext)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeFile(w, r, path)
+}
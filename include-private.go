@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Private files are left out of listings, search and tag queries, and
+// cannot be opened directly, unless the request is authenticated. A request
+// is authenticated by the login cookie or by an "Authorization: Bearer
+// <password>" header for scripts. Without an access_password every request
+// counts as authenticated, so private files stay visible until one is set.
+//
+// The login cookie holds an HMAC of the password under a key generated at
+// startup, so it never contains the password, stops working when the
+// password changes and expires when the server restarts.
+
+const authCookie = "taggart_auth"
+
+var authKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+func authToken() string {
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write([]byte(config.AccessPassword))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isAuthenticated reports whether the request may see private files
+func isAuthenticated(r *http.Request) bool {
+	if config.AccessPassword == "" {
+		return true
+	}
+	if c, err := r.Cookie(authCookie); err == nil && hmac.Equal([]byte(c.Value), []byte(authToken())) {
+		return true
+	}
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(config.AccessPassword)) == 1
+	}
+	return false
+}
+
+type visibilityKey struct{}
+
+// withVisibility records on the request context whether private files may be shown
+func withVisibility(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), visibilityKey{}, isAuthenticated(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// showPrivate reports whether private files may be shown for this context.
+// Contexts not derived from a request never show them.
+func showPrivate(ctx context.Context) bool {
+	show, _ := ctx.Value(visibilityKey{}).(bool)
+	return show
+}
+
+// privateFilter is appended to a WHERE clause over files f to leave out
+// private files the request may not see
+func privateFilter(ctx context.Context) string {
+	if showPrivate(ctx) {
+		return ""
+	}
+	return " AND COALESCE(f.private, 0) = 0"
+}
+
+// hiddenFile reports whether the file with this id is private and the
+// request may not see it
+func hiddenFile(ctx context.Context, id string) bool {
+	if showPrivate(ctx) {
+		return false
+	}
+	var private bool
+	db.QueryRowContext(ctx, "SELECT COALESCE(private, 0) FROM files WHERE id=?", id).Scan(&private)
+	return private
+}
+
+// isPrivateUpload reports whether a path under /uploads/ is a private file
+// or one made from it: a thumbnail, sprite, preview clip or kept original
+func isPrivateUpload(ctx context.Context, name string) bool {
+	owners := uploadOwners(strings.TrimPrefix(path.Clean("/"+name), "/"))
+	if len(owners) == 0 {
+		return false
+	}
+	placeholders := make([]string, len(owners))
+	args := make([]interface{}, len(owners))
+	for i, owner := range owners {
+		placeholders[i] = "?"
+		args[i] = owner
+	}
+	var n int
+	db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM files
+		WHERE COALESCE(private, 0) = 1
+		AND filename IN (`+strings.Join(placeholders, ",")+`)`, args...).Scan(&n)
+	return n > 0
+}
+
+// uploadOwners returns the filenames a path under the upload directory may
+// belong to. A thumbnail named a.jpg.sprite.jpg is either the sprite of
+// a.jpg or the thumbnail of a.jpg.sprite, so both are returned.
+func uploadOwners(name string) []string {
+	switch {
+	case strings.HasPrefix(name, "originals/"):
+		return []string{strings.TrimPrefix(name, "originals/")}
+	case strings.HasPrefix(name, "thumbnails/compact/"):
+		name = strings.TrimPrefix(name, "thumbnails/compact/")
+		return []string{strings.TrimSuffix(name, ".jpg")}
+	case strings.HasPrefix(name, "thumbnails/"):
+		name = strings.TrimPrefix(name, "thumbnails/")
+		var owners []string
+		for _, suffix := range []string{".sprite.jpg", ".preview.mp4", ".jpg"} {
+			if strings.HasSuffix(name, suffix) {
+				owners = append(owners, strings.TrimSuffix(name, suffix))
+			}
+		}
+		return owners
+	}
+	return []string{name}
+}
+
+// requireLogin redirects to the login page, returning to the current page afterwards
+func requireLogin(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+}
+
+// safeNext only allows redirecting back to a path on this server
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// LoginData is the data for the login page
+type LoginData struct {
+	Next  string
+	Error string
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	data := LoginData{Next: safeNext(r.FormValue("next"))}
+
+	if r.Method == http.MethodPost {
+		password := r.FormValue("password")
+		if config.AccessPassword != "" && subtle.ConstantTimeCompare([]byte(password), []byte(config.AccessPassword)) == 1 {
+			http.SetCookie(w, &http.Cookie{
+				Name:     authCookie,
+				Value:    authToken(),
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, data.Next, http.StatusSeeOther)
+			return
+		}
+		data.Error = "Incorrect password"
+		if config.AccessPassword == "" {
+			data.Error = "No access password is set"
+		}
+	}
+
+	renderTemplate(w, "login.html", buildPageData(r.Context(), "Log In", data))
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: authCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// filePrivateHandler marks a file private or public
+func filePrivateHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+		return
+	}
+	if !showPrivate(r.Context()) {
+		renderError(w, "Log in to change whether a file is private", http.StatusForbidden)
+		return
+	}
+
+	private := parts[3] == "private"
+	res, err := db.ExecContext(r.Context(), "UPDATE files SET private=? WHERE id=?", private, parts[2])
+	if err != nil {
+		renderError(w, "Failed to update file", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		renderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	invalidateCaches()
+	audit(r, parts[3], fileTarget(parts[2]), "")
+
+	http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadsHidePrivateFilesAndDerivedFiles(t *testing.T) {
+	newTestDB(t)
+	config.AccessPassword = "pw"
+
+	addTestFile(t, "public.jpg")
+	private := addTestFile(t, "private.jpg")
+	if _, err := db.Exec("UPDATE files SET private = 1 WHERE id = ?", private); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, name := range []string{"public.jpg", "private.jpg"} {
+		paths = append(paths,
+			name,
+			"originals/"+name,
+			"thumbnails/"+name+".jpg",
+			"thumbnails/"+name+".sprite.jpg",
+			"thumbnails/"+name+".preview.mp4",
+			"thumbnails/compact/"+name+".jpg",
+		)
+	}
+	for _, p := range paths {
+		full := filepath.Join(config.UploadDir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(p string, loggedIn bool) int {
+		r := httptest.NewRequest("GET", "/"+p, nil)
+		if loggedIn {
+			r.Header.Set("Authorization", "Bearer pw")
+		}
+		w := httptest.NewRecorder()
+		withVisibility(http.HandlerFunc(uploadsHandler)).ServeHTTP(w, r)
+		return w.Code
+	}
+	for i, p := range paths {
+		want := http.StatusOK
+		if i >= len(paths)/2 {
+			want = http.StatusNotFound
+		}
+		if got := get(p, false); got != want {
+			t.Errorf("logged out GET /uploads/%s = %d, want %d", p, got, want)
+		}
+		if got := get(p, true); got != http.StatusOK {
+			t.Errorf("logged in GET /uploads/%s = %d, want %d", p, got, http.StatusOK)
+		}
+	}
+}
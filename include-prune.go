@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+// pruneUnusedTags deletes tags no file uses and then categories with no
+// tags left, returning how many of each were removed. It runs inside the
+// caller's transaction so pruning commits or rolls back with the removal
+// that caused it.
+func pruneUnusedTags(ctx context.Context, tx *sql.Tx) (int64, int64, error) {
+	res, err := tx.ExecContext(ctx, `
+		DELETE FROM tags
+		WHERE NOT EXISTS (SELECT 1 FROM file_tags ft WHERE ft.tag_id = tags.id)`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to prune tags: %v", err)
+	}
+	tags, _ := res.RowsAffected()
+
+	res, err = tx.ExecContext(ctx, `
+		DELETE FROM categories
+		WHERE NOT EXISTS (SELECT 1 FROM tags t WHERE t.category_id = categories.id)`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to prune categories: %v", err)
+	}
+	categories, _ := res.RowsAffected()
+
+	return tags, categories, nil
+}
+
+// autoPruneUnusedTags prunes after a removal when auto_prune_tags is set
+func autoPruneUnusedTags(ctx context.Context, tx *sql.Tx) error {
+	if !config.AutoPruneTags {
+		return nil
+	}
+	_, _, err := pruneUnusedTags(ctx, tx)
+	return err
+}
+
+func handlePruneTags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	adminData := AdminData{
+		Config: config,
+	}
+
+	tags, categories, err := func() (int64, int64, error) {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to start transaction: %v", err)
+		}
+		defer tx.Rollback()
+
+		tags, categories, err := pruneUnusedTags(ctx, tx)
+		if err != nil {
+			return 0, 0, err
+		}
+		return tags, categories, tx.Commit()
+	}()
+
+	if err != nil {
+		adminData.Error = err.Error()
+	} else {
+		invalidateCaches()
+		adminData.Success = fmt.Sprintf("Removed %d unused tags and %d empty categories", tags, categories)
+	}
+
+	renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+}
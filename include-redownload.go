@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A file with a source URL can be downloaded again, directly or with
+// yt-dlp, to replace a truncated or poor copy. Only the bytes on disk change:
+// the database row keeps its ID, tags and description. The download is
+// checked before it replaces anything, and the old file is put back if
+// processing the new one fails.
+
+var errNoSourceURL = errors.New("file has no source URL")
+
+// downloadURL saves the body of a successful GET of rawURL to dst, checking
+// it has content suited to filename
+func downloadURL(ctx context.Context, rawURL, filename, dst string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download file: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download file: %s", resp.Status)
+	}
+	if err := checkDownloadContentType(resp.Header.Get("Content-Type"), filename); err != nil {
+		return fmt.Errorf("download rejected, keeping the current file: %v", err)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	_, err = io.Copy(out, resp.Body)
+	out.Close()
+	if err != nil {
+		return fmt.Errorf("failed to copy file data: %v", err)
+	}
+	return nil
+}
+
+// downloadYtdlp downloads a single video with yt-dlp and moves it to dst.
+// The download must have the extension of the file it replaces.
+func downloadYtdlp(ctx context.Context, videoURL, dst, ext string) error {
+	stagingDir, err := os.MkdirTemp(config.UploadDir, ".ytdlp-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	outTemplate := filepath.Join(stagingDir, "%(title)s.%(ext)s")
+	if _, err := runYtdlp(ctx, false, ytdlpArgs(config.YtdlpFormat, false, videoURL, "-o", outTemplate)...); err != nil {
+		return fmt.Errorf("failed to download video: %v", err)
+	}
+
+	downloaded, err := getYtdlpDownloads(stagingDir, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read downloaded files: %v", err)
+	}
+	if len(downloaded) == 0 {
+		return fmt.Errorf("yt-dlp finished but no downloaded file was found")
+	}
+	if got := filepath.Ext(downloaded[0]); !strings.EqualFold(got, ext) {
+		return fmt.Errorf("yt-dlp downloaded a %s file but the file being replaced is %s", got, ext)
+	}
+	if err := os.Rename(downloaded[0], dst); err != nil {
+		return fmt.Errorf("failed to move downloaded file: %v", err)
+	}
+	return nil
+}
+
+// redownloadFile replaces a file's contents with a fresh download from its
+// source URL and refreshes its hash, metadata and thumbnail. It returns a
+// warning for anything worth telling the user that did not stop it.
+func redownloadFile(ctx context.Context, id string, useYtdlp bool) (File, string, error) {
+	var f File
+	var oldHash string
+	err := db.QueryRowContext(ctx, "SELECT id, filename, path, COALESCE(source_url, ''), COALESCE(hash, '') FROM files WHERE id=?", id).
+		Scan(&f.ID, &f.Filename, &f.Path, &f.SourceURL, &oldHash)
+	if err != nil {
+		return f, "", errFileNotFound
+	}
+	if f.SourceURL == "" {
+		return f, "", errNoSourceURL
+	}
+	if err := checkPathAllowed(f.Path); err != nil {
+		return f, "", err
+	}
+
+	tempPath := f.Path + ".tmp"
+	defer os.Remove(tempPath)
+	if useYtdlp {
+		err = downloadYtdlp(ctx, f.SourceURL, tempPath, filepath.Ext(f.Filename))
+	} else {
+		err = downloadURL(ctx, f.SourceURL, f.Filename, tempPath)
+	}
+	if err != nil {
+		return f, "", err
+	}
+
+	info, err := os.Stat(tempPath)
+	if err != nil {
+		return f, "", err
+	}
+	if info.Size() == 0 {
+		return f, "", fmt.Errorf("the download is empty (0 bytes), keeping the current file")
+	}
+	if err := validateMediaFile(tempPath, f.Filename); err != nil {
+		return f, "", fmt.Errorf("the download appears to be corrupt, keeping the current file: %v", err)
+	}
+
+	// Keep the current file until the new one is in place
+	backupPath := f.Path + ".old.tmp"
+	if err := os.Rename(f.Path, backupPath); err != nil && !os.IsNotExist(err) {
+		return f, "", fmt.Errorf("failed to move current file aside: %v", err)
+	}
+	restore := func() {
+		if err := os.Rename(backupPath, f.Path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to put back %s: %v", f.Path, err)
+		}
+	}
+
+	var warningMsg string
+	if isVideoFile(f.Filename) {
+		if _, warningMsg, err = processVideoFile(tempPath, f.Path); err != nil {
+			restore()
+			return f, "", err
+		}
+	} else {
+		if warningMsg, err = limitImageSize(tempPath, f.Filename); err != nil {
+			restore()
+			return f, "", fmt.Errorf("failed to downscale %s: %v", f.Filename, err)
+		}
+		if err := os.Rename(tempPath, f.Path); err != nil {
+			restore()
+			return f, "", fmt.Errorf("failed to move file: %v", err)
+		}
+		makeImageThumbnail(f.Path)
+	}
+	os.Remove(backupPath)
+
+	var hash interface{}
+	if h, err := fileHash(f.Path); err == nil {
+		hash = h
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE files SET hash=?, phash=NULL WHERE id=?", hash, f.ID); err != nil {
+		return f, "", fmt.Errorf("file replaced but failed to update its hash: %v", err)
+	}
+	releaseSharedThumbnails(ctx, oldHash)
+	if m, err := probeFileMetadata(f.Path, f.Filename); err == nil {
+		if err := storeFileMetadata(ctx, int64(f.ID), m); err != nil {
+			log.Printf("Warning: %v for %s", err, f.Filename)
+		}
+	}
+	if dupeMsg := hashNewImage(ctx, int64(f.ID), f.Path, f.Filename); dupeMsg != "" {
+		if warningMsg != "" {
+			warningMsg += "; "
+		}
+		warningMsg += dupeMsg
+	}
+	invalidateCaches()
+
+	return f, warningMsg, nil
+}
+
+// fileRedownloadHandler serves POST /file/{id}/redownload, using yt-dlp when
+// the form asks for it
+func fileRedownloadHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+		return
+	}
+
+	var private bool
+	if err := db.QueryRowContext(r.Context(), "SELECT COALESCE(private, 0) FROM files WHERE id=?", parts[2]).Scan(&private); err == nil && private && !showPrivate(r.Context()) {
+		requireLogin(w, r)
+		return
+	}
+
+	useYtdlp := r.FormValue("method") == "ytdlp"
+	f, warningMsg, err := redownloadFile(r.Context(), parts[2], useYtdlp)
+	if err != nil {
+		switch err {
+		case errFileNotFound:
+			renderError(w, "File not found", http.StatusNotFound)
+		case errNoSourceURL:
+			renderError(w, "This file has no source URL to download from", http.StatusBadRequest)
+		case errPathNotAllowed:
+			renderError(w, "Refusing to replace a file outside the allowed directories", http.StatusForbidden)
+		default:
+			renderError(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	audit(r, "redownload", fileTarget(f.ID), f.SourceURL)
+
+	redirectWithWarning(w, r, fmt.Sprintf("/file/%d", f.ID), warningMsg)
+}
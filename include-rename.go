@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RenameForm holds the find and replace inputs from the admin page
+type RenameForm struct {
+	Match       string
+	Replacement string
+	UseRegex    bool
+}
+
+// RenamePreview describes the rename planned for a single file
+type RenamePreview struct {
+	FileID   int
+	OldName  string
+	NewName  string
+	Conflict string
+}
+
+// buildRenamePreview works out the new name of every file whose name matches,
+// flagging names that already exist or would collide with another rename
+func buildRenamePreview(ctx context.Context, form RenameForm) ([]RenamePreview, error) {
+	if form.Match == "" {
+		return nil, fmt.Errorf("match text cannot be empty")
+	}
+
+	var re *regexp.Regexp
+	if form.UseRegex {
+		var err error
+		re, err = regexp.Compile(form.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression: %v", err)
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, filename FROM files ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	var previews []RenamePreview
+	for rows.Next() {
+		var id int
+		var filename string
+		if err := rows.Scan(&id, &filename); err != nil {
+			return nil, err
+		}
+		existing[filename] = true
+
+		var newName string
+		if re != nil {
+			newName = re.ReplaceAllString(filename, form.Replacement)
+		} else {
+			newName = strings.ReplaceAll(filename, form.Match, form.Replacement)
+		}
+		newName = strings.TrimSpace(newName)
+		if newName == filename {
+			continue
+		}
+		if newName != "" {
+			newName = sanitizeFilename(newName)
+		}
+
+		previews = append(previews, RenamePreview{FileID: id, OldName: filename, NewName: newName})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	targets := make(map[string]int)
+	for _, p := range previews {
+		targets[p.NewName]++
+	}
+
+	for i := range previews {
+		p := &previews[i]
+		switch {
+		case p.NewName == "":
+			p.Conflict = "new name is empty"
+		case targets[p.NewName] > 1:
+			p.Conflict = "several files would get this name"
+		case existing[p.NewName]:
+			p.Conflict = "another file already has this name"
+		default:
+			if _, err := os.Stat(filepath.Join(config.UploadDir, p.NewName)); !os.IsNotExist(err) {
+				p.Conflict = "a file with this name exists on disk"
+			}
+		}
+	}
+
+	return previews, nil
+}
+
+// applyRenames renames every file in the preview that has no conflict,
+// returning the number renamed and a description of each failure
+func applyRenames(ctx context.Context, previews []RenamePreview) (int, []string) {
+	renamed := 0
+	var failures []string
+	for _, p := range previews {
+		if p.Conflict != "" {
+			failures = append(failures, fmt.Sprintf("%s: %s", p.OldName, p.Conflict))
+			continue
+		}
+		if err := renameFile(ctx, strconv.Itoa(p.FileID), p.NewName); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", p.OldName, err))
+			continue
+		}
+		renamed++
+	}
+	return renamed, failures
+}
+
+func handleBulkRename(w http.ResponseWriter, r *http.Request) {
+	form := RenameForm{
+		Match:       r.FormValue("rename_match"),
+		Replacement: r.FormValue("rename_replacement"),
+		UseRegex:    r.FormValue("rename_regex") == "on",
+	}
+
+	adminData := AdminData{
+		Config:     config,
+		RenameForm: form,
+	}
+
+	previews, err := buildRenamePreview(r.Context(), form)
+	if err != nil {
+		adminData.Error = err.Error()
+		renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+		return
+	}
+
+	if r.FormValue("action") == "rename_preview" {
+		adminData.RenamePreview = previews
+		if len(previews) == 0 {
+			adminData.Success = "No filenames match"
+		}
+		renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+		return
+	}
+
+	renamed, failures := applyRenames(r.Context(), previews)
+	adminData.Success = fmt.Sprintf("Renamed %d files", renamed)
+	if len(failures) > 0 {
+		adminData.Error = fmt.Sprintf("Skipped %d files: %s", len(failures), strings.Join(failures, "; "))
+	}
+	renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+}
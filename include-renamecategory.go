@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Renaming a category from the admin page changes its name in place, so
+// every tag in it keeps its files. When a category with the new name
+// already exists the two are merged: each tag is moved into it, a tag whose
+// value is already there is merged into that tag, and the emptied category
+// is deleted. Alias groups of the old category follow it to the new name.
+
+// RenameCategoryResult reports what renaming a category did
+type RenameCategoryResult struct {
+	Tags   int  // tags in the renamed category
+	Files  int  // files carrying any of them
+	Merged bool // whether it was merged into an existing category
+}
+
+// renameCategory renames the category oldName to newName in one
+// transaction, merging it into an existing category with that name
+func renameCategory(ctx context.Context, oldName, newName string) (RenameCategoryResult, error) {
+	var result RenameCategoryResult
+	oldName = strings.TrimSpace(oldName)
+	newName = strings.TrimSpace(newName)
+	if oldName == "" || newName == "" {
+		return result, fmt.Errorf("category and new name are required")
+	}
+	if newName == oldName {
+		return result, fmt.Errorf("the category is already called %s", newName)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var sourceID int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM categories WHERE name=?", oldName).Scan(&sourceID)
+	if err == sql.ErrNoRows {
+		return result, fmt.Errorf("category %s not found", oldName)
+	} else if err != nil {
+		return result, err
+	}
+
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*), (SELECT COUNT(DISTINCT ft.file_id) FROM file_tags ft JOIN tags t ON t.id = ft.tag_id WHERE t.category_id = ?)
+		FROM tags WHERE category_id = ?`, sourceID, sourceID).Scan(&result.Tags, &result.Files); err != nil {
+		return result, err
+	}
+
+	// Names are compared without case, so a change of case finds the
+	// category itself and is a plain rename
+	var targetID int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM categories WHERE name=?", newName).Scan(&targetID)
+	if err != nil && err != sql.ErrNoRows {
+		return result, err
+	}
+	result.Merged = err == nil && targetID != sourceID
+
+	if result.Merged {
+		rows, err := tx.QueryContext(ctx, "SELECT id, value FROM tags WHERE category_id=?", sourceID)
+		if err != nil {
+			return result, err
+		}
+		type tag struct {
+			id    int
+			value string
+		}
+		var tags []tag
+		for rows.Next() {
+			var t tag
+			if err := rows.Scan(&t.id, &t.value); err != nil {
+				rows.Close()
+				return result, err
+			}
+			tags = append(tags, t)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return result, err
+		}
+
+		for _, t := range tags {
+			if _, err := moveTagInTx(ctx, tx, t.id, t.value, targetID); err != nil {
+				return result, err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM categories WHERE id=?", sourceID); err != nil {
+			return result, fmt.Errorf("failed to delete category %s: %v", oldName, err)
+		}
+	} else if _, err := tx.ExecContext(ctx, "UPDATE categories SET name=? WHERE id=?", newName, sourceID); err != nil {
+		return result, fmt.Errorf("failed to rename category: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit: %v", err)
+	}
+	invalidateCaches()
+
+	renameAliasCategory(oldName, newName)
+
+	return result, nil
+}
+
+// renameAliasCategory points the alias groups of a renamed category at its
+// new name and saves the configuration if any changed
+func renameAliasCategory(oldName, newName string) {
+	changed := false
+	for i, group := range config.TagAliases {
+		if strings.EqualFold(group.Category, oldName) {
+			config.TagAliases[i].Category = newName
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := saveConfig(); err != nil {
+		log.Printf("Warning: failed to save tag aliases for renamed category %s: %v", newName, err)
+	}
+}
+
+func handleRenameCategory(w http.ResponseWriter, r *http.Request) {
+	category := strings.TrimSpace(r.FormValue("category"))
+	newName := strings.TrimSpace(r.FormValue("new_name"))
+
+	adminData := AdminData{
+		Config: config,
+	}
+
+	result, err := renameCategory(r.Context(), category, newName)
+	if err != nil {
+		adminData.Error = "Failed to rename category: " + err.Error()
+	} else {
+		audit(r, "category-rename", "category:"+category, fmt.Sprintf("to %s, %d tags affecting %d files", newName, result.Tags, result.Files))
+		if result.Merged {
+			adminData.Success = fmt.Sprintf("Merged %s into the existing %s, moving %d tags on %d files", category, newName, result.Tags, result.Files)
+		} else {
+			adminData.Success = fmt.Sprintf("Renamed %s to %s, with %d tags on %d files", category, newName, result.Tags, result.Files)
+		}
+		adminData.Config = config
+	}
+
+	renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+}
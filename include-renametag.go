@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// POST /tag/{category}/{value}/rename with a value field renames a tag in
+// place, so fixing a typo keeps it on every file. When the category already
+// has a tag with the new value the two are merged: files with the old tag
+// get the existing one, keeping where it was ordered among their tags, and
+// the old tag is deleted.
+
+// renameTag renames the tag category:oldValue to newValue in one
+// transaction, merging it into an existing tag with that value. It returns
+// how many files carry the tag and whether it was merged.
+func renameTag(ctx context.Context, category, oldValue, newValue string) (int, bool, error) {
+	category = strings.TrimSpace(category)
+	oldValue = strings.TrimSpace(oldValue)
+	newValue = strings.TrimSpace(newValue)
+	if category == "" || oldValue == "" || newValue == "" {
+		return 0, false, fmt.Errorf("category, value and new value are required")
+	}
+	if newValue == oldValue {
+		return 0, false, fmt.Errorf("the tag is already called %s", newValue)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var tagID, categoryID int
+	err = tx.QueryRowContext(ctx, `
+		SELECT t.id, t.category_id
+		FROM tags t
+		JOIN categories c ON c.id = t.category_id
+		WHERE c.name = ? AND t.value = ?`, category, oldValue).Scan(&tagID, &categoryID)
+	if err == sql.ErrNoRows {
+		return 0, false, fmt.Errorf("tag %s:%s not found", category, oldValue)
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	var files int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM file_tags WHERE tag_id=?", tagID).Scan(&files); err != nil {
+		return 0, false, err
+	}
+
+	var existingID int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE category_id=? AND value=?", categoryID, newValue).Scan(&existingID)
+	merged := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return 0, false, err
+	}
+
+	if merged {
+		if _, _, err := mergeTagInTx(ctx, tx, tagID, existingID); err != nil {
+			return 0, false, err
+		}
+	} else if _, err := tx.ExecContext(ctx, "UPDATE tags SET value=? WHERE id=?", newValue, tagID); err != nil {
+		return 0, false, fmt.Errorf("failed to rename tag: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, false, fmt.Errorf("failed to commit: %v", err)
+	}
+	invalidateCaches()
+
+	return files, merged, nil
+}
+
+// tagRenameHandler serves POST /tag/{category}/{value}/rename
+func tagRenameHandler(w http.ResponseWriter, r *http.Request, category, value string) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/tag/"+category+"/"+value, http.StatusSeeOther)
+		return
+	}
+	newValue := strings.TrimSpace(r.FormValue("value"))
+
+	files, merged, err := renameTag(r.Context(), category, value, newValue)
+	if err != nil {
+		http.Redirect(w, r, "/tags?error="+url.QueryEscape("Failed to rename tag: "+err.Error()), http.StatusSeeOther)
+		return
+	}
+	audit(r, "tag-rename", "tag:"+category+":"+value, fmt.Sprintf("to %s, affecting %d files", newValue, files))
+
+	var message string
+	if merged {
+		message = fmt.Sprintf("Merged %s:%s into the existing %s:%s, affecting %d files", category, value, category, newValue, files)
+	} else {
+		message = fmt.Sprintf("Renamed %s:%s to %s:%s, affecting %d files", category, value, category, newValue, files)
+	}
+	http.Redirect(w, r, "/tags?success="+url.QueryEscape(message)+"#tag-"+url.PathEscape(category), http.StatusSeeOther)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// limitImageSize downscales the image at path in place when its width or
+// height is larger than the configured max_image_dimension, keeping the
+// aspect ratio. With keep_originals set the full size image is first copied
+// to the originals directory. It returns a warning describing any change.
+func limitImageSize(path, filename string) (string, error) {
+	limit := config.MaxImageDimension
+	ext := strings.ToLower(filepath.Ext(filename))
+	if limit <= 0 || (ext != ".jpg" && ext != ".jpeg" && ext != ".png") {
+		return "", nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		f.Close()
+		return "", fmt.Errorf("cannot read image header: %v", err)
+	}
+	if cfg.Width <= limit && cfg.Height <= limit {
+		f.Close()
+		return "", nil
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		f.Close()
+		return "", err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	if config.KeepOriginals {
+		originalsDir := filepath.Join(config.UploadDir, "originals")
+		if err := os.MkdirAll(originalsDir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create originals directory: %v", err)
+		}
+		if err := exportFile(path, filepath.Join(originalsDir, filename), "copy"); err != nil {
+			return "", fmt.Errorf("failed to keep original: %v", err)
+		}
+	}
+
+	resized := resizeImage(img, limit, limit)
+
+	out, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to write resized image: %v", err)
+	}
+	if ext == ".png" {
+		err = png.Encode(out, resized)
+	} else {
+		err = jpeg.Encode(out, resized, &jpeg.Options{Quality: 90})
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to encode resized image: %v", err)
+	}
+
+	b := resized.Bounds()
+	return fmt.Sprintf("%s was %dx%d and has been downscaled to %dx%d.", filename, cfg.Width, cfg.Height, b.Dx(), b.Dy()), nil
+}
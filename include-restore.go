@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Restoring a backup replaces the database file under the global db handle.
+// Every request holds dbGate for reading while it runs and a restore holds
+// it for writing, so no request sees the handle while it is being swapped.
+// The restored database goes through initSchema, so a backup taken by an
+// older version gains any newer columns without a restart.
+
+var dbGate sync.RWMutex
+
+// restorePath serves the restore page, which takes dbGate itself
+const restorePath = "/admin/restore"
+
+// withDBGate holds dbGate for reading for the duration of each request
+func withDBGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != restorePath {
+			dbGate.RLock()
+			defer dbGate.RUnlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BackupInfo describes one backup file next to the database
+type BackupInfo struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+// RestoreData is the data for the restore page
+type RestoreData struct {
+	Backups []BackupInfo
+	Error   string
+	Success string
+}
+
+// listBackups returns the backups made by backupDatabase, newest first
+func listBackups(dbPath string) ([]BackupInfo, error) {
+	pattern := strings.TrimSuffix(dbPath, filepath.Ext(dbPath)) + "_backup_*.db"
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []BackupInfo
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		backups = append(backups, BackupInfo{Name: filepath.Base(path), Size: info.Size(), Modified: info.ModTime()})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name > backups[j].Name })
+	return backups, nil
+}
+
+// checkBackupIntegrity runs SQLite's integrity check over a backup without modifying it
+func checkBackupIntegrity(path string) error {
+	backup, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	var result string
+	if err := backup.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("integrity check failed: %v", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+	return nil
+}
+
+// restoreBackup replaces the database with the named backup, first backing
+// up the current database. It returns the path of that safety backup.
+func restoreBackup(name string) (string, error) {
+	backups, err := listBackups(openDatabasePath)
+	if err != nil {
+		return "", err
+	}
+	var backupPath string
+	for _, b := range backups {
+		if b.Name == name {
+			backupPath = filepath.Join(filepath.Dir(openDatabasePath), b.Name)
+		}
+	}
+	if backupPath == "" {
+		return "", fmt.Errorf("backup %s not found", name)
+	}
+	if err := checkBackupIntegrity(backupPath); err != nil {
+		return "", err
+	}
+
+	dbGate.Lock()
+	defer dbGate.Unlock()
+
+	flushCaches()
+	safetyPath, err := backupDatabase(openDatabasePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to back up the current database: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		return safetyPath, fmt.Errorf("failed to close the database: %v", err)
+	}
+
+	if err := replaceDatabase(backupPath); err != nil {
+		// Put the current database back so the server keeps working
+		if restoreErr := replaceDatabase(safetyPath); restoreErr != nil {
+			err = fmt.Errorf("%v, and reopening the previous database failed: %v", err, restoreErr)
+		}
+		return safetyPath, err
+	}
+
+	invalidateCaches()
+	return safetyPath, nil
+}
+
+// replaceDatabase copies src over the database file and reopens the global
+// handle on it. The caller must hold dbGate for writing with db closed.
+func replaceDatabase(src string) error {
+	tmpPath := openDatabasePath + ".restore"
+	if err := exportFile(src, tmpPath, "copy"); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to copy backup: %v", err)
+	}
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		os.Remove(openDatabasePath + suffix)
+	}
+	if err := os.Rename(tmpPath, openDatabasePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace database: %v", err)
+	}
+
+	newDB, err := sql.Open(timedDriverName, openDatabasePath)
+	if err != nil {
+		return fmt.Errorf("failed to open restored database: %v", err)
+	}
+	db = newDB
+	if err := initSchema(); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to update restored database: %v", err)
+	}
+	return nil
+}
+
+func restoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	var data RestoreData
+
+	if r.Method == http.MethodPost {
+		name := r.FormValue("backup")
+		safetyPath, err := restoreBackup(name)
+		if err != nil {
+			data.Error = "Failed to restore " + name + ": " + err.Error()
+		} else {
+			data.Success = fmt.Sprintf("Restored %s. The previous database was saved as %s.", name, filepath.Base(safetyPath))
+			dbGate.RLock()
+			audit(r, "db-restore", "", name)
+			dbGate.RUnlock()
+		}
+	}
+
+	backups, err := listBackups(openDatabasePath)
+	if err != nil && data.Error == "" {
+		data.Error = "Failed to list backups: " + err.Error()
+	}
+	data.Backups = backups
+
+	dbGate.RLock()
+	defer dbGate.RUnlock()
+	renderTemplate(w, "restore.html", buildPageData(r.Context(), "Restore Backup", data))
+}
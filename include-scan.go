@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The scan job imports files copied straight into the upload directory, the
+// ones the orphans report lists. The directory is read a batch of entries at
+// a time so a large one starts importing at once, and the job counts what it
+// has scanned, added and skipped as it goes. Video and image thumbnails are
+// generated by a few workers alongside the scan rather than one ffmpeg per
+// file at once.
+// Names matching a scan_ignore pattern are left out here and in the report.
+// The report can also import only the files ticked on it, straight away
+// rather than as a job, making their thumbnails if asked.
+
+// scanBatchSize is how many directory entries are read at a time
+const scanBatchSize = 256
+
+// scanThumbnailWorkers caps how many thumbnails are generated at once
+const scanThumbnailWorkers = 4
+
+// defaultScanIgnore covers dotfiles such as .DS_Store and the files Windows
+// leaves behind
+var defaultScanIgnore = []string{".*", "Thumbs.db", "desktop.ini"}
+
+// ignoredOnDisk reports whether an upload directory entry is never treated
+// as a file of the library: directories, the thumbnails directory even when
+// it is a symlink, and names matching a scan_ignore pattern
+func ignoredOnDisk(e os.DirEntry) bool {
+	if e.IsDir() || e.Name() == "thumbnails" {
+		return true
+	}
+	name := strings.ToLower(e.Name())
+	for _, pattern := range config.ScanIgnore {
+		if matched, _ := filepath.Match(strings.ToLower(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validateScanIgnore checks every ignore pattern is a valid filename pattern
+func validateScanIgnore(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("ignored file pattern %q is invalid: %v", pattern, err)
+		}
+		if strings.ContainsRune(pattern, filepath.Separator) {
+			return fmt.Errorf("ignored file pattern %q must be a filename, not a path", pattern)
+		}
+	}
+	return nil
+}
+
+// scanUploads adds every untracked file in the upload directory to the database
+func scanUploads(j *Job) (string, error) {
+	dbGate.RLock()
+	known, err := getFilesInDB()
+	dbGate.RUnlock()
+	if err != nil {
+		return "", fmt.Errorf("failed to list files in database: %v", err)
+	}
+
+	dir, err := os.Open(config.UploadDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to open upload directory: %v", err)
+	}
+	defer dir.Close()
+
+	thumbnails := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < scanThumbnailWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filename := range thumbnails {
+				generate := generateThumbnail
+				if isThumbnailImage(filename) {
+					generate = generateImageThumbnail
+				}
+				if err := generate(filepath.Join(config.UploadDir, filename), config.UploadDir, filename); err != nil {
+					j.Fail(filename, err)
+				}
+			}
+		}()
+	}
+
+	scanned, added := 0, 0
+	for {
+		entries, err := dir.ReadDir(scanBatchSize)
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			j.Count("scanned")
+			j.Step()
+			scanned++
+			name := e.Name()
+			if ignoredOnDisk(e) {
+				j.Count("ignored")
+				continue
+			}
+			// In-progress uploads are written next to their final name with .tmp appended
+			if known[name] || strings.HasSuffix(name, ".tmp") {
+				j.Count("skipped")
+				continue
+			}
+
+			if err := scanFile(name); err != nil {
+				j.Fail(name, err)
+				continue
+			}
+			known[name] = true
+			added++
+			j.Count("added")
+			if (isVideoFile(name) && config.ThumbnailMode != "lazy") || isThumbnailImage(name) {
+				thumbnails <- name
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			close(thumbnails)
+			wg.Wait()
+			return "", fmt.Errorf("failed to read upload directory: %v", err)
+		}
+	}
+	close(thumbnails)
+	wg.Wait()
+	missingThumbnailsReport.Invalidate()
+	j.SetTotal(scanned)
+
+	return fmt.Sprintf("Added %d files from the upload directory", added), nil
+}
+
+// scanFile adds one file found in the upload directory to the database
+func scanFile(filename string) error {
+	path := filepath.Join(config.UploadDir, filename)
+
+	dbGate.RLock()
+	defer dbGate.RUnlock()
+	id, err := saveFileToDatabase(filename, path, fileOrigin{Source: sourceScan, OriginalName: filename})
+	if err != nil {
+		return err
+	}
+	hashNewImage(context.Background(), id, path, filename)
+	return nil
+}
+
+// OrphanImportResult reports what importing chosen orphaned files did
+type OrphanImportResult struct {
+	Imported int      // files added to the database
+	Skipped  int      // files already tracked, ignored or no longer on disk
+	Failures []string // files that could not be added, with the reason
+}
+
+// importOrphans adds the named files of the upload directory to the
+// database, skipping any that are tracked already, and makes their
+// thumbnails when thumbnails is set
+func importOrphans(ctx context.Context, names []string, thumbnails bool) (OrphanImportResult, error) {
+	var result OrphanImportResult
+	known, err := getFilesInDB()
+	if err != nil {
+		return result, fmt.Errorf("failed to list files in database: %v", err)
+	}
+
+	for _, name := range names {
+		// Only plain names of the upload directory, never a path out of it
+		if name == "" || name != filepath.Base(name) || known[name] || strings.HasSuffix(name, ".tmp") {
+			result.Skipped++
+			continue
+		}
+		path := filepath.Join(config.UploadDir, name)
+		info, err := os.Lstat(path)
+		if err != nil || ignoredOnDisk(fs.FileInfoToDirEntry(info)) {
+			result.Skipped++
+			continue
+		}
+
+		id, err := saveFileToDatabase(name, path, fileOrigin{Source: sourceScan, OriginalName: name})
+		if err != nil {
+			result.Failures = append(result.Failures, name+": "+err.Error())
+			continue
+		}
+		hashNewImage(ctx, id, path, name)
+		known[name] = true
+		result.Imported++
+
+		if !thumbnails {
+			continue
+		}
+		switch {
+		case isVideoFile(name):
+			uploadVideoThumbnails(path)
+		case isThumbnailImage(name):
+			if err := generateImageThumbnail(path, config.UploadDir, name); err != nil {
+				result.Failures = append(result.Failures, name+": imported, but "+err.Error())
+			}
+		}
+	}
+	missingThumbnailsReport.Invalidate()
+	return result, nil
+}
+
+// handleImportOrphans imports the orphaned files ticked on the orphans
+// report and returns to it
+func handleImportOrphans(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		renderError(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	names := r.Form["file"]
+	if len(names) == 0 {
+		http.Redirect(w, r, "/admin/orphans?error="+url.QueryEscape("No files selected"), http.StatusSeeOther)
+		return
+	}
+
+	result, err := importOrphans(r.Context(), names, r.FormValue("thumbnails") == "on")
+	if err != nil {
+		http.Redirect(w, r, "/admin/orphans?error="+url.QueryEscape("Failed to import files: "+err.Error()), http.StatusSeeOther)
+		return
+	}
+	audit(r, "upload", "", fmt.Sprintf("imported %d orphaned files", result.Imported))
+
+	query := url.Values{}
+	query.Set("success", fmt.Sprintf("Imported %d files, skipped %d", result.Imported, result.Skipped))
+	if len(result.Failures) > 0 {
+		query.Set("error", strings.Join(result.Failures, "; "))
+	}
+	http.Redirect(w, r, "/admin/orphans?"+query.Encode(), http.StatusSeeOther)
+}
+
+// scanUploadsHandler starts the scan job and shows its progress on the jobs page
+func scanUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/admin/orphans", http.StatusSeeOther)
+		return
+	}
+	startJob("scan_uploads", scanUploads)
+	http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sidecar files carry tags for a media file exported by another tool. A
+// sidecar has the media file's name with its extension replaced or extended
+// by .txt or .json, so photo.jpg can use photo.txt, photo.json, photo.jpg.txt
+// or photo.jpg.json.
+//
+// Text sidecars hold one "category:value" per line. Blank lines and lines
+// starting with # are ignored. JSON sidecars are an object mapping each
+// category to a value or a list of values:
+//
+//	{"artist": "Someone", "genre": ["jazz", "live"]}
+
+// SidecarTag is a single tag read from a sidecar file
+type SidecarTag struct {
+	Category string
+	Value    string
+}
+
+// sidecarNames returns the file names a sidecar for filename may have, in order of preference
+func sidecarNames(filename string) []string {
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	return []string{base + ".txt", base + ".json", filename + ".txt", filename + ".json"}
+}
+
+func isSidecarExt(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".txt" || ext == ".json"
+}
+
+// findSidecar returns the path of the sidecar next to a media file, or "" if there is none
+func findSidecar(mediaPath string) string {
+	dir := filepath.Dir(mediaPath)
+	for _, name := range sidecarNames(filepath.Base(mediaPath)) {
+		path := filepath.Join(dir, name)
+		if path == mediaPath {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// parseSidecar reads the tags from sidecar data, using name to tell the format apart
+func parseSidecar(name string, data []byte) ([]SidecarTag, error) {
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		return parseSidecarJSON(data)
+	}
+
+	var tags []SidecarTag
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("line %d: expected category:value", lineNum)
+		}
+		tags = append(tags, SidecarTag{Category: strings.TrimSpace(parts[0]), Value: strings.TrimSpace(parts[1])})
+	}
+	return tags, scanner.Err()
+}
+
+func parseSidecarJSON(data []byte) ([]SidecarTag, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	var tags []SidecarTag
+	for category, rawValue := range raw {
+		category = strings.TrimSpace(category)
+		if category == "" {
+			return nil, fmt.Errorf("empty category name")
+		}
+
+		var values []string
+		var single string
+		if err := json.Unmarshal(rawValue, &single); err == nil {
+			values = []string{single}
+		} else if err := json.Unmarshal(rawValue, &values); err != nil {
+			return nil, fmt.Errorf("%s: value must be a string or a list of strings", category)
+		}
+
+		for _, v := range values {
+			if v = strings.TrimSpace(v); v != "" {
+				tags = append(tags, SidecarTag{Category: category, Value: v})
+			}
+		}
+	}
+	return tags, nil
+}
+
+// splitSidecarUploads separates uploaded sidecars from the media files they
+// belong to. A .txt or .json upload only counts as a sidecar when a file it
+// describes is part of the same upload.
+func splitSidecarUploads(files []*multipart.FileHeader) ([]*multipart.FileHeader, map[string]*multipart.FileHeader) {
+	uploaded := make(map[string]*multipart.FileHeader)
+	for _, fh := range files {
+		uploaded[fh.Filename] = fh
+	}
+
+	sidecars := make(map[string]*multipart.FileHeader)
+	for _, fh := range files {
+		if isSidecarExt(fh.Filename) {
+			continue
+		}
+		for _, name := range sidecarNames(fh.Filename) {
+			if sidecar, ok := uploaded[name]; ok {
+				sidecars[name] = sidecar
+			}
+		}
+	}
+
+	var media []*multipart.FileHeader
+	for _, fh := range files {
+		if _, ok := sidecars[fh.Filename]; !ok {
+			media = append(media, fh)
+		}
+	}
+	return media, sidecars
+}
+
+// uploadedSidecarTags reads the tags from the uploaded sidecar for filename, if there is one
+func uploadedSidecarTags(sidecars map[string]*multipart.FileHeader, filename string) ([]SidecarTag, error) {
+	for _, name := range sidecarNames(filename) {
+		fh, ok := sidecars[name]
+		if !ok {
+			continue
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		return parseSidecar(name, data)
+	}
+	return nil, nil
+}
+
+// applySidecarTags adds the given tags to a file, creating categories and tags as needed
+func applySidecarTags(ctx context.Context, fileID int64, tags []SidecarTag) error {
+	for _, t := range tags {
+		_, tagID, err := getOrCreateCategoryAndTag(ctx, t.Category, t.Value)
+		if err != nil {
+			return fmt.Errorf("failed to create tag %s:%s: %v", t.Category, t.Value, err)
+		}
+		if _, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO file_tags(file_id, tag_id) VALUES (?, ?)", fileID, tagID); err != nil {
+			return fmt.Errorf("failed to add tag %s:%s: %v", t.Category, t.Value, err)
+		}
+	}
+	if len(tags) > 0 {
+		invalidateCaches()
+	}
+	return nil
+}
+
+// importSidecars applies the sidecar next to every file in the database,
+// returning the number of sidecars applied and any per-file failures
+func importSidecars(ctx context.Context) (int, []string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, filename, path FROM files ORDER BY id")
+	if err != nil {
+		return 0, nil, err
+	}
+	var files []File
+	for rows.Next() {
+		var f File
+		if err := rows.Scan(&f.ID, &f.Filename, &f.Path); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	applied := 0
+	var failures []string
+	for _, f := range files {
+		sidecar := findSidecar(f.Path)
+		if sidecar == "" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(sidecar)
+		if err == nil {
+			var tags []SidecarTag
+			if tags, err = parseSidecar(sidecar, data); err == nil {
+				err = applySidecarTags(ctx, int64(f.ID), tags)
+			}
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", filepath.Base(sidecar), err))
+			continue
+		}
+		applied++
+	}
+
+	return applied, failures, nil
+}
+
+func handleImportSidecars(w http.ResponseWriter, r *http.Request) {
+	applied, failures, err := importSidecars(r.Context())
+
+	adminData := AdminData{
+		Config: config,
+		Error:  errorString(err),
+	}
+	if err == nil {
+		adminData.Success = fmt.Sprintf("Applied tags from %d sidecar files", applied)
+		if len(failures) > 0 {
+			adminData.Error = "Failed to import: " + strings.Join(failures, "; ")
+		}
+	}
+
+	renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+}
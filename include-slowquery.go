@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// slow_query_ms logs every database query that takes longer than that many
+// milliseconds, with the function that ran it, to help find missing indexes
+// and expensive tag filters. 0 turns it off. The database is opened through
+// a thin wrapper around the SQLite driver that times each statement, and a
+// query's time covers stepping through its rows, which is where SQLite does
+// most of the work, but not what the caller does between rows. When it is
+// off statements go straight to the driver, and the time is only taken
+// once a statement starts.
+
+// timedDriverName is the driver the database is opened with
+const timedDriverName = "sqlite3_timed"
+
+// slowQueryMaxLength caps how much of a query's text is logged
+const slowQueryMaxLength = 300
+
+func init() {
+	sql.Register(timedDriverName, timedDriver{})
+}
+
+// slowQueryThreshold is how long a query may take before it is logged, or 0
+func slowQueryThreshold() time.Duration {
+	return time.Duration(config.SlowQueryMs) * time.Millisecond
+}
+
+// logSlowQuery logs a query that took at least threshold
+func logSlowQuery(query string, elapsed, threshold time.Duration) {
+	if elapsed < threshold {
+		return
+	}
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > slowQueryMaxLength {
+		query = query[:slowQueryMaxLength] + "..."
+	}
+	log.Printf("Slow query (%v) in %s: %s", elapsed.Round(time.Millisecond), slowQueryCaller(), query)
+}
+
+// slowQueryCaller names the first function outside database/sql, the
+// driver and this wrapper, with its file and line
+func slowQueryCaller() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		name := frame.Function
+		if !strings.HasPrefix(name, "database/sql") && !strings.HasPrefix(name, "github.com/mattn/go-sqlite3") &&
+			!strings.HasPrefix(name, "main.timed") && !strings.HasPrefix(name, "main.(*timed") && !strings.HasPrefix(name, "main.logSlowQuery") {
+			return fmt.Sprintf("%s (%s:%d)", strings.TrimPrefix(name, "main."), filepath.Base(frame.File), frame.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// timedDriver opens SQLite connections that time their statements
+type timedDriver struct{}
+
+func (timedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+// timedConn passes everything to the SQLite connection, timing queries and
+// statements that are executed
+type timedConn struct {
+	conn *sqlite3.SQLiteConn
+}
+
+func (c *timedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.conn.Prepare(query)
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.conn.PrepareContext(ctx, query)
+}
+
+func (c *timedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *timedConn) Begin() (driver.Tx, error) {
+	return c.conn.Begin()
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.conn.BeginTx(ctx, opts)
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	return c.conn.Ping(ctx)
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	threshold := slowQueryThreshold()
+	if threshold <= 0 {
+		return c.conn.ExecContext(ctx, query, args)
+	}
+	start := time.Now()
+	res, err := c.conn.ExecContext(ctx, query, args)
+	logSlowQuery(query, time.Since(start), threshold)
+	return res, err
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	threshold := slowQueryThreshold()
+	if threshold <= 0 {
+		return c.conn.QueryContext(ctx, query, args)
+	}
+	start := time.Now()
+	rows, err := c.conn.QueryContext(ctx, query, args)
+	elapsed := time.Since(start)
+	if err != nil {
+		logSlowQuery(query, elapsed, threshold)
+		return nil, err
+	}
+	return &timedRows{Rows: rows, query: query, elapsed: elapsed, threshold: threshold}, nil
+}
+
+// timedRows adds up the time spent fetching rows and logs the query when
+// the rows are closed
+type timedRows struct {
+	driver.Rows
+	query     string
+	elapsed   time.Duration
+	threshold time.Duration
+	logged    bool
+}
+
+func (r *timedRows) Next(dest []driver.Value) error {
+	start := time.Now()
+	err := r.Rows.Next(dest)
+	r.elapsed += time.Since(start)
+	return err
+}
+
+func (r *timedRows) Close() error {
+	if !r.logged {
+		r.logged = true
+		logSlowQuery(r.query, r.elapsed, r.threshold)
+	}
+	return r.Rows.Close()
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Files downloaded from a URL or with yt-dlp remember where they came from in
+// files.source_url, so they can be revisited or downloaded again. The URL can
+// also be set or cleared by hand on the file page.
+
+// maxSourceURLLength is the longest source URL a file can have
+const maxSourceURLLength = 2048
+
+// validateSourceURL accepts an empty URL, which clears it, or an absolute
+// http or https URL
+func validateSourceURL(sourceURL string) error {
+	if sourceURL == "" {
+		return nil
+	}
+	if len(sourceURL) > maxSourceURLLength {
+		return fmt.Errorf("source URL must be at most %d characters", maxSourceURLLength)
+	}
+	u, err := url.ParseRequestURI(sourceURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("source URL must be an http or https URL")
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Sprite sheets are a horizontal strip of evenly spaced video frames
+const (
+	spriteFrameCount = 10
+	spriteFrameWidth = 160
+)
+
+// SpriteInfo describes a video's preview sprite sheet for hover scrubbing
+type SpriteInfo struct {
+	URL         string
+	Frames      int
+	FrameWidth  int
+	FrameHeight int
+}
+
+func spritePath(uploadDir, filename string) string {
+	return filepath.Join(uploadDir, "thumbnails", filename+".sprite.jpg")
+}
+
+// getVideoDuration returns the length of a video in seconds
+func getVideoDuration(videoPath string) (float64, error) {
+	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration",
+		"-of", "default=nokey=1:noprint_wrappers=1", videoPath)
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to probe duration: %v", err)
+	}
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse duration: %v", err)
+	}
+	return duration, nil
+}
+
+// extractVideoFrame decodes a single frame at the given offset in seconds
+func extractVideoFrame(videoPath string, seconds float64) (image.Image, error) {
+	cmd := exec.Command("ffmpeg", "-v", "error", "-ss", strconv.FormatFloat(seconds, 'f', 2, 64), "-i", videoPath,
+		"-vframes", "1", "-vf", fmt.Sprintf("scale=%d:-1", spriteFrameWidth), "-f", "image2pipe", "-vcodec", "mjpeg", "-")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract frame at %.2fs: %v", seconds, err)
+	}
+	return jpeg.Decode(bytes.NewReader(out))
+}
+
+// generateVideoSprite extracts evenly spaced frames from a video and saves
+// them side by side as a single JPEG next to the thumbnail
+func generateVideoSprite(videoPath, uploadDir, filename string) error {
+	thumbDir := filepath.Join(uploadDir, "thumbnails")
+	if err := os.MkdirAll(thumbDir, 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnails directory: %v", err)
+	}
+
+	hash := thumbnailHash(videoPath)
+	if linkSharedThumbnail(hash, spritePath(uploadDir, filename), ".sprite.jpg") {
+		return nil
+	}
+
+	duration, err := getVideoDuration(videoPath)
+	if err != nil {
+		return err
+	}
+
+	var frames []image.Image
+	for i := 0; i < spriteFrameCount; i++ {
+		seconds := duration * (float64(i) + 0.5) / spriteFrameCount
+		frame, err := extractVideoFrame(videoPath, seconds)
+		if err != nil {
+			return err
+		}
+		frames = append(frames, frame)
+	}
+
+	strip := createStrip(frames, spriteFrameWidth)
+
+	unshareThumbnail(spritePath(uploadDir, filename))
+	outFile, err := os.Create(spritePath(uploadDir, filename))
+	if err != nil {
+		return fmt.Errorf("failed to create sprite file: %v", err)
+	}
+	defer outFile.Close()
+
+	if err := jpeg.Encode(outFile, strip, &jpeg.Options{Quality: 80}); err != nil {
+		return fmt.Errorf("failed to encode JPEG: %v", err)
+	}
+
+	shareThumbnail(hash, spritePath(uploadDir, filename), ".sprite.jpg")
+	return nil
+}
+
+// createStrip lays images out left to right in equally sized cells,
+// with the cell height taken from the first image's aspect ratio
+func createStrip(images []image.Image, frameWidth int) image.Image {
+	if len(images) == 0 {
+		return image.NewRGBA(image.Rect(0, 0, 0, 0))
+	}
+
+	first := images[0].Bounds()
+	frameHeight := frameWidth * first.Dy() / first.Dx()
+
+	strip := image.NewRGBA(image.Rect(0, 0, frameWidth*len(images), frameHeight))
+	for i, img := range images {
+		resized := resizeImage(img, frameWidth, frameHeight)
+		drawImage(strip, resized, i*frameWidth, 0)
+	}
+
+	return strip
+}
+
+// getSpriteInfo returns the sprite sheet details for a file, or nil if none has been generated
+func getSpriteInfo(uploadDir, filename string) *SpriteInfo {
+	f, err := os.Open(spritePath(uploadDir, filename))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	cfg, err := jpeg.DecodeConfig(f)
+	if err != nil || cfg.Width < spriteFrameWidth {
+		return nil
+	}
+
+	return &SpriteInfo{
+		URL:         "/uploads/thumbnails/" + url.PathEscape(filename) + ".sprite.jpg",
+		Frames:      cfg.Width / spriteFrameWidth,
+		FrameWidth:  spriteFrameWidth,
+		FrameHeight: cfg.Height,
+	}
+}
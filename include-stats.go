@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// /api/stats/library returns library wide totals for monitoring dashboards.
+// It is built from a handful of aggregate queries and reused for
+// reportCacheTTL. Private files are only counted for logged in callers, so
+// there is one cached copy with them and one without.
+
+// LibraryStats is the response of /api/stats/library
+type LibraryStats struct {
+	Files            int             `json:"files"`
+	Tagged           int             `json:"tagged"`
+	Untagged         int             `json:"untagged"`
+	Archived         int             `json:"archived"`
+	Categories       int             `json:"categories"`
+	Tags             int             `json:"tags"`
+	TotalBytes       int64           `json:"total_bytes"`
+	FilesWithoutSize int             `json:"files_without_size"`
+	MediaTypes       map[string]int  `json:"media_types"`
+	CategoryFiles    []CategoryCount `json:"category_files"`
+	Generated        time.Time       `json:"generated"`
+}
+
+// CategoryCount is how many files have at least one tag in a category
+type CategoryCount struct {
+	Category string `json:"category"`
+	Files    int    `json:"files"`
+}
+
+var (
+	publicStatsReport = &reportCache[LibraryStats]{build: func() (LibraryStats, error) {
+		return getLibraryStats(context.Background())
+	}}
+	allStatsReport = &reportCache[LibraryStats]{build: func() (LibraryStats, error) {
+		return getLibraryStats(context.WithValue(context.Background(), visibilityKey{}, true))
+	}}
+)
+
+func init() {
+	registerCache("public library stats", publicStatsReport)
+	registerCache("library stats", allStatsReport)
+}
+
+// mediaTypeOf groups a file as video, image, audio, text or other by its extension
+func mediaTypeOf(filename string) string {
+	if isVideoFile(filename) {
+		return "video"
+	}
+	mediaType := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))
+	switch kind, _, _ := strings.Cut(mediaType, "/"); kind {
+	case "image", "video", "audio", "text":
+		return kind
+	}
+	return "other"
+}
+
+func getLibraryStats(ctx context.Context) (LibraryStats, error) {
+	stats := LibraryStats{MediaTypes: map[string]int{}, CategoryFiles: []CategoryCount{}, Generated: time.Now()}
+	filter := privateFilter(ctx)
+
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*),
+		       COALESCE(SUM(EXISTS (SELECT 1 FROM file_tags ft WHERE ft.file_id = f.id)), 0),
+		       COALESCE(SUM(COALESCE(f.archived, 0)), 0),
+		       COALESCE(SUM(f.size), 0),
+		       COALESCE(SUM(f.size IS NULL), 0)
+		FROM files f WHERE 1=1`+filter).
+		Scan(&stats.Files, &stats.Tagged, &stats.Archived, &stats.TotalBytes, &stats.FilesWithoutSize)
+	if err != nil {
+		return stats, err
+	}
+	stats.Untagged = stats.Files - stats.Tagged
+
+	if err := db.QueryRowContext(ctx, "SELECT (SELECT COUNT(*) FROM categories), (SELECT COUNT(*) FROM tags)").
+		Scan(&stats.Categories, &stats.Tags); err != nil {
+		return stats, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT f.filename FROM files f WHERE 1=1"+filter)
+	if err != nil {
+		return stats, err
+	}
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			rows.Close()
+			return stats, err
+		}
+		stats.MediaTypes[mediaTypeOf(filename)]++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT c.name, COUNT(DISTINCT ft.file_id) AS n
+		FROM categories c
+		JOIN tags t ON t.category_id = c.id
+		JOIN file_tags ft ON ft.tag_id = t.id
+		JOIN files f ON f.id = ft.file_id
+		WHERE 1=1`+filter+`
+		GROUP BY c.id
+		ORDER BY n DESC, c.name`)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c CategoryCount
+		if err := rows.Scan(&c.Category, &c.Files); err != nil {
+			return stats, err
+		}
+		stats.CategoryFiles = append(stats.CategoryFiles, c)
+	}
+	return stats, rows.Err()
+}
+
+// apiLibraryStatsHandler serves /api/stats/library
+func apiLibraryStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	report := publicStatsReport
+	if showPrivate(r.Context()) {
+		report = allStatsReport
+	}
+	stats, err := report.get()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
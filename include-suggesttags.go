@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// GET /api/files/{id}/suggested-tags suggests tags for a file from the
+// files most like it, so they can be applied with one click through
+// POST /api/file/{id}/tags. A file is like it when its name shares words
+// with the file's name, each shared word counting twice, or when it is the
+// same type of media, counting once. Every tag of those files scores what
+// its files count, and the best scoring tags the file does not have yet
+// are returned, most likely first. ?limit= asks for more or fewer.
+//
+//	[{"category": "genre", "value": "jazz", "score": 5, "files": 3}, ...]
+
+const (
+	defaultTagSuggestions = 10
+	maxTagSuggestions     = 50
+	// maxSuggestionWords caps how many words of a filename are compared
+	maxSuggestionWords = 8
+)
+
+// TagSuggestion is a tag suggested for a file
+type TagSuggestion struct {
+	Category string `json:"category"`
+	Value    string `json:"value"`
+	Score    int    `json:"score"`
+	Files    int    `json:"files"`
+}
+
+// filenameWords splits a filename without its extension into lowercase
+// words, leaving out repeats, numbers and words too short to tell files
+// apart
+func filenameWords(filename string) []string {
+	name := strings.TrimSuffix(filename, filepath.Ext(filename))
+	fields := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]bool)
+	var words []string
+	for _, word := range fields {
+		if len([]rune(word)) < 3 || seen[word] {
+			continue
+		}
+		if _, err := strconv.Atoi(word); err == nil {
+			continue
+		}
+		seen[word] = true
+		words = append(words, word)
+		if len(words) == maxSuggestionWords {
+			break
+		}
+	}
+	return words
+}
+
+// apiSuggestedTagsHandler serves GET /api/files/{id}/suggested-tags
+func apiSuggestedTagsHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	limit := defaultTagSuggestions
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxTagSuggestions {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxTagSuggestions))
+			return
+		}
+		limit = n
+	}
+
+	ctx := r.Context()
+	var filename string
+	var private bool
+	if err := db.QueryRowContext(ctx, "SELECT filename, COALESCE(private, 0) FROM files WHERE id=?", id).Scan(&filename, &private); err != nil || (private && !showPrivate(ctx)) {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	// Words are letters and digits only, so they hold no LIKE wildcards
+	var weights []string
+	var args []interface{}
+	for _, word := range filenameWords(filename) {
+		weights = append(weights, "CASE WHEN LOWER(f.filename) LIKE ? THEN 2 ELSE 0 END")
+		args = append(args, "%"+word+"%")
+	}
+	extensions := mediaTypeExtensions(mediaType(filename))
+	if extensions == nil {
+		if ext := filepath.Ext(filename); ext != "" {
+			extensions = []string{ext}
+		}
+	}
+	if len(extensions) > 0 {
+		matches := make([]string, len(extensions))
+		for i, ext := range extensions {
+			matches[i] = "LOWER(f.filename) LIKE ?"
+			args = append(args, "%"+strings.ToLower(ext))
+		}
+		weights = append(weights, "CASE WHEN "+strings.Join(matches, " OR ")+" THEN 1 ELSE 0 END")
+	}
+	suggestions := []TagSuggestion{}
+	if len(weights) == 0 {
+		writeJSON(w, http.StatusOK, suggestions)
+		return
+	}
+	args = append(args, id, id, limit)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.name, t.value, SUM(similar.weight) AS score, COUNT(*) AS files
+		FROM (
+			SELECT f.id, `+strings.Join(weights, " + ")+` AS weight
+			FROM files f
+			WHERE f.id != ?`+privateFilter(ctx)+`
+		) similar
+		JOIN file_tags ft ON ft.file_id = similar.id
+		JOIN tags t ON t.id = ft.tag_id
+		JOIN categories c ON c.id = t.category_id
+		WHERE similar.weight > 0
+		AND NOT EXISTS (SELECT 1 FROM file_tags own WHERE own.file_id = ? AND own.tag_id = t.id)
+		GROUP BY t.id
+		ORDER BY score DESC, files DESC, c.name, t.value
+		LIMIT ?`, args...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s TagSuggestion
+		if err := rows.Scan(&s.Category, &s.Value, &s.Score, &s.Files); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		suggestions = append(suggestions, s)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, suggestions)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// A tag export is a JSON list with one entry per tagged file, giving its
+// filename, the SHA-256 of its contents and its tags. Importing matches each
+// entry to a file by filename, or by hash so that tags survive a file being
+// renamed on one side. Entries without a hash, or files whose contents cannot
+// be read to hash, fall back to matching by filename.
+//
+//	[{"filename": "a.jpg", "hash": "9f86d0...", "tags": [{"category": "artist", "value": "Someone"}]}]
+
+// TagExportEntry is one file in a tag export
+type TagExportEntry struct {
+	Filename  string    `json:"filename"`
+	Hash      string    `json:"hash,omitempty"`
+	SourceURL string    `json:"source_url,omitempty"`
+	Tags      []TagPair `json:"tags"`
+}
+
+// TagImportResult records how one entry of a tag import was matched
+type TagImportResult struct {
+	Filename string
+	FileID   int
+	Method   string
+	Tags     int
+	Error    string
+}
+
+// fileHash returns the hex SHA-256 of a file's contents
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// getFileHashes returns every file the request may see with its stored
+// hash, hashing and storing any file that has none yet. Files that cannot
+// be read are left without a hash.
+func getFileHashes(ctx context.Context) ([]File, map[int]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT f.id, f.filename, f.path, COALESCE(f.hash, ''), COALESCE(f.source_url, '') FROM files f WHERE 1=1"+privateFilter(ctx)+" ORDER BY f.id")
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []File
+	hashes := make(map[int]string)
+	for rows.Next() {
+		var f File
+		var hash string
+		if err := rows.Scan(&f.ID, &f.Filename, &f.Path, &hash, &f.SourceURL); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		files = append(files, f)
+		hashes[f.ID] = hash
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for _, f := range files {
+		if hashes[f.ID] != "" {
+			continue
+		}
+		hash, err := fileHash(f.Path)
+		if err != nil {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, "UPDATE files SET hash=? WHERE id=?", hash, f.ID); err != nil {
+			return nil, nil, fmt.Errorf("failed to store hash for %s: %v", f.Filename, err)
+		}
+		hashes[f.ID] = hash
+	}
+
+	return files, hashes, nil
+}
+
+// exportTagsJSON lists every tagged file the request may see with its
+// hash and tags
+func exportTagsJSON(ctx context.Context) ([]TagExportEntry, error) {
+	files, hashes, err := getFileHashes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []TagExportEntry{}
+	for _, f := range files {
+		rows, err := db.QueryContext(ctx, `
+			SELECT c.name, t.value
+			FROM file_tags ft
+			JOIN tags t ON t.id = ft.tag_id
+			JOIN categories c ON c.id = t.category_id
+			WHERE ft.file_id = ?
+			ORDER BY c.name, `+fileTagOrder, f.ID)
+		if err != nil {
+			return nil, err
+		}
+		entry := TagExportEntry{Filename: f.Filename, Hash: hashes[f.ID], SourceURL: f.SourceURL}
+		for rows.Next() {
+			var t TagPair
+			if err := rows.Scan(&t.Category, &t.Value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			entry.Tags = append(entry.Tags, t)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if len(entry.Tags) > 0 || entry.SourceURL != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// importTagsJSON adds the tags in a tag export to the matching files. With
+// byHash set an entry is matched by its hash, falling back to its filename
+// when the entry or the file of that name has no hash. A matched file
+// without a source URL takes the entry's.
+func importTagsJSON(ctx context.Context, entries []TagExportEntry, byHash bool) ([]TagImportResult, error) {
+	files, hashes, err := getFileHashes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]int)
+	byHashes := make(map[string]int)
+	sourceURLs := make(map[int]string)
+	for _, f := range files {
+		byName[f.Filename] = f.ID
+		sourceURLs[f.ID] = f.SourceURL
+		if hash := hashes[f.ID]; hash != "" {
+			if _, ok := byHashes[hash]; !ok {
+				byHashes[hash] = f.ID
+			}
+		}
+	}
+
+	var results []TagImportResult
+	for _, entry := range entries {
+		result := TagImportResult{Filename: entry.Filename}
+
+		nameID, nameOK := byName[entry.Filename]
+		switch {
+		case byHash && entry.Hash != "" && byHashes[entry.Hash] != 0:
+			result.FileID, result.Method = byHashes[entry.Hash], "hash"
+		case byHash && entry.Hash != "" && (!nameOK || hashes[nameID] != ""):
+			result.Error = "no file with this hash"
+		case nameOK:
+			result.FileID, result.Method = nameID, "filename"
+		default:
+			result.Error = "no file with this name"
+		}
+
+		if result.FileID != 0 {
+			tags := make([]SidecarTag, 0, len(entry.Tags))
+			for _, t := range entry.Tags {
+				if t.Category != "" && t.Value != "" {
+					tags = append(tags, SidecarTag{Category: t.Category, Value: t.Value})
+				}
+			}
+			if err := applySidecarTags(ctx, int64(result.FileID), tags); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Tags = len(tags)
+			}
+
+			if result.Error == "" && sourceURLs[result.FileID] == "" && entry.SourceURL != "" && validateSourceURL(entry.SourceURL) == nil {
+				if _, err := db.ExecContext(ctx, "UPDATE files SET source_url=? WHERE id=?", entry.SourceURL, result.FileID); err != nil {
+					result.Error = fmt.Sprintf("failed to set source URL: %v", err)
+				}
+				sourceURLs[result.FileID] = entry.SourceURL
+			}
+		}
+
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func handleExportTagsJSON(w http.ResponseWriter, r *http.Request) {
+	entries, err := exportTagsJSON(r.Context())
+	if err != nil {
+		renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", AdminData{
+			Config: config,
+			Error:  "Failed to export tags: " + err.Error(),
+		}))
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="tags-%s.json"`, time.Now().Format("20060102-150405")))
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func handleImportTagsJSON(w http.ResponseWriter, r *http.Request) {
+	adminData := AdminData{
+		Config: config,
+	}
+
+	results, err := func() ([]TagImportResult, error) {
+		file, _, err := r.FormFile("tags_file")
+		if err != nil {
+			return nil, fmt.Errorf("no tag export file uploaded")
+		}
+		defer file.Close()
+
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		var entries []TagExportEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("invalid tag export: %v", err)
+		}
+		return importTagsJSON(r.Context(), entries, r.FormValue("match") == "hash")
+	}()
+
+	if err != nil {
+		adminData.Error = "Failed to import tags: " + err.Error()
+	} else {
+		matched := 0
+		for _, result := range results {
+			if result.Error == "" {
+				matched++
+			}
+		}
+		adminData.Success = fmt.Sprintf("Imported tags for %d of %d entries", matched, len(results))
+		adminData.TagImportResults = results
+	}
+
+	renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+}
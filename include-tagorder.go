@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Tags within a category are shown in the order they were added unless the
+// file has been given an explicit order through file_tags.position. Tags
+// added after a category was reordered have no position and go at the end.
+const fileTagOrder = "(ft.position IS NULL), ft.position, ft.rowid"
+
+// moveFileTag moves one of a file's tags up (delta -1) or down (delta 1)
+// within its category, saving the resulting order for the whole category
+func moveFileTag(ctx context.Context, fileID, category, value string, delta int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT t.id, t.value
+		FROM file_tags ft
+		JOIN tags t ON t.id = ft.tag_id
+		JOIN categories c ON c.id = t.category_id
+		WHERE ft.file_id = ? AND c.name = ?
+		ORDER BY `+fileTagOrder, fileID, category)
+	if err != nil {
+		return err
+	}
+
+	var tagIDs []int
+	index := -1
+	for rows.Next() {
+		var id int
+		var v string
+		if err := rows.Scan(&id, &v); err != nil {
+			rows.Close()
+			return err
+		}
+		if v == value {
+			index = len(tagIDs)
+		}
+		tagIDs = append(tagIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if index == -1 {
+		return fmt.Errorf("file does not have the tag %s:%s", category, value)
+	}
+	target := index + delta
+	if target < 0 || target >= len(tagIDs) {
+		return nil
+	}
+	tagIDs[index], tagIDs[target] = tagIDs[target], tagIDs[index]
+
+	for position, id := range tagIDs {
+		if _, err := tx.ExecContext(ctx, "UPDATE file_tags SET position=? WHERE file_id=? AND tag_id=?", position, fileID, id); err != nil {
+			return fmt.Errorf("failed to save tag order: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save tag order: %v", err)
+	}
+	invalidateCaches()
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// GET /api/tags/suggest?category=colour&q=bl completes a tag value as it is
+// typed, returning the values of the category that contain q, most used
+// first. Only files the request can see are counted, so a value used only
+// on private files is not offered without logging in.
+//
+//	[{"value": "blue", "count": 12}, {"value": "black", "count": 3}]
+
+// maxTagValueSuggestions caps how many values are returned
+const maxTagValueSuggestions = 10
+
+// TagValueSuggestion is an existing value offered for a category
+type TagValueSuggestion struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// apiTagSuggestHandler serves GET /api/tags/suggest
+func apiTagSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	category := strings.TrimSpace(r.URL.Query().Get("category"))
+	if category == "" {
+		writeJSONError(w, http.StatusBadRequest, "category is required")
+		return
+	}
+	q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	q = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q)
+
+	ctx := r.Context()
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.value, COUNT(ft.file_id)
+		FROM tags t
+		JOIN categories c ON c.id = t.category_id
+		JOIN file_tags ft ON ft.tag_id = t.id
+		JOIN files f ON f.id = ft.file_id
+		WHERE c.name = ? AND LOWER(t.value) LIKE ? ESCAPE '\'`+privateFilter(ctx)+`
+		GROUP BY t.id
+		ORDER BY COUNT(ft.file_id) DESC, t.value
+		LIMIT ?`, category, "%"+q+"%", maxTagValueSuggestions)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	suggestions := []TagValueSuggestion{}
+	for rows.Next() {
+		var s TagValueSuggestion
+		if err := rows.Scan(&s.Value, &s.Count); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		suggestions = append(suggestions, s)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, suggestions)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// POST /api/files/{id}/tags/toggle adds a tag to a file when it is missing
+// and removes it when it is there, in one transaction, so two clicks on a
+// tag chip cannot race each other into the wrong state. It responds with
+// whether the file has the tag afterwards.
+//
+//	{"category": "colour", "value": "blue"} -> {"present": true}
+
+// TagToggleRequest is the body of POST /api/files/{id}/tags/toggle
+type TagToggleRequest struct {
+	Category string `json:"category"`
+	Value    string `json:"value"`
+}
+
+// TagToggleResponse is the tag's state on the file after a toggle
+type TagToggleResponse struct {
+	Category string `json:"category"`
+	Value    string `json:"value"`
+	Present  bool   `json:"present"`
+}
+
+// toggleFileTag removes a tag from a file if it has it and adds it
+// otherwise, creating the category and tag as needed. It returns whether
+// the file has the tag afterwards.
+func toggleFileTag(ctx context.Context, fileID int, category, value string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var catID int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM categories WHERE name=?", category).Scan(&catID)
+	if err == sql.ErrNoRows {
+		res, err := tx.ExecContext(ctx, "INSERT INTO categories(name) VALUES(?)", category)
+		if err != nil {
+			return false, fmt.Errorf("failed to create category: %v", err)
+		}
+		cid, _ := res.LastInsertId()
+		catID = int(cid)
+	} else if err != nil {
+		return false, fmt.Errorf("failed to query category: %v", err)
+	}
+
+	var tagID int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE category_id=? AND value=?", catID, value).Scan(&tagID)
+	if err == sql.ErrNoRows {
+		res, err := tx.ExecContext(ctx, "INSERT INTO tags(category_id, value) VALUES(?, ?)", catID, value)
+		if err != nil {
+			return false, fmt.Errorf("failed to create tag: %v", err)
+		}
+		tid, _ := res.LastInsertId()
+		tagID = int(tid)
+	} else if err != nil {
+		return false, fmt.Errorf("failed to query tag: %v", err)
+	}
+
+	// Deleting first takes the write lock, so the check and the flip
+	// cannot interleave with another toggle
+	res, err := tx.ExecContext(ctx, "DELETE FROM file_tags WHERE file_id=? AND tag_id=?", fileID, tagID)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove tag: %v", err)
+	}
+	present := false
+	if n, _ := res.RowsAffected(); n > 0 {
+		if err := autoPruneUnusedTags(ctx, tx); err != nil {
+			return false, err
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO file_tags(file_id, tag_id) VALUES (?, ?)", fileID, tagID); err != nil {
+			return false, fmt.Errorf("failed to add tag: %v", err)
+		}
+		present = true
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return present, nil
+}
+
+// apiTagToggleHandler serves POST /api/files/{id}/tags/toggle
+func apiTagToggleHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req TagToggleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	req.Category = strings.TrimSpace(req.Category)
+	req.Value = strings.TrimSpace(req.Value)
+	if req.Category == "" || req.Value == "" {
+		writeJSONError(w, http.StatusBadRequest, "category and value are required")
+		return
+	}
+
+	ctx := r.Context()
+	var private bool
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(private, 0) FROM files WHERE id=?", id).Scan(&private); err != nil || (private && !showPrivate(ctx)) {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	present, err := toggleFileTag(ctx, id, req.Category, req.Value)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	invalidateCaches()
+	if present {
+		audit(r, "tag-add", fileTarget(id), req.Category+":"+req.Value)
+	} else {
+		audit(r, "tag-remove", fileTarget(id), req.Category+":"+req.Value)
+	}
+
+	writeJSON(w, http.StatusOK, TagToggleResponse{Category: req.Category, Value: req.Value, Present: present})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// thumbnail_dedup lets files with the same content share one thumbnail and
+// preview sprite on disk. The shared copy is kept under thumbnails/shared,
+// named after the content hash, and each file's usual thumbnail path is a
+// hard link to it, so serving, renaming and lookups by filename work as
+// before. A file whose content already has a thumbnail is linked to it
+// instead of having one generated. The file is hashed when its thumbnail is
+// made, as a replaced file keeps its old hash until it has been stored.
+//
+// Generating a thumbnail first drops the file's own link, so choosing a new
+// frame or replacing a file never changes the thumbnail of its duplicates.
+// A shared copy is removed once no file with its hash is left. Where hard
+// links are not supported each file keeps a copy of its own, as it does
+// with the option off.
+
+// sharedThumbnailDir is where shared thumbnails are kept
+func sharedThumbnailDir() string {
+	return filepath.Join(config.UploadDir, "thumbnails", "shared")
+}
+
+// sharedThumbnailPath is the shared copy for a content hash, with suffix
+// ".jpg" for the thumbnail or ".sprite.jpg" for the preview sprite
+func sharedThumbnailPath(hash, suffix string) string {
+	return filepath.Join(sharedThumbnailDir(), hash+suffix)
+}
+
+// thumbnailHash returns the content hash to share a file's thumbnail under,
+// or "" when thumbnails are not shared
+func thumbnailHash(srcPath string) string {
+	if !config.ThumbnailDedup {
+		return ""
+	}
+	hash, err := fileHash(srcPath)
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+// linkSharedThumbnail points thumbPath at the shared copy for hash,
+// reporting whether there was a usable one to link to
+func linkSharedThumbnail(hash, thumbPath, suffix string) bool {
+	if hash == "" {
+		return false
+	}
+	shared := sharedThumbnailPath(hash, suffix)
+	if _, err := decodeImageFile(shared); err != nil {
+		return false
+	}
+	if err := os.MkdirAll(filepath.Dir(thumbPath), 0755); err != nil {
+		return false
+	}
+	os.Remove(thumbPath)
+	if err := os.Link(shared, thumbPath); err != nil {
+		log.Printf("Warning: failed to link shared thumbnail %s: %v", filepath.Base(thumbPath), err)
+		return false
+	}
+	return true
+}
+
+// unshareThumbnail removes a thumbnail before it is written over, so a copy
+// it shares with other files is left as it is
+func unshareThumbnail(thumbPath string) {
+	if _, err := os.Stat(sharedThumbnailDir()); err == nil {
+		os.Remove(thumbPath)
+	}
+}
+
+// shareThumbnail makes a newly generated thumbnail the shared copy for hash
+func shareThumbnail(hash, thumbPath, suffix string) {
+	if hash == "" {
+		return
+	}
+	dir := sharedThumbnailDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Warning: failed to create shared thumbnails directory: %v", err)
+		return
+	}
+
+	// Link under a temporary name first so the shared copy is replaced in one step
+	tmp, err := os.CreateTemp(dir, hash+".*.tmp")
+	if err != nil {
+		log.Printf("Warning: failed to share thumbnail %s: %v", filepath.Base(thumbPath), err)
+		return
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	if err := os.Link(thumbPath, tmp.Name()); err != nil {
+		log.Printf("Warning: failed to share thumbnail %s: %v", filepath.Base(thumbPath), err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), sharedThumbnailPath(hash, suffix)); err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Warning: failed to share thumbnail %s: %v", filepath.Base(thumbPath), err)
+	}
+}
+
+// releaseSharedThumbnails removes the shared copies for hash once no file
+// has that content any more
+func releaseSharedThumbnails(ctx context.Context, hash string) {
+	if hash == "" {
+		return
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM files WHERE hash=?", hash).Scan(&n); err != nil || n > 0 {
+		return
+	}
+	for _, suffix := range []string{".jpg", ".sprite.jpg"} {
+		if err := os.Remove(sharedThumbnailPath(hash, suffix)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to remove shared thumbnail %s: %v", hash+suffix, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// thumbnail_mode chooses when a new video's thumbnail and preview sprite,
+// and its preview clip when hover_previews is on, are made. "upload" makes
+// them before the upload finishes. "background" queues them for a worker so
+// uploads return straight away. "lazy" makes the thumbnail when it is first
+// requested, which also covers CBZ files, and queues the rest at that
+// point. A full queue drops the file with a warning; its thumbnail can
+// still be made from the missing thumbnails page.
+
+// thumbnailModes are the accepted values of thumbnail_mode
+var thumbnailModes = map[string]bool{"upload": true, "background": true, "lazy": true}
+
+// thumbnailQueueSize is how many videos can wait for the background worker
+const thumbnailQueueSize = 1024
+
+// thumbnailTask is a video waiting for its thumbnail and sprite, or only
+// its sprite when the thumbnail was made on demand
+type thumbnailTask struct {
+	path       string
+	filename   string
+	spriteOnly bool
+}
+
+var thumbnailQueue = make(chan thumbnailTask, thumbnailQueueSize)
+
+// lazyThumbnailLocks holds a mutex per filename so a thumbnail requested
+// by several pages at once is only made once
+var lazyThumbnailLocks sync.Map
+
+// lazyThumbnailFailed remembers files whose thumbnail could not be made, so
+// a broken file is not retried on every page view until the next restart
+var lazyThumbnailFailed sync.Map
+
+// makeVideoThumbnails creates a video's thumbnail, unless spriteOnly is
+// set, its preview sprite and, when hover_previews is on, its preview clip
+func makeVideoThumbnails(path, filename string, spriteOnly bool) {
+	if !spriteOnly {
+		if err := generateThumbnail(path, config.UploadDir, filename); err != nil {
+			log.Printf("Warning: could not generate thumbnail: %v", err)
+		}
+	}
+	if err := generateVideoSprite(path, config.UploadDir, filename); err != nil {
+		log.Printf("Warning: could not generate preview sprite: %v", err)
+	}
+	if config.HoverPreviews {
+		if err := generateHoverPreview(path, config.UploadDir, filename); err != nil {
+			log.Printf("Warning: could not generate preview clip: %v", err)
+		}
+	}
+}
+
+// queueVideoThumbnails hands a video to the background worker
+func queueVideoThumbnails(path, filename string, spriteOnly bool) {
+	select {
+	case thumbnailQueue <- thumbnailTask{path: path, filename: filename, spriteOnly: spriteOnly}:
+	default:
+		log.Printf("Warning: thumbnail queue is full, not generating a thumbnail for %s", filename)
+	}
+}
+
+// runThumbnailQueue makes the thumbnails of queued videos one at a time
+func runThumbnailQueue() {
+	for task := range thumbnailQueue {
+		makeVideoThumbnails(task.path, task.filename, task.spriteOnly)
+		missingThumbnailsReport.Invalidate()
+	}
+}
+
+// uploadVideoThumbnails makes or defers the thumbnails of a newly stored
+// video according to thumbnail_mode
+func uploadVideoThumbnails(path string) {
+	filename := filepath.Base(path)
+	switch config.ThumbnailMode {
+	case "background":
+		queueVideoThumbnails(path, filename, false)
+	case "lazy":
+	default:
+		makeVideoThumbnails(path, filename, false)
+	}
+}
+
+// ensureLazyThumbnail makes the thumbnail asked for at /uploads/{name} when
+// thumbnail_mode is lazy and it does not exist yet
+func ensureLazyThumbnail(ctx context.Context, name string) {
+	if config.ThumbnailMode != "lazy" {
+		return
+	}
+	filename, ok := strings.CutPrefix(name, "/thumbnails/")
+	if !ok {
+		return
+	}
+	filename, ok = strings.CutSuffix(filename, ".jpg")
+	if !ok || strings.HasSuffix(filename, ".sprite") {
+		return
+	}
+	thumbPath := filepath.Join(config.UploadDir, "thumbnails", filename+".jpg")
+	if _, err := os.Stat(thumbPath); err == nil {
+		return
+	}
+	if _, failed := lazyThumbnailFailed.Load(filename); failed {
+		return
+	}
+
+	var path string
+	if err := db.QueryRowContext(ctx, "SELECT path FROM files WHERE filename=?", filename).Scan(&path); err != nil {
+		return
+	}
+
+	lock, _ := lazyThumbnailLocks.LoadOrStore(filename, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	if _, err := os.Stat(thumbPath); err == nil {
+		return
+	}
+
+	var err error
+	switch {
+	case isVideoFile(filename):
+		if err = generateThumbnail(path, config.UploadDir, filename); err == nil {
+			queueVideoThumbnails(path, filename, true)
+		}
+	case strings.HasSuffix(strings.ToLower(filename), ".cbz"):
+		err = generateCBZThumbnail(path, config.UploadDir, filename)
+	default:
+		return
+	}
+	if err != nil {
+		log.Printf("Warning: could not generate thumbnail: %v", err)
+		lazyThumbnailFailed.Store(filename, true)
+		return
+	}
+	missingThumbnailsReport.Invalidate()
+}
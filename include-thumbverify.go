@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The verify_thumbnails job decodes every thumbnail, preview sprite and
+// compact preview on disk to find ones left truncated, for example by
+// ffmpeg being interrupted, which show as broken images. Each corrupt one
+// is made again by the generator for its file type. One that cannot be
+// made again is removed so the file is listed as missing a thumbnail
+// instead. Missing thumbnails are not counted here; the missing thumbnails
+// page covers those.
+
+// maxListedThumbnails caps how many repaired thumbnails the job names
+const maxListedThumbnails = 20
+
+// thumbnailCheck is one generated image of a file and how to make it again
+type thumbnailCheck struct {
+	path     string
+	generate func() error
+}
+
+// fileThumbnailChecks lists the generated images a file may have
+func fileThumbnailChecks(f File) []thumbnailCheck {
+	var checks []thumbnailCheck
+	thumbPath := filepath.Join(config.UploadDir, "thumbnails", f.Filename+".jpg")
+	switch {
+	case isVideoFile(f.Filename):
+		checks = append(checks,
+			thumbnailCheck{thumbPath, func() error { return generateThumbnail(f.Path, config.UploadDir, f.Filename) }},
+			thumbnailCheck{spritePath(config.UploadDir, f.Filename), func() error { return generateVideoSprite(f.Path, config.UploadDir, f.Filename) }},
+		)
+	case strings.HasSuffix(strings.ToLower(f.Filename), ".cbz"):
+		checks = append(checks,
+			thumbnailCheck{thumbPath, func() error { return generateCBZThumbnail(f.Path, config.UploadDir, f.Filename) }},
+		)
+	case isThumbnailImage(f.Filename):
+		checks = append(checks,
+			thumbnailCheck{thumbPath, func() error { return generateImageThumbnail(f.Path, config.UploadDir, f.Filename) }},
+		)
+	}
+
+	// The compact preview comes last, as it is made from the thumbnail
+	compactPath := compactThumbnailPath(f.Filename)
+	checks = append(checks, thumbnailCheck{compactPath, func() error {
+		return makeCompactThumbnail(compactThumbnailSource(context.Background(), f.Path, f.Filename), compactPath)
+	}})
+	return checks
+}
+
+// verifyThumbnails checks the generated images of every file and makes the
+// corrupt ones again
+func verifyThumbnails(j *Job) (string, error) {
+	ctx := context.Background()
+
+	dbGate.RLock()
+	files, err := queryFilesWithTags(ctx, "SELECT id, filename, path, COALESCE(description, '') FROM files ORDER BY id")
+	dbGate.RUnlock()
+	if err != nil {
+		return "", err
+	}
+
+	j.SetTotal(len(files))
+	checked := 0
+	var repaired []string
+	for _, f := range files {
+		for _, c := range fileThumbnailChecks(f) {
+			if _, err := os.Stat(c.path); err != nil {
+				continue
+			}
+			checked++
+			if _, err := decodeImageFile(c.path); err == nil {
+				continue
+			}
+
+			j.Count("corrupt")
+			name, err := filepath.Rel(filepath.Join(config.UploadDir, "thumbnails"), c.path)
+			if err != nil {
+				name = c.path
+			}
+			if err := c.generate(); err != nil {
+				os.Remove(c.path)
+				j.Fail(name, fmt.Errorf("corrupt and could not be made again, removed: %v", err))
+				continue
+			}
+			if _, err := decodeImageFile(c.path); err != nil {
+				os.Remove(c.path)
+				j.Fail(name, fmt.Errorf("still corrupt after being made again, removed: %v", err))
+				continue
+			}
+			j.Count("repaired")
+			repaired = append(repaired, name)
+		}
+		j.Step()
+	}
+	missingThumbnailsReport.Invalidate()
+
+	message := fmt.Sprintf("Checked %d thumbnails, repaired %d", checked, len(repaired))
+	if len(repaired) > maxListedThumbnails {
+		message += ": " + strings.Join(repaired[:maxListedThumbnails], ", ") + fmt.Sprintf(" and %d more", len(repaired)-maxListedThumbnails)
+	} else if len(repaired) > 0 {
+		message += ": " + strings.Join(repaired, ", ")
+	}
+	return message, nil
+}
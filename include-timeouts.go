@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The server times out slow clients: a request's headers must arrive within
+// read_header_timeout_seconds, the rest of it within read_timeout_seconds, and
+// the response must be written within write_timeout_seconds. Uploads,
+// downloads and anything that transcodes or streams a whole file can take
+// far longer, so those routes get long_request_timeout_seconds instead. A
+// timeout of 0 means none. The server timeouts apply from the next restart.
+
+// maxTimeoutSeconds is the longest timeout that can be configured, a day
+const maxTimeoutSeconds = 86400
+
+// seconds converts a configured number of seconds to a duration
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+// newServer builds the HTTP server with the configured timeouts
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              config.ServerPort,
+		Handler:           handler,
+		ReadHeaderTimeout: seconds(config.ReadHeaderTimeout),
+		ReadTimeout:       seconds(config.ReadTimeout),
+		WriteTimeout:      seconds(config.WriteTimeout),
+		IdleTimeout:       seconds(config.IdleTimeout),
+	}
+}
+
+// withLongTimeout replaces the server's read and write deadlines for a
+// route that moves whole files
+func withLongTimeout(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if config.LongRequestTimeout > 0 {
+			deadline = time.Now().Add(seconds(config.LongRequestTimeout))
+		}
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline)
+		next(w, r)
+	}
+}
+
+// validateTimeouts checks every timeout is between 0 and a day, and that
+// long requests get at least as long as ordinary ones
+func validateTimeouts(c Config) error {
+	timeouts := []struct {
+		name  string
+		value int
+	}{
+		{"read header timeout", c.ReadHeaderTimeout},
+		{"read timeout", c.ReadTimeout},
+		{"write timeout", c.WriteTimeout},
+		{"idle timeout", c.IdleTimeout},
+		{"long request timeout", c.LongRequestTimeout},
+	}
+	for _, t := range timeouts {
+		if t.value < 0 || t.value > maxTimeoutSeconds {
+			return fmt.Errorf("%s must be between 0 and %d seconds", t.name, maxTimeoutSeconds)
+		}
+	}
+	if c.LongRequestTimeout != 0 && (c.ReadTimeout == 0 || c.WriteTimeout == 0 ||
+		c.LongRequestTimeout < c.ReadTimeout || c.LongRequestTimeout < c.WriteTimeout) {
+		return fmt.Errorf("long request timeout must be 0 or at least the read and write timeouts")
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"image"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// validateMediaFile does a quick check that a file can be read as the type its
+// extension claims. Types without a check are accepted, as are videos when
+// ffprobe is not installed to probe them.
+func validateMediaFile(path, filename string) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch {
+	case isVideoFile(filename):
+		if _, err := exec.LookPath("ffprobe"); err != nil {
+			return nil
+		}
+		_, err := detectVideoCodec(path)
+		return err
+
+	case ext == ".jpg" || ext == ".jpeg" || ext == ".png":
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, _, err := image.DecodeConfig(f); err != nil {
+			return fmt.Errorf("cannot read image header: %v", err)
+		}
+
+	case ext == ".cbz":
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			return fmt.Errorf("cannot open archive: %v", err)
+		}
+		r.Close()
+	}
+
+	return nil
+}
+
+// downloadContentTypes are the content types accepted for each media type
+// besides its own major type, such as image/* for images
+var downloadContentTypes = map[string][]string{
+	"video": {"video/", "application/mp4", "application/x-mpegurl", "application/vnd.apple.mpegurl"},
+	"image": {"image/"},
+	"audio": {"audio/", "application/ogg"},
+	"comic": {"application/zip", "application/x-zip-compressed", "application/vnd.comicbook+zip", "application/x-cbz"},
+	"pdf":   {"application/pdf"},
+}
+
+// checkDownloadContentType checks the content type a server sent for a
+// download suits the file it is saved as, so an error page answered with
+// 200 is not saved as a download. A web page is only accepted as an .html
+// file, and a media file must have content of its kind or the type of its
+// extension. A missing or generic binary type is accepted, since many
+// servers send nothing better. lenient_url_uploads accepts everything.
+func checkDownloadContentType(contentType, filename string) error {
+	if config.LenientURLUploads || contentType == "" {
+		return nil
+	}
+	received, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("the server sent an invalid content type %q", contentType)
+	}
+	switch received {
+	case "application/octet-stream", "binary/octet-stream", "application/binary":
+		return nil
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	if received == "text/html" || received == "application/xhtml+xml" {
+		if ext == ".html" || ext == ".htm" {
+			return nil
+		}
+		return fmt.Errorf("the URL returned a web page (%s) instead of a file", received)
+	}
+
+	kind := mediaType(filename)
+	expected, ok := downloadContentTypes[kind]
+	if !ok {
+		return nil
+	}
+	if byExt, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil && byExt == received {
+		return nil
+	}
+	for _, prefix := range expected {
+		if strings.HasPrefix(received, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the URL returned %s content, which is not a valid %s for %s", received, kind, filename)
+}
+
+// getEmptyFiles returns every file in the database whose file on disk is zero bytes
+func getEmptyFiles(ctx context.Context) ([]File, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, filename, path FROM files ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var empty []File
+	for rows.Next() {
+		var f File
+		if err := rows.Scan(&f.ID, &f.Filename, &f.Path); err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(f.Path); err == nil && info.Size() == 0 {
+			empty = append(empty, f)
+		}
+	}
+	return empty, rows.Err()
+}
+
+func handleEmptyFiles(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	adminData := AdminData{
+		Config:       config,
+		EmptyScanned: true,
+	}
+
+	if r.FormValue("action") == "delete_empty" {
+		// Only delete files that are still empty, in case they changed since the scan
+		stillEmpty := make(map[string]bool)
+		empty, err := getEmptyFiles(ctx)
+		if err != nil {
+			adminData.Error = err.Error()
+			renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+			return
+		}
+		for _, f := range empty {
+			stillEmpty[fmt.Sprint(f.ID)] = true
+		}
+
+		deleted := 0
+		var failures []string
+		for _, id := range r.Form["file_id"] {
+			if !stillEmpty[id] {
+				continue
+			}
+			if _, err := deleteFile(ctx, id); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", id, err))
+				continue
+			}
+			deleted++
+		}
+
+		adminData.Success = fmt.Sprintf("Deleted %d empty files", deleted)
+		if len(failures) > 0 {
+			adminData.Error = "Failed to delete: " + strings.Join(failures, "; ")
+		}
+	}
+
+	empty, err := getEmptyFiles(ctx)
+	if err != nil {
+		adminData.Error = err.Error()
+	}
+	adminData.EmptyFiles = empty
+
+	renderTemplate(w, "admin.html", buildPageData(r.Context(), "Admin", adminData))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Files can be linked as variants of each other, such as a low and a high
+// resolution copy of the same picture, so both can be kept and reached from
+// either file page. A link goes both ways and is stored once, with the
+// lower file ID first.
+//
+//	POST /file/{id}/variants                 links variant_id to the file
+//	POST /file/{id}/variants/{other}/remove  unlinks other from the file
+
+func createRelatedFilesTable() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS related_files (
+		file_id INTEGER,
+		related_id INTEGER,
+		PRIMARY KEY (file_id, related_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_related_files_related ON related_files(related_id);`)
+	return err
+}
+
+// relatedPair orders two file IDs the way a link stores them
+func relatedPair(a, b int) (int, int) {
+	if a > b {
+		return b, a
+	}
+	return a, b
+}
+
+// getFileVariants returns the files linked to a file that the context may see
+func getFileVariants(ctx context.Context, fileID int) ([]File, error) {
+	return queryFilesWithTags(ctx, `
+		SELECT f.id, f.filename, f.path, COALESCE(f.description, '')
+		FROM related_files rf
+		JOIN files f ON f.id = CASE WHEN rf.file_id = ? THEN rf.related_id ELSE rf.file_id END
+		WHERE (rf.file_id = ? OR rf.related_id = ?)`+privateFilter(ctx)+`
+		ORDER BY f.id`, fileID, fileID, fileID)
+}
+
+// linkFiles records two files as variants of each other
+func linkFiles(ctx context.Context, fileID, otherID int) error {
+	if fileID == otherID {
+		return fmt.Errorf("a file cannot be a variant of itself")
+	}
+	var private bool
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(private, 0) FROM files WHERE id=?", otherID).Scan(&private)
+	if err == sql.ErrNoRows || (err == nil && private && !showPrivate(ctx)) {
+		return fmt.Errorf("file %d not found", otherID)
+	} else if err != nil {
+		return err
+	}
+
+	a, b := relatedPair(fileID, otherID)
+	_, err = db.ExecContext(ctx, "INSERT OR IGNORE INTO related_files(file_id, related_id) VALUES(?, ?)", a, b)
+	return err
+}
+
+// unlinkFiles removes the link between two files
+func unlinkFiles(ctx context.Context, fileID, otherID int) error {
+	a, b := relatedPair(fileID, otherID)
+	_, err := db.ExecContext(ctx, "DELETE FROM related_files WHERE file_id=? AND related_id=?", a, b)
+	return err
+}
+
+// parseVariantID reads a file ID given as a number or a /file/{id} link
+func parseVariantID(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if u, err := url.Parse(s); err == nil && strings.HasPrefix(u.Path, "/file/") {
+		s = strings.SplitN(strings.TrimPrefix(u.Path, "/file/"), "/", 2)[0]
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid file ID: %s", s)
+	}
+	return id, nil
+}
+
+// fileVariantsHandler serves the variant link and unlink forms on the file page
+func fileVariantsHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+		return
+	}
+
+	ctx := r.Context()
+	fileID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		renderError(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	var private bool
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(private, 0) FROM files WHERE id=?", fileID).Scan(&private); err != nil || (private && !showPrivate(ctx)) {
+		renderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 4:
+		otherID, err := parseVariantID(r.FormValue("variant_id"))
+		if err != nil {
+			renderError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := linkFiles(ctx, fileID, otherID); err != nil {
+			renderError(w, "Failed to link files: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit(r, "link", fileTarget(fileID), fileTarget(otherID))
+	case len(parts) == 6 && parts[5] == "remove":
+		otherID, err := strconv.Atoi(parts[4])
+		if err != nil {
+			renderError(w, "Invalid file ID", http.StatusBadRequest)
+			return
+		}
+		if err := unlinkFiles(ctx, fileID, otherID); err != nil {
+			renderError(w, "Failed to unlink files: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(r, "unlink", fileTarget(fileID), fileTarget(otherID))
+	default:
+		renderError(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+}
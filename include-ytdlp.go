@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ytdlpQualities maps the quality choices offered on the upload form to yt-dlp
+// format strings. Only these values are accepted so no user input reaches the
+// command line as a flag. An empty choice uses the configured default format.
+var ytdlpQualities = map[string]string{
+	"best":  "bestvideo[ext=mp4]+bestaudio[ext=m4a]/best[ext=mp4]/best",
+	"1080p": "bestvideo[height<=1080][ext=mp4]+bestaudio[ext=m4a]/best[height<=1080][ext=mp4]/best[height<=1080]",
+	"720p":  "bestvideo[height<=720][ext=mp4]+bestaudio[ext=m4a]/best[height<=720][ext=mp4]/best[height<=720]",
+	"audio": "bestaudio[ext=m4a]/bestaudio",
+}
+
+// ytdlpFormatFor returns the yt-dlp format string for a quality choice
+func ytdlpFormatFor(quality string) (string, bool) {
+	if quality == "" {
+		return config.YtdlpFormat, true
+	}
+	format, ok := ytdlpQualities[quality]
+	return format, ok
+}
+
+// ytdlpArgs builds the yt-dlp arguments for a download, ending with the URL
+func ytdlpArgs(format string, playlist bool, videoURL string, extra ...string) []string {
+	args := []string{"-f", format, "--no-overwrites"}
+	if !playlist {
+		args = append(args, "--playlist-items", "1")
+	}
+	if config.YtdlpCookies != "" {
+		args = append(args, "--cookies", config.YtdlpCookies)
+	}
+	args = append(args, extra...)
+	// "--" stops yt-dlp reading the URL as an option
+	return append(args, "--", videoURL)
+}
+
+// runYtdlp runs yt-dlp, retrying with exponential backoff when it fails.
+// With captureOutput set stdout is returned, otherwise it goes to the server log.
+func runYtdlp(ctx context.Context, captureOutput bool, args ...string) ([]byte, error) {
+	attempts := config.YtdlpRetries + 1
+	delay := time.Duration(config.YtdlpBackoff) * time.Second
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		log.Printf("yt-dlp: attempt %d of %d: %s", attempt, attempts, strings.Join(args, " "))
+
+		cmd := exec.CommandContext(ctx, "yt-dlp", args...)
+		cmd.Stderr = os.Stderr
+
+		var out []byte
+		var err error
+		if captureOutput {
+			out, err = cmd.Output()
+		} else {
+			cmd.Stdout = os.Stdout
+			err = cmd.Run()
+		}
+		if err == nil {
+			return out, nil
+		}
+
+		lastErr = err
+		log.Printf("yt-dlp: attempt %d failed: %v", attempt, err)
+
+		if attempt < attempts {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+	}
+
+	return nil, fmt.Errorf("failed after %d attempts: %v", attempts, lastErr)
+}
+
+// getYtdlpDownloads returns the files yt-dlp left in its staging directory.
+// Expected names that are missing, usually because yt-dlp sanitised the title
+// differently for --get-filename than for the download, are logged.
+func getYtdlpDownloads(stagingDir string, expectedNames []string) ([]string, error) {
+	entries, err := os.ReadDir(stagingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool)
+	var downloaded []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() {
+			continue
+		}
+		// Leftovers from interrupted or merged downloads
+		switch filepath.Ext(name) {
+		case ".part", ".ytdl", ".tmp":
+			continue
+		}
+		downloaded = append(downloaded, filepath.Join(stagingDir, name))
+		found[sanitizeFilename(name)] = true
+	}
+
+	for _, name := range expectedNames {
+		if !found[name] {
+			log.Printf("yt-dlp: expected %s but it was not downloaded under that name", name)
+		}
+	}
+
+	return downloaded, nil
+}
+
+// importYtdlpFile moves a file yt-dlp has downloaded into the upload
+// directory under a sanitised name, re-encoding and thumbnailing videos, and
+// adds it to the database with the URL it was downloaded from
+func importYtdlpFile(downloadedPath, sourceURL string) (int64, string, error) {
+	info, err := os.Stat(downloadedPath)
+	if err != nil {
+		return 0, "", fmt.Errorf("downloaded file not found: %v", err)
+	}
+	if info.Size() == 0 {
+		return 0, "", fmt.Errorf("downloaded file is empty")
+	}
+
+	finalFilename, finalPath, err := checkFileConflictStrict(sanitizeFilename(filepath.Base(downloadedPath)))
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err := os.Rename(downloadedPath, finalPath); err != nil {
+		return 0, "", fmt.Errorf("failed to move downloaded file: %v", err)
+	}
+
+	processedPath := finalPath
+	var warningMsg string
+	if isVideoFile(finalFilename) {
+		tempPath := finalPath + ".tmp"
+		if err := os.Rename(finalPath, tempPath); err != nil {
+			return 0, "", fmt.Errorf("failed to create temp file for processing: %v", err)
+		}
+
+		processedPath, warningMsg, err = processVideoFile(tempPath, finalPath)
+		if err != nil {
+			os.Remove(tempPath)
+			return 0, "", fmt.Errorf("failed to process video: %v", err)
+		}
+	}
+
+	id, err := saveFileToDatabase(finalFilename, processedPath, fileOrigin{Source: sourceYtdlp, OriginalName: filepath.Base(downloadedPath), URL: sourceURL})
+	if err != nil {
+		os.Remove(processedPath)
+		return 0, "", err
+	}
+
+	return id, warningMsg, nil
+}
@@ -1,21 +1,27 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -34,16 +40,69 @@ type File struct {
 	Path            string
 	Description     string
 	Tags            map[string][]string
+	Archived        bool
+	Private         bool
+	SourceURL       string
+	Size            int64
+	Modified        string
+	HoverPreview    string
 }
 
 type Config struct {
-	DatabasePath string `json:"database_path"`
-	UploadDir    string `json:"upload_dir"`
-	ServerPort   string `json:"server_port"`
-	InstanceName string `json:"instance_name"`
-	GallerySize  string `json:"gallery_size"`
-	ItemsPerPage string `json:"items_per_page"`
-	TagAliases   []TagAliasGroup `json:"tag_aliases"`
+	DatabasePath         string            `json:"database_path"`
+	UploadDir            string            `json:"upload_dir"`
+	ServerPort           string            `json:"server_port"`
+	ReadHeaderTimeout    int               `json:"read_header_timeout_seconds"`
+	ReadTimeout          int               `json:"read_timeout_seconds"`
+	WriteTimeout         int               `json:"write_timeout_seconds"`
+	IdleTimeout          int               `json:"idle_timeout_seconds"`
+	LongRequestTimeout   int               `json:"long_request_timeout_seconds"`
+	SlowQueryMs          int               `json:"slow_query_ms"`
+	InstanceName         string            `json:"instance_name"`
+	GallerySize          string            `json:"gallery_size"`
+	ItemsPerPage         string            `json:"items_per_page"`
+	MaxItemsPerPage      int               `json:"max_items_per_page"`
+	TitleFormat          string            `json:"title_format"`
+	GalleryMinWidth      string            `json:"gallery_min_width"`
+	GalleryMaxWidth      string            `json:"gallery_max_width"`
+	VideoExtensions      []string          `json:"video_extensions"`
+	ValidateUploads      bool              `json:"validate_uploads"`
+	LenientURLUploads    bool              `json:"lenient_url_uploads"`
+	ExportDir            string            `json:"export_dir"`
+	ExportMode           string            `json:"export_mode"`
+	YtdlpRetries         int               `json:"ytdlp_retries"`
+	YtdlpBackoff         int               `json:"ytdlp_backoff_seconds"`
+	YtdlpFormat          string            `json:"ytdlp_format"`
+	YtdlpCookies         string            `json:"ytdlp_cookies_file"`
+	DefaultView          string            `json:"default_view"`
+	ListSort             string            `json:"list_sort"`
+	GalleryFields        string            `json:"gallery_fields"`
+	HomeSections         string            `json:"home_sections"`
+	UntaggedNext         string            `json:"untagged_next"`
+	CopyPreviousFallback string            `json:"copy_previous_fallback"`
+	CORSOrigins          []string          `json:"cors_allowed_origins"`
+	CORSMethods          []string          `json:"cors_allowed_methods"`
+	CORSHeaders          []string          `json:"cors_allowed_headers"`
+	AllowedRoots         []string          `json:"allowed_roots"`
+	ScanIgnore           []string          `json:"scan_ignore"`
+	ArchiveDir           string            `json:"archive_dir"`
+	MaxImageDimension    int               `json:"max_image_dimension"`
+	KeepOriginals        bool              `json:"keep_originals"`
+	AutoPruneTags        bool              `json:"auto_prune_tags"`
+	ThumbnailBackground  string            `json:"thumbnail_background"`
+	ThumbnailMode        string            `json:"thumbnail_mode"`
+	ThumbnailDedup       bool              `json:"thumbnail_dedup"`
+	HoverPreviews        bool              `json:"hover_previews"`
+	FallbackThumbnails   map[string]string `json:"fallback_thumbnails"`
+	DescriptionTemplate  string            `json:"description_template"`
+	DescriptionDrafts    bool              `json:"description_drafts"`
+	PerceptualHash       bool              `json:"perceptual_hash"`
+	DuplicateThreshold   int               `json:"duplicate_threshold"`
+	BulkOperation        string            `json:"bulk_default_operation"`
+	BulkRemember         bool              `json:"bulk_remember"`
+	AuditLog             bool              `json:"audit_log"`
+	AccessPassword       string            `json:"access_password"`
+	TagAliases           []TagAliasGroup   `json:"tag_aliases"`
 }
 
 type Breadcrumb struct {
@@ -61,23 +120,41 @@ type TagDisplay struct {
 	Count int
 }
 
+// TagCategory is a category with its tags, in the order they are shown
+type TagCategory struct {
+	Name string
+	Tags []TagDisplay
+}
+
 type ListData struct {
-    Tagged      []File
-    Untagged    []File
-    Breadcrumbs []Breadcrumb
+	Tagged             []File
+	Untagged           []File
+	TaggedPagination   *Pagination
+	UntaggedPagination *Pagination
+	Breadcrumbs        []Breadcrumb
+	Sort               string
+	JumpIndex          []JumpLink
+	Sections           *ListSections
+	Tag                *filter // the tag a single tag page shows, offered for renaming
 }
 
 type PageData struct {
-	Title      string
-	Data       interface{}
-	Query      string
-	IP         string
-	Port       string
-	Files      []File
-	Tags       map[string][]TagDisplay
-	Breadcrumbs []Breadcrumb
-	Pagination *Pagination
-	GallerySize string
+	Title           string
+	PageTitle       string
+	Data            interface{}
+	Query           string
+	IP              string
+	Port            string
+	Files           []File
+	Tags            []TagCategory
+	Breadcrumbs     []Breadcrumb
+	Pagination      *Pagination
+	GallerySize     string
+	GalleryMinWidth string
+	GalleryMaxWidth string
+	Compact         bool
+	GalleryFields   map[string]bool
+	HoverPreviews   bool
 }
 
 type Pagination struct {
@@ -88,6 +165,65 @@ type Pagination struct {
 	PrevPage    int
 	NextPage    int
 	PerPage     int
+	Params      url.Values
+	Param       string // query parameter holding the page number, page when empty
+}
+
+// PageParam is the query parameter holding the page number
+func (p *Pagination) PageParam() string {
+	if p.Param == "" {
+		return "page"
+	}
+	return p.Param
+}
+
+// pageNumberWindow is how many page numbers are linked either side of the current page
+const pageNumberWindow = 2
+
+// PageNumbers returns the page numbers to link to around the current page
+func (p *Pagination) PageNumbers() []int {
+	first := p.CurrentPage - pageNumberWindow
+	if first < 1 {
+		first = 1
+	}
+	last := p.CurrentPage + pageNumberWindow
+	if last > p.TotalPages {
+		last = p.TotalPages
+	}
+
+	var pages []int
+	for i := first; i <= last; i++ {
+		pages = append(pages, i)
+	}
+	return pages
+}
+
+// pageURL returns a link to another page of the current listing, keeping
+// every query parameter of the current request except the page number
+func pageURL(p *Pagination, page int) string {
+	params := url.Values{}
+	for key, values := range p.Params {
+		if key != p.PageParam() {
+			params[key] = values
+		}
+	}
+	params.Set(p.PageParam(), strconv.Itoa(page))
+	return "?" + params.Encode()
+}
+
+type AdminData struct {
+	Config           Config
+	Error            string
+	Success          string
+	RenameForm       RenameForm
+	RenamePreview    []RenamePreview
+	ExportCategories string
+	ExportResults    []ExportResult
+	EmptyFiles       []File
+	EmptyScanned     bool
+	PathViolations   []File
+	PathsChecked     bool
+	TagImportResults []TagImportResult
 }
 
 type VideoFile struct {
@@ -104,13 +240,64 @@ type filter struct {
 	Value      string
 	Values     []string // Expanded values including aliases
 	IsPreviews bool     // New field to indicate preview mode
+	Exclude    bool     // Files must not have the tag, from a /not/tag/ segment
+}
+
+// title describes a filter in page titles
+func (f filter) title() string {
+	if f.Exclude {
+		return fmt.Sprintf("not %s: %s", f.Category, f.Value)
+	}
+	return fmt.Sprintf("%s: %s", f.Category, f.Value)
+}
+
+// filterCondition returns the condition a file f must meet for a tag
+// filter that is not a preview, with its arguments
+func filterCondition(f filter) (string, []interface{}) {
+	exists := "EXISTS"
+	if f.Exclude {
+		exists = "NOT EXISTS"
+	}
+
+	// Unassigned matches files with no tag in the category
+	if f.Value == "unassigned" {
+		if f.Exclude {
+			exists = "EXISTS"
+		} else {
+			exists = "NOT EXISTS"
+		}
+		return `
+			AND ` + exists + ` (
+				SELECT 1
+				FROM file_tags ft
+				JOIN tags t ON ft.tag_id = t.id
+				JOIN categories c ON c.id = t.category_id
+				WHERE ft.file_id = f.id AND c.name = ?
+			)`, []interface{}{f.Category}
+	}
+
+	// Build OR clause for aliases
+	placeholders := make([]string, len(f.Values))
+	args := []interface{}{f.Category}
+	for i, v := range f.Values {
+		placeholders[i] = "?"
+		args = append(args, v)
+	}
+	return fmt.Sprintf(`
+			AND %s (
+				SELECT 1
+				FROM file_tags ft
+				JOIN tags t ON ft.tag_id = t.id
+				JOIN categories c ON c.id = t.category_id
+				WHERE ft.file_id = f.id AND c.name = ? AND t.value IN (%s)
+			)`, exists, strings.Join(placeholders, ",")), args
 }
 
 func expandTagWithAliases(category, value string) []string {
 	values := []string{value}
 
 	for _, group := range config.TagAliases {
-		if group.Category != category {
+		if !strings.EqualFold(group.Category, category) {
 			continue
 		}
 
@@ -137,13 +324,13 @@ func expandTagWithAliases(category, value string) []string {
 	return values
 }
 
-func getOrCreateCategoryAndTag(category, value string) (int, int, error) {
+func getOrCreateCategoryAndTag(ctx context.Context, category, value string) (int, int, error) {
 	category = strings.TrimSpace(category)
 	value = strings.TrimSpace(value)
 	var catID int
-	err := db.QueryRow("SELECT id FROM categories WHERE name=?", category).Scan(&catID)
+	err := db.QueryRowContext(ctx, "SELECT id FROM categories WHERE name=?", category).Scan(&catID)
 	if err == sql.ErrNoRows {
-		res, err := db.Exec("INSERT INTO categories(name) VALUES(?)", category)
+		res, err := db.ExecContext(ctx, "INSERT INTO categories(name) VALUES(?)", category)
 		if err != nil {
 			return 0, 0, err
 		}
@@ -155,9 +342,9 @@ func getOrCreateCategoryAndTag(category, value string) (int, int, error) {
 
 	var tagID int
 	if value != "" {
-		err = db.QueryRow("SELECT id FROM tags WHERE category_id=? AND value=?", catID, value).Scan(&tagID)
+		err = db.QueryRowContext(ctx, "SELECT id FROM tags WHERE category_id=? AND value=?", catID, value).Scan(&tagID)
 		if err == sql.ErrNoRows {
-			res, err := db.Exec("INSERT INTO tags(category_id, value) VALUES(?, ?)", catID, value)
+			res, err := db.ExecContext(ctx, "INSERT INTO tags(category_id, value) VALUES(?, ?)", catID, value)
 			if err != nil {
 				return 0, 0, err
 			}
@@ -171,8 +358,8 @@ func getOrCreateCategoryAndTag(category, value string) (int, int, error) {
 	return catID, tagID, nil
 }
 
-func queryFilesWithTags(query string, args ...interface{}) ([]File, error) {
-	rows, err := db.Query(query, args...)
+func queryFilesWithTags(ctx context.Context, query string, args ...interface{}) ([]File, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -190,74 +377,133 @@ func queryFilesWithTags(query string, args ...interface{}) ([]File, error) {
 	return files, nil
 }
 
-func getTaggedFiles() ([]File, error) {
-	return queryFilesWithTags(`
+func getTaggedFiles(ctx context.Context) ([]File, error) {
+	return queryFilesWithTags(ctx, `
 		SELECT DISTINCT f.id, f.filename, f.path, COALESCE(f.description, '') as description
 		FROM files f
 		JOIN file_tags ft ON ft.file_id = f.id
+		WHERE 1=1`+privateFilter(ctx)+`
 		ORDER BY f.id DESC
 	`)
 }
 
-func getTaggedFilesPaginated(page, perPage int) ([]File, int, error) {
+func getTaggedFilesPaginated(ctx context.Context, page, perPage int, order string) ([]File, int, error) {
 	// Get total count
 	var total int
-	err := db.QueryRow(`SELECT COUNT(DISTINCT f.id) FROM files f JOIN file_tags ft ON ft.file_id = f.id`).Scan(&total)
+	err := db.QueryRowContext(ctx, `SELECT COUNT(DISTINCT f.id) FROM files f JOIN file_tags ft ON ft.file_id = f.id WHERE 1=1`+privateFilter(ctx)).Scan(&total)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	offset := (page - 1) * perPage
-	files, err := queryFilesWithTags(`
+	files, err := queryFilesWithTags(ctx, `
 		SELECT DISTINCT f.id, f.filename, f.path, COALESCE(f.description, '') as description
 		FROM files f
 		JOIN file_tags ft ON ft.file_id = f.id
-		ORDER BY f.id DESC
+		WHERE 1=1`+privateFilter(ctx)+`
+		ORDER BY `+order+`
 		LIMIT ? OFFSET ?
 	`, perPage, offset)
 
 	return files, total, err
 }
 
-func getUntaggedFiles() ([]File, error) {
-	return queryFilesWithTags(`
+func getUntaggedFiles(ctx context.Context) ([]File, error) {
+	return queryFilesWithTags(ctx, `
 		SELECT f.id, f.filename, f.path, COALESCE(f.description, '') as description
 		FROM files f
 		LEFT JOIN file_tags ft ON ft.file_id = f.id
-		WHERE ft.file_id IS NULL
+		WHERE ft.file_id IS NULL`+privateFilter(ctx)+`
 		ORDER BY f.id DESC
 	`)
 }
 
-func getUntaggedFilesPaginated(page, perPage int) ([]File, int, error) {
+func getUntaggedFilesPaginated(ctx context.Context, page, perPage int, order string) ([]File, int, error) {
 	// Get total count
 	var total int
-	err := db.QueryRow(`SELECT COUNT(*) FROM files f LEFT JOIN file_tags ft ON ft.file_id = f.id WHERE ft.file_id IS NULL`).Scan(&total)
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM files f LEFT JOIN file_tags ft ON ft.file_id = f.id WHERE ft.file_id IS NULL`+privateFilter(ctx)).Scan(&total)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	offset := (page - 1) * perPage
-	files, err := queryFilesWithTags(`
+	files, err := queryFilesWithTags(ctx, `
 		SELECT f.id, f.filename, f.path, COALESCE(f.description, '') as description
 		FROM files f
 		LEFT JOIN file_tags ft ON ft.file_id = f.id
-		WHERE ft.file_id IS NULL
-		ORDER BY f.id DESC
+		WHERE ft.file_id IS NULL`+privateFilter(ctx)+`
+		ORDER BY `+order+`
 		LIMIT ? OFFSET ?
 	`, perPage, offset)
 
 	return files, total, err
 }
 
-func buildPageData(title string, data interface{}) PageData {
-	tagMap, _ := getTagData()
-	return PageData{Title: title, Data: data, Tags: tagMap, GallerySize: config.GallerySize,}
+// untaggedOrders maps the strategies for picking the next untagged file to an ORDER BY clause
+var untaggedOrders = map[string]string{
+	"oldest": "f.id ASC",
+	"newest": "f.id DESC",
+	"random": "RANDOM()",
+}
+
+// getNextUntaggedFile returns the ID of the untagged file to tag next, or
+// errFileNotFound when every file has tags
+func getNextUntaggedFile(ctx context.Context, strategy string) (int, error) {
+	order, ok := untaggedOrders[strategy]
+	if !ok {
+		return 0, fmt.Errorf("unknown strategy: %s", strategy)
+	}
+
+	var id int
+	err := db.QueryRowContext(ctx, `
+		SELECT f.id
+		FROM files f
+		LEFT JOIN file_tags ft ON ft.file_id = f.id
+		WHERE ft.file_id IS NULL`+privateFilter(ctx)+`
+		ORDER BY `+order+`
+		LIMIT 1
+	`).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errFileNotFound
+	}
+	return id, err
+}
+
+func buildPageData(ctx context.Context, title string, data interface{}) PageData {
+	categories, _ := tagCacheFor(ctx).get()
+	return PageData{
+		Title:           title,
+		PageTitle:       formatPageTitle(title),
+		Data:            data,
+		Tags:            categories,
+		GallerySize:     config.GallerySize,
+		GalleryMinWidth: config.GalleryMinWidth,
+		GalleryMaxWidth: config.GalleryMaxWidth,
+	}
+}
+
+// formatPageTitle applies the configured title format, where {page} is the
+// page-specific title and {instance} the instance name
+func formatPageTitle(page string) string {
+	instance := config.InstanceName
+	if instance == "" {
+		instance = "Taggart"
+	}
+	if page == "" {
+		return instance
+	}
+
+	format := config.TitleFormat
+	if format == "" {
+		format = "{page} — {instance}"
+	}
+	return strings.NewReplacer("{page}", page, "{instance}", instance).Replace(format)
 }
 
-func buildPageDataWithPagination(title string, data interface{}, page, total, perPage int) PageData {
-	pd := buildPageData(title, data)
+func buildPageDataWithPagination(ctx context.Context, title string, data interface{}, page, total, perPage int, params url.Values) PageData {
+	pd := buildPageData(ctx, title, data)
 	pd.Pagination = calculatePagination(page, total, perPage)
+	pd.Pagination.Params = params
 	return pd
 }
 
@@ -278,8 +524,8 @@ func calculatePagination(page, total, perPage int) *Pagination {
 	}
 }
 
-func buildPageDataWithIP(title string, data interface{}) PageData {
-	pageData := buildPageData(title, data)
+func buildPageDataWithIP(ctx context.Context, title string, data interface{}) PageData {
+	pageData := buildPageData(ctx, title, data)
 	ip, _ := getLocalIP()
 	pageData.IP = ip
 	pageData.Port = strings.TrimPrefix(config.ServerPort, ":")
@@ -296,12 +542,16 @@ func renderTemplate(w http.ResponseWriter, tmplName string, data PageData) {
 	}
 }
 
-func getTagData() (map[string][]TagDisplay, error) {
-	rows, err := db.Query(`
+// getTagData returns the categories alphabetically, each with its tags in
+// use sorted by value. Only files the context may see are counted.
+func getTagData(ctx context.Context) ([]TagCategory, error) {
+	rows, err := db.QueryContext(ctx, `
 		SELECT c.name, t.value, COUNT(ft.file_id)
 		FROM tags t
 		JOIN categories c ON c.id = t.category_id
-		LEFT JOIN file_tags ft ON ft.tag_id = t.id
+		JOIN file_tags ft ON ft.tag_id = t.id
+		JOIN files f ON f.id = ft.file_id
+		WHERE 1=1`+privateFilter(ctx)+`
 		GROUP BY t.id
 		HAVING COUNT(ft.file_id) > 0
 		ORDER BY c.name, t.value`)
@@ -310,14 +560,18 @@ func getTagData() (map[string][]TagDisplay, error) {
 	}
 	defer rows.Close()
 
-	tagMap := make(map[string][]TagDisplay)
+	categories := []TagCategory{}
 	for rows.Next() {
 		var cat, val string
 		var count int
 		rows.Scan(&cat, &val, &count)
-		tagMap[cat] = append(tagMap[cat], TagDisplay{Value: val, Count: count})
+		if n := len(categories); n == 0 || categories[n-1].Name != cat {
+			categories = append(categories, TagCategory{Name: cat})
+		}
+		last := &categories[len(categories)-1]
+		last.Tags = append(last.Tags, TagDisplay{Value: val, Count: count})
 	}
-	return tagMap, nil
+	return categories, nil
 }
 
 func main() {
@@ -326,42 +580,24 @@ func main() {
 	}
 
 	var err error
-	db, err = sql.Open("sqlite3", config.DatabasePath)
+	db, err = sql.Open(timedDriverName, config.DatabasePath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	openDatabasePath = config.DatabasePath
+	// db is replaced when a backup is restored, so close whichever is current
+	defer func() { db.Close() }()
 
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS files (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		filename TEXT,
-		path TEXT,
-		description TEXT DEFAULT ''
-	);
-	CREATE TABLE IF NOT EXISTS categories (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT UNIQUE
-	);
-	CREATE TABLE IF NOT EXISTS tags (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		category_id INTEGER,
-		value TEXT,
-		UNIQUE(category_id, value)
-	);
-	CREATE TABLE IF NOT EXISTS file_tags (
-		file_id INTEGER,
-		tag_id INTEGER,
-		UNIQUE(file_id, tag_id)
-	);
-	`)
-	if err != nil {
+	if err := initSchema(); err != nil {
 		log.Fatal(err)
 	}
 
 	os.MkdirAll(config.UploadDir, 0755)
 	os.MkdirAll("static", 0755)
 
+	logPathViolations()
+	go runThumbnailQueue()
+
 	tmpl = template.Must(template.New("").Funcs(template.FuncMap{
 		"hasAnySuffix": func(s string, suffixes ...string) bool {
 			for _, suf := range suffixes {
@@ -371,6 +607,21 @@ func main() {
 			}
 			return false
 		},
+		"isVideo":                isVideoFile,
+		"join":                   strings.Join,
+		"add":                    func(a, b int) int { return a + b },
+		"sub":                    func(a, b int) int { return a - b },
+		"pageURL":                pageURL,
+		"sortURL":                sortURL,
+		"databasePathWarning":    databasePathWarning,
+		"maintenanceMode":        maintenanceMode,
+		"placeholderExt":         placeholderExt,
+		"galleryThumbnailURL":    galleryThumbnailURL,
+		"galleryFieldNames":      func() []string { return galleryFieldNames },
+		"fallbackThumbnailTypes": func() []string { return fallbackThumbnailTypes },
+		"toggledGalleryFields":   toggledGalleryFields,
+		"fileTypeLabel":          fileTypeLabel,
+		"formatBytes":            formatBytes,
     "dict": func(values ...interface{}) (map[string]interface{}, error) {
         if len(values)%2 != 0 {
             return nil, fmt.Errorf("dict requires an even number of args")
@@ -387,97 +638,254 @@ func main() {
     },
 	}).ParseGlob("templates/*.html"))
 
-	http.HandleFunc("/", listFilesHandler)
-	http.HandleFunc("/add", uploadHandler)
-	http.HandleFunc("/add-yt", ytdlpHandler)
-	http.HandleFunc("/upload-url", uploadFromURLHandler)
-	http.HandleFunc("/file/", fileRouter)
+	http.HandleFunc("/", homeHandler)
+	http.HandleFunc("/browse", listFilesHandler)
+	http.HandleFunc("/dashboard", dashboardHandler)
+	http.HandleFunc("/add", withLongTimeout(uploadHandler))
+	http.HandleFunc("/add-yt", withLongTimeout(ytdlpHandler))
+	http.HandleFunc("/upload-url", withLongTimeout(uploadFromURLHandler))
+	http.HandleFunc("/file/", withLongTimeout(fileRouter))
 	http.HandleFunc("/tags", tagsHandler)
+	http.HandleFunc("/tags/move", tagsMoveHandler)
 	http.HandleFunc("/tag/", tagFilterHandler)
 	http.HandleFunc("/untagged", untaggedFilesHandler)
+	http.HandleFunc("/untagged/next", untaggedNextHandler)
 	http.HandleFunc("/search", searchHandler)
 	http.HandleFunc("/bulk-tag", bulkTagHandler)
-	http.HandleFunc("/admin", adminHandler)
-	http.HandleFunc("/thumbnails/generate", generateThumbnailHandler)
-
-	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(config.UploadDir))))
+	http.HandleFunc("/admin", withLongTimeout(adminHandler))
+	http.HandleFunc("/admin/audit", auditLogHandler)
+	http.HandleFunc("/admin/jobs", jobsPageHandler)
+	http.HandleFunc("/admin/orphans", orphansHandler)
+	http.HandleFunc("/admin/orphans/import", scanUploadsHandler)
+	http.HandleFunc("/admin/thumbnails", thumbnailsHandler)
+	http.HandleFunc("/admin/duplicates", duplicatesHandler)
+	http.HandleFunc("/admin/export.jsonl", withLongTimeout(handleExportJSONL))
+	http.HandleFunc(restorePath, withLongTimeout(restoreBackupHandler))
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/thumbnails/generate", withLongTimeout(generateThumbnailHandler))
+	http.HandleFunc("/cbz/", withLongTimeout(cbzViewerHandler))
+	http.HandleFunc("/placeholder/", placeholderHandler)
+	http.HandleFunc("/compact/", compactThumbnailHandler)
+	http.HandleFunc("/gallery-sprites/", gallerySpriteHandler)
+	http.HandleFunc("/api/files", withCORS(apiListFilesHandler))
+	http.HandleFunc("/api/file/", withCORS(fileRouter))
+	http.HandleFunc("/api/files/", withCORS(apiFilesRouter))
+	http.HandleFunc("/api/tag-query/validate", withCORS(apiTagQueryValidateHandler))
+	http.HandleFunc("/api/tags/suggest", withCORS(apiTagSuggestHandler))
+	http.HandleFunc("/api/categories/", withCORS(apiCategoriesRouter))
+	http.HandleFunc("/api/stats/library", withCORS(apiLibraryStatsHandler))
+	http.HandleFunc("/api/bulk", withCORS(apiBulkHandler))
+	http.HandleFunc("/api/gallery-sprite", withCORS(withLongTimeout(apiGallerySpriteHandler)))
+	http.HandleFunc("/api/jobs", withCORS(apiJobsHandler))
+	http.HandleFunc("/api/jobs/", withCORS(apiJobsHandler))
+
+	http.Handle("/uploads/", http.StripPrefix("/uploads/", withLongTimeout(uploadsHandler)))
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
 	log.Printf("Server started at http://localhost%s", config.ServerPort)
-	log.Printf("Database: %s", config.DatabasePath)
+	log.Printf("Database: %s", openDatabasePath)
 	log.Printf("Upload directory: %s", config.UploadDir)
-	http.ListenAndServe(config.ServerPort, nil)
+
+	server := newServer(withRecovery(withMaintenance(withDBGate(withVisibility(http.DefaultServeMux)))))
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a signal, let in-flight requests finish, then flush caches
+	// before the deferred db.Close runs
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Printf("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: shutdown did not complete cleanly: %v", err)
+	}
+	flushCaches()
+}
+
+// searchSorts maps the sort parameter accepted by search to the SQL ordering
+// of the results, where score is a file's best relevance score
+var searchSorts = map[string]string{
+	"name":      "f.filename, f.id",
+	"id":        "f.id DESC",
+	"relevance": "score DESC, f.filename, f.id",
 }
 
 func searchHandler(w http.ResponseWriter, r *http.Request) {
 	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	page, perPage := reportPage(r)
+
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "name"
+	}
+	if _, ok := searchSorts[sortBy]; !ok {
+		renderError(w, "Invalid sort, must be one of: name, id, relevance", http.StatusBadRequest)
+		return
+	}
 
 	var files []File
+	var total int
+	var pages []CBZPageResult
 	var searchTitle string
 
 	if query != "" {
-		sqlPattern := "%" + strings.ReplaceAll(strings.ReplaceAll(strings.ToLower(query), "*", "%"), "?", "_") + "%"
-
-		rows, err := db.Query(`
-			SELECT f.id, f.filename, f.path, COALESCE(f.description, '') AS description,
-			       c.name AS category, t.value AS tag
-			FROM files f
-			LEFT JOIN file_tags ft ON ft.file_id = f.id
-			LEFT JOIN tags t ON t.id = ft.tag_id
-			LEFT JOIN categories c ON c.id = t.category_id
-			WHERE LOWER(f.filename) LIKE ? OR LOWER(f.description) LIKE ? OR LOWER(t.value) LIKE ?
-			ORDER BY f.filename
-		`, sqlPattern, sqlPattern, sqlPattern)
+		var err error
+		files, total, err = searchFilesPaginated(r.Context(), query, sortBy, page, perPage)
 		if err != nil {
 			renderError(w, "Search failed: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		fileMap := make(map[int]*File)
-		for rows.Next() {
-			var id int
-			var filename, path, description, category, tag sql.NullString
-
-			if err := rows.Scan(&id, &filename, &path, &description, &category, &tag); err != nil {
-				renderError(w, "Failed to read search results: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			f, exists := fileMap[id]
-			if !exists {
-				f = &File{
-					ID:              id,
-					Filename:        filename.String,
-					Path:            path.String,
-					EscapedFilename: url.PathEscape(filename.String),
-					Description:     description.String,
-					Tags:            make(map[string][]string),
-				}
-				fileMap[id] = f
-			}
-
-			if category.Valid && tag.Valid && tag.String != "" {
-				f.Tags[category.String] = append(f.Tags[category.String], tag.String)
-			}
-		}
-
-		for _, f := range fileMap {
-			files = append(files, *f)
+		pages, err = searchCBZPages(r.Context(), query)
+		if err != nil {
+			renderError(w, "Search failed: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
-
 		searchTitle = fmt.Sprintf("Search Results for: %s", query)
 	} else {
 		searchTitle = "Search Files"
 	}
 
-	pageData := buildPageData(searchTitle, files)
+	pageData := buildPageDataWithPagination(r.Context(), searchTitle, struct {
+		Sort  string
+		Total int
+		Pages []CBZPageResult
+	}{sortBy, total, pages}, page, total, perPage, r.URL.Query())
 	pageData.Query = query
 	pageData.Files = files
+	prepareGallery(&pageData, r, files)
 	renderTemplate(w, "search.html", pageData)
 }
 
-func processUpload(src io.Reader, filename string) (int64, string, error) {
+// searchPattern turns a search query into a LIKE pattern, where * and ?
+// are wildcards
+func searchPattern(query string) string {
+	return "%" + strings.ReplaceAll(strings.ReplaceAll(strings.ToLower(query), "*", "%"), "?", "_") + "%"
+}
+
+// searchTagCondition returns the condition on t for a tag value matching a
+// search. When the whole query names a tag alias, the other values of its
+// alias group match too, in the group's category only.
+func searchTagCondition(query string) (string, []interface{}) {
+	condition := "LOWER(t.value) LIKE ?"
+	args := []interface{}{searchPattern(query)}
+	for _, group := range config.TagAliases {
+		found := false
+		for _, alias := range group.Aliases {
+			if strings.EqualFold(alias, query) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		placeholders := make([]string, len(group.Aliases))
+		args = append(args, group.Category)
+		for i, alias := range group.Aliases {
+			placeholders[i] = "?"
+			args = append(args, strings.ToLower(alias))
+		}
+		condition += " OR (t.category_id = (SELECT id FROM categories WHERE name = ?) AND LOWER(t.value) IN (" + strings.Join(placeholders, ",") + "))"
+	}
+	return "(" + condition + ")", args
+}
+
+// searchFrom returns the FROM and WHERE part of a search for query, with f
+// as the files alias, so counting and fetching results match the same
+// files. A file matches when its filename, description, source URL or a tag
+// value does.
+func searchFrom(ctx context.Context, query string) (string, []interface{}) {
+	pattern := searchPattern(query)
+	tagCondition, tagArgs := searchTagCondition(query)
+	from := `
+		FROM files f
+		LEFT JOIN file_tags ft ON ft.file_id = f.id
+		LEFT JOIN tags t ON t.id = ft.tag_id
+		WHERE (LOWER(f.filename) LIKE ? OR LOWER(f.description) LIKE ? OR LOWER(f.source_url) LIKE ? OR ` + tagCondition + `)` + privateFilter(ctx)
+	return from, append([]interface{}{pattern, pattern, pattern}, tagArgs...)
+}
+
+// searchFiles returns every file matching query, in the order of sortBy
+func searchFiles(ctx context.Context, query, sortBy string) ([]File, error) {
+	// A negative LIMIT is no limit in SQLite
+	return querySearch(ctx, query, sortBy, -1, 0)
+}
+
+// searchFilesPaginated returns one page of the files matching query, in the
+// order of sortBy, with how many match in all
+func searchFilesPaginated(ctx context.Context, query, sortBy string, page, perPage int) ([]File, int, error) {
+	from, args := searchFrom(ctx, query)
+	var total int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(DISTINCT f.id) "+from, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	files, err := querySearch(ctx, query, sortBy, perPage, (page-1)*perPage)
+	return files, total, err
+}
+
+// querySearch fetches up to limit files matching query from offset, each
+// with all its tags. Results come back in the same order every time for
+// the same query and sort, as every ordering ends with the file ID.
+func querySearch(ctx context.Context, query, sortBy string, limit, offset int) ([]File, error) {
+	order, ok := searchSorts[sortBy]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort: %s", sortBy)
+	}
+
+	from, args := searchFrom(ctx, query)
+	pattern := searchPattern(query)
+	tagCondition, tagArgs := searchTagCondition(query)
+	scoreArgs := append(append([]interface{}{pattern}, tagArgs...), pattern, pattern)
+
+	// score weights a filename match over a tag match over a description or source URL match
+	rows, err := db.QueryContext(ctx, `
+		SELECT f.id, f.filename, f.path, COALESCE(f.description, '') AS description,
+		       MAX(COALESCE(LOWER(f.filename) LIKE ?, 0) * 4 + COALESCE(`+tagCondition+`, 0) * 2 + COALESCE(LOWER(f.description) LIKE ? OR LOWER(f.source_url) LIKE ?, 0)) AS score
+		`+from+`
+		GROUP BY f.id
+		ORDER BY `+order+`
+		LIMIT ? OFFSET ?`, append(append(scoreArgs, args...), limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []File
+	var ids []int
+	for rows.Next() {
+		var f File
+		var score int
+		if err := rows.Scan(&f.ID, &f.Filename, &f.Path, &f.Description, &score); err != nil {
+			return nil, fmt.Errorf("failed to read search results: %v", err)
+		}
+		f.EscapedFilename = url.PathEscape(f.Filename)
+		files = append(files, f)
+		ids = append(ids, f.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	tags, err := getTagsForFiles(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		files[i].Tags = tags[files[i].ID]
+	}
+	return files, nil
+}
+
+func processUpload(src io.Reader, origin fileOrigin) (int64, string, error) {
+    filename := origin.OriginalName
     finalFilename, finalPath, err := checkFileConflictStrict(filename)
     if err != nil {
         return 0, "", err
@@ -489,42 +897,62 @@ func processUpload(src io.Reader, filename string) (int64, string, error) {
         return 0, "", fmt.Errorf("failed to create temp file: %v", err)
     }
 
-    _, err = io.Copy(tempFile, src)
+    written, err := io.Copy(tempFile, src)
     tempFile.Close()
     if err != nil {
         os.Remove(tempPath)
         return 0, "", fmt.Errorf("failed to copy file data: %v", err)
     }
 
-    ext := strings.ToLower(filepath.Ext(filename))
-    videoExts := map[string]bool{
-        ".mp4": true, ".mov": true, ".avi": true,
-        ".mkv": true, ".webm": true, ".m4v": true,
+    if written == 0 {
+        os.Remove(tempPath)
+        return 0, "", fmt.Errorf("%s is empty (0 bytes), upload rejected", filename)
     }
 
     var processedPath string
     var warningMsg string
 
-    if videoExts[ext] {
+    if config.ValidateUploads {
+        if err := validateMediaFile(tempPath, filename); err != nil {
+            os.Remove(tempPath)
+            return 0, "", fmt.Errorf("%s appears to be corrupt: %v", filename, err)
+        }
+    }
+
+    if isVideoFile(filename) {
         processedPath, warningMsg, err = processVideoFile(tempPath, finalPath)
         if err != nil {
             os.Remove(tempPath)
             return 0, "", err
         }
     } else {
+        warningMsg, err = limitImageSize(tempPath, finalFilename)
+        if err != nil {
+            os.Remove(tempPath)
+            return 0, "", fmt.Errorf("failed to downscale %s: %v", filename, err)
+        }
+
         // Non-video → just rename temp file to final
         if err := os.Rename(tempPath, finalPath); err != nil {
             return 0, "", fmt.Errorf("failed to move file: %v", err)
         }
         processedPath = finalPath
+        makeImageThumbnail(finalPath)
     }
 
-    id, err := saveFileToDatabase(finalFilename, processedPath)
+    id, err := saveFileToDatabase(finalFilename, processedPath, origin)
     if err != nil {
         os.Remove(processedPath)
         return 0, "", err
     }
 
+    if dupeMsg := hashNewImage(context.Background(), id, processedPath, finalFilename); dupeMsg != "" {
+        if warningMsg != "" {
+            warningMsg += "; "
+        }
+        warningMsg += dupeMsg
+    }
+
     return id, warningMsg, nil
 }
 
@@ -555,6 +983,7 @@ func uploadFromURLHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer resp.Body.Close()
+	contentType := resp.Header.Get("Content-Type")
 
 	var filename string
 	urlExt := filepath.Ext(parsedURL.Path)
@@ -571,77 +1000,140 @@ func uploadFromURLHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	id, warningMsg, err := processUpload(resp.Body, filename)
+	if err := checkDownloadContentType(contentType, filename); err != nil {
+		renderError(w, "Download rejected: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, warningMsg, err := processUpload(resp.Body, fileOrigin{Source: sourceURL, OriginalName: filename, URL: fileURL})
 	if err != nil {
 		renderError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	audit(r, "upload", fileTarget(id), fileURL)
 
 	redirectWithWarning(w, r, fmt.Sprintf("/file/%d", id), warningMsg)
 }
 
+// defaultViews are the pages that can be shown at / by the default_view setting
+var defaultViews = map[string]http.HandlerFunc{
+	"list":      listFilesHandler,
+	"dashboard": dashboardHandler,
+	"untagged":  untaggedFilesHandler,
+	"tags":      tagsHandler,
+}
+
+func homeHandler(w http.ResponseWriter, r *http.Request) {
+	if view, ok := defaultViews[config.DefaultView]; ok && r.URL.Path == "/" {
+		view(w, r)
+		return
+	}
+	listFilesHandler(w, r)
+}
+
 func listFilesHandler(w http.ResponseWriter, r *http.Request) {
-	// Get page number from query params
-	pageStr := r.URL.Query().Get("page")
-	page := 1
-	if pageStr != "" {
-		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-			page = p
-		}
+	perPage := pageSize(r)
+
+	sortBy, order, ok := listSort(r)
+	if !ok {
+		renderError(w, "Invalid sort, must be one of: newest, name", http.StatusBadRequest)
+		return
 	}
 
-	// Get per page from config
-	perPage := 50
-	if config.ItemsPerPage != "" {
-		if pp, err := strconv.Atoi(config.ItemsPerPage); err == nil && pp > 0 {
-			perPage = pp
-		}
+	sections, ok := listSections(r)
+	if !ok {
+		renderError(w, "Invalid show, must be one of: both, tagged, untagged", http.StatusBadRequest)
+		return
 	}
 
-	tagged, taggedTotal, _ := getTaggedFilesPaginated(page, perPage)
-	untagged, untaggedTotal, _ := getUntaggedFilesPaginated(page, perPage)
+	// Hidden sections are not queried. Each shown section is paged on its
+	// own; the untagged one takes ?page= when it is the only one.
+	untaggedParam := "page"
+	if sections.ShowTagged {
+		untaggedParam = untaggedPageParam
+	}
+	var tagged, untagged []File
+	var taggedPagination, untaggedPagination *Pagination
+	if sections.ShowTagged {
+		page := sectionPage(r, "page")
+		tagged, sections.TaggedCount, _ = getTaggedFilesPaginated(r.Context(), page, perPage, order)
+		taggedPagination = sectionPagination(r, "page", page, sections.TaggedCount, perPage)
+	}
+	if sections.ShowUntagged {
+		page := sectionPage(r, untaggedParam)
+		untagged, sections.UntaggedCount, _ = getUntaggedFilesPaginated(r.Context(), page, perPage, order)
+		untaggedPagination = sectionPagination(r, untaggedParam, page, sections.UntaggedCount, perPage)
+	}
 
-	// Use the larger total for pagination
-	total := taggedTotal
-	if untaggedTotal > total {
-		total = untaggedTotal
+	// The jump index follows the tagged files unless only untagged are shown
+	var jumpIndex []JumpLink
+	if sortBy == "name" {
+		from := `FROM files f JOIN file_tags ft ON ft.file_id = f.id WHERE 1=1`
+		if !sections.ShowTagged {
+			from = `FROM files f LEFT JOIN file_tags ft ON ft.file_id = f.id WHERE ft.file_id IS NULL`
+		}
+		var err error
+		if jumpIndex, err = getJumpIndex(r.Context(), from+privateFilter(r.Context()), nil, perPage); err != nil {
+			renderError(w, "Failed to build jump index", http.StatusInternalServerError)
+			return
+		}
 	}
 
-	pageData := buildPageDataWithPagination("File Browser", ListData{
+	pageData := buildPageData(r.Context(), "File Browser", ListData{
 		Tagged:      tagged,
 		Untagged:    untagged,
-		Breadcrumbs: []Breadcrumb{},
-	}, page, total, perPage)
+		TaggedPagination:   taggedPagination,
+		UntaggedPagination: untaggedPagination,
+		Breadcrumbs:        []Breadcrumb{},
+		Sort:               sortBy,
+		JumpIndex:          jumpIndex,
+		Sections:           sections,
+	})
+	// The jump index and sort links work on the section paged by ?page=
+	pageData.Pagination = taggedPagination
+	if !sections.ShowTagged {
+		pageData.Pagination = untaggedPagination
+	}
+	prepareGallery(&pageData, r, tagged, untagged)
 
 	renderTemplate(w, "list.html", pageData)
 }
 
 func untaggedFilesHandler(w http.ResponseWriter, r *http.Request) {
-	// Get page number from query params
-	pageStr := r.URL.Query().Get("page")
-	page := 1
-	if pageStr != "" {
-		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-			page = p
-		}
+	page, perPage := reportPage(r)
+
+	files, total, _ := getUntaggedFilesPaginated(r.Context(), page, perPage, listSorts["newest"])
+	pageData := buildPageDataWithPagination(r.Context(), "Untagged Files", files, page, total, perPage, r.URL.Query())
+	prepareGallery(&pageData, r, files)
+	renderTemplate(w, "untagged.html", pageData)
+}
+
+func untaggedNextHandler(w http.ResponseWriter, r *http.Request) {
+	strategy := r.URL.Query().Get("strategy")
+	if strategy == "" {
+		strategy = config.UntaggedNext
+	}
+	if _, ok := untaggedOrders[strategy]; !ok {
+		renderError(w, "Invalid strategy, must be one of: oldest, newest, random", http.StatusBadRequest)
+		return
 	}
 
-	// Get per page from config
-	perPage := 50
-	if config.ItemsPerPage != "" {
-		if pp, err := strconv.Atoi(config.ItemsPerPage); err == nil && pp > 0 {
-			perPage = pp
-		}
+	id, err := getNextUntaggedFile(r.Context(), strategy)
+	if err == errFileNotFound {
+		http.Redirect(w, r, "/untagged", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		renderError(w, "Failed to find next untagged file", http.StatusInternalServerError)
+		return
 	}
 
-	files, total, _ := getUntaggedFilesPaginated(page, perPage)
-	pageData := buildPageDataWithPagination("Untagged Files", files, page, total, perPage)
-	renderTemplate(w, "untagged.html", pageData)
+	http.Redirect(w, r, fmt.Sprintf("/file/%d", id), http.StatusSeeOther)
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		pageData := buildPageData("Add File", nil)
+		pageData := buildPageData(r.Context(), "Add File", nil)
 		renderTemplate(w, "add.html", pageData)
 		return
 	}
@@ -661,6 +1153,11 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	var warnings []string
 
+	var sidecars map[string]*multipart.FileHeader
+	if r.FormValue("apply_sidecars") == "on" {
+		files, sidecars = splitSidecarUploads(files)
+	}
+
 	// Process each file
 	for _, fileHeader := range files {
 		file, err := fileHeader.Open()
@@ -670,11 +1167,22 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer file.Close()
 
-		_, warningMsg, err := processUpload(file, fileHeader.Filename)
+		id, warningMsg, err := processUpload(file, fileOrigin{Source: sourceUpload, OriginalName: fileHeader.Filename})
 		if err != nil {
 			renderError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		audit(r, "upload", fileTarget(id), fileHeader.Filename)
+
+		if sidecars != nil {
+			tags, err := uploadedSidecarTags(sidecars, fileHeader.Filename)
+			if err == nil {
+				err = applySidecarTags(r.Context(), id, tags)
+			}
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s sidecar: %v", fileHeader.Filename, err))
+			}
+		}
 
 		if warningMsg != "" {
 			warnings = append(warnings, warningMsg)
@@ -704,6 +1212,9 @@ func checkFileConflictStrict(filename string) (string, string, error) {
 	} else if !os.IsNotExist(err) {
 		return "", "", fmt.Errorf("failed to check for existing file: %v", err)
 	}
+	if inArchive(filename) {
+		return "", "", fmt.Errorf("a file with that name already exists in the archive")
+	}
 	return filename, finalPath, nil
 }
 
@@ -725,6 +1236,31 @@ func getLocalIP() (string, error) {
 func fileRouter(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
 
+	// /api/file/{id} is the JSON version of the file page
+	if parts[1] == "api" {
+		if len(parts) == 4 {
+			apiFileHandler(w, r, parts[3])
+			return
+		}
+		if len(parts) == 5 && parts[4] == "tags" {
+			apiFileTagsHandler(w, r, parts[3])
+			return
+		}
+		if len(parts) >= 7 && parts[4] == "tags" {
+			apiFileTagRemoveHandler(w, r, parts[3])
+			return
+		}
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	// Private files are not found by logged-out visitors, so nothing below
+	// can change them either
+	if len(parts) >= 4 && hiddenFile(r.Context(), parts[2]) {
+		renderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
 	if len(parts) >= 4 && parts[3] == "delete" {
 		fileDeleteHandler(w, r, parts)
 		return
@@ -735,64 +1271,129 @@ func fileRouter(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(parts) >= 7 && parts[3] == "tag" {
-		tagActionHandler(w, r, parts)
+	if len(parts) >= 4 && (parts[3] == "archive" || parts[3] == "restore") {
+		fileArchiveHandler(w, r, parts)
 		return
 	}
 
-	fileHandler(w, r)
-}
-
-func fileDeleteHandler(w http.ResponseWriter, r *http.Request, parts []string) {
-	if r.Method != http.MethodPost {
-		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+	if len(parts) == 4 && parts[3] == "card.png" {
+		fileCardHandler(w, r, parts)
 		return
 	}
 
-	fileID := parts[2]
-
-	var currentFile File
-	err := db.QueryRow("SELECT id, filename, path FROM files WHERE id=?", fileID).Scan(&currentFile.ID, &currentFile.Filename, &currentFile.Path)
-	if err != nil {
-		renderError(w, "File not found", http.StatusNotFound)
+	if len(parts) >= 4 && (parts[3] == "private" || parts[3] == "public") {
+		filePrivateHandler(w, r, parts)
 		return
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		renderError(w, "Failed to start transaction", http.StatusInternalServerError)
+	if len(parts) >= 4 && parts[3] == "variants" {
+		fileVariantsHandler(w, r, parts)
 		return
 	}
-	defer tx.Rollback()
 
-	if _, err = tx.Exec("DELETE FROM file_tags WHERE file_id=?", fileID); err != nil {
-		renderError(w, "Failed to delete file tags", http.StatusInternalServerError)
+	if len(parts) >= 4 && parts[3] == "redownload" {
+		fileRedownloadHandler(w, r, parts)
 		return
 	}
 
-	if _, err = tx.Exec("DELETE FROM files WHERE id=?", fileID); err != nil {
-		renderError(w, "Failed to delete file record", http.StatusInternalServerError)
+	if len(parts) == 4 && parts[3] == "draft" {
+		fileDraftHandler(w, r, parts)
 		return
 	}
 
-	if err = tx.Commit(); err != nil {
-		renderError(w, "Failed to commit transaction", http.StatusInternalServerError)
+	if len(parts) >= 7 && parts[3] == "tag" {
+		tagActionHandler(w, r, parts)
 		return
 	}
 
-	if err = os.Remove(currentFile.Path); err != nil {
-		log.Printf("Warning: Failed to delete physical file %s: %v", currentFile.Path, err)
-	}
+	fileHandler(w, r)
+}
+
+func fileDeleteHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+		return
+	}
+
+	currentFile, err := deleteFile(r.Context(), parts[2])
+	if err == errFileNotFound {
+		renderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err == errPathNotAllowed {
+		renderError(w, "Refusing to delete a file outside the allowed directories", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		renderError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(r, "delete", fileTarget(parts[2]), currentFile.Filename)
+
+	http.Redirect(w, r, "/?deleted="+currentFile.Filename, http.StatusSeeOther)
+}
+
+// deleteFile removes a file's database row and tags, then its file, thumbnail
+// and preview sprite. A private file the context may not see is not found.
+func deleteFile(ctx context.Context, fileID string) (File, error) {
+	var currentFile File
+	var hash string
+	err := db.QueryRowContext(ctx, "SELECT f.id, f.filename, f.path, COALESCE(f.hash, '') FROM files f WHERE f.id=?"+privateFilter(ctx), fileID).Scan(&currentFile.ID, &currentFile.Filename, &currentFile.Path, &hash)
+	if err != nil {
+		return currentFile, errFileNotFound
+	}
+
+	if err := checkPathAllowed(currentFile.Path); err != nil {
+		return currentFile, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return currentFile, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM file_tags WHERE file_id=?", fileID); err != nil {
+		return currentFile, fmt.Errorf("failed to delete file tags: %v", err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM cbz_pages WHERE file_id=?", fileID); err != nil {
+		return currentFile, fmt.Errorf("failed to delete page notes: %v", err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM related_files WHERE file_id=? OR related_id=?", fileID, fileID); err != nil {
+		return currentFile, fmt.Errorf("failed to delete variant links: %v", err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM files WHERE id=?", fileID); err != nil {
+		return currentFile, fmt.Errorf("failed to delete file record: %v", err)
+	}
+
+	if err = autoPruneUnusedTags(ctx, tx); err != nil {
+		return currentFile, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return currentFile, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	invalidateCaches()
+
+	if err = os.Remove(currentFile.Path); err != nil {
+		log.Printf("Warning: Failed to delete physical file %s: %v", currentFile.Path, err)
+	}
 
-	// Delete thumbnail if it exists
+	// Delete thumbnail and preview sprite if they exist
 	thumbPath := filepath.Join(config.UploadDir, "thumbnails", currentFile.Filename+".jpg")
-	if _, err := os.Stat(thumbPath); err == nil {
-		if err := os.Remove(thumbPath); err != nil {
-			log.Printf("Warning: Failed to delete thumbnail %s: %v", thumbPath, err)
+	for _, p := range []string{thumbPath, spritePath(config.UploadDir, currentFile.Filename), hoverPreviewPath(config.UploadDir, currentFile.Filename), compactThumbnailPath(currentFile.Filename)} {
+		if _, err := os.Stat(p); err == nil {
+			if err := os.Remove(p); err != nil {
+				log.Printf("Warning: Failed to delete thumbnail %s: %v", p, err)
+			}
 		}
 	}
+	releaseSharedThumbnails(ctx, hash)
 
-	http.Redirect(w, r, "/?deleted="+currentFile.Filename, http.StatusSeeOther)
+	return currentFile, nil
 }
 
 func fileRenameHandler(w http.ResponseWriter, r *http.Request, parts []string) {
@@ -809,27 +1410,68 @@ func fileRenameHandler(w http.ResponseWriter, r *http.Request, parts []string) {
 		return
 	}
 
+	if err := renameFile(r.Context(), fileID, newFilename); err != nil {
+		switch err {
+		case errFileNotFound:
+			renderError(w, "File not found", http.StatusNotFound)
+		case errFileExists:
+			renderError(w, "A file with that name already exists", http.StatusConflict)
+		case errPathNotAllowed:
+			renderError(w, "Refusing to rename a file outside the allowed directories", http.StatusForbidden)
+		default:
+			renderError(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	audit(r, "rename", fileTarget(fileID), "renamed to "+newFilename)
+
+	http.Redirect(w, r, "/file/"+fileID, http.StatusSeeOther)
+}
+
+var (
+	errFileNotFound = errors.New("file not found")
+	errFileExists   = errors.New("a file with that name already exists")
+)
+
+// renameFile renames a file, its thumbnail and its database row. The row is
+// updated in a transaction that is only committed once the disk renames have
+// succeeded, and the disk renames are undone if anything fails.
+func renameFile(ctx context.Context, fileID, newFilename string) error {
 	var currentFilename, currentPath string
-	err := db.QueryRow("SELECT filename, path FROM files WHERE id=?", fileID).Scan(&currentFilename, &currentPath)
+	err := db.QueryRowContext(ctx, "SELECT filename, path FROM files WHERE id=?", fileID).Scan(&currentFilename, &currentPath)
 	if err != nil {
-		renderError(w, "File not found", http.StatusNotFound)
-		return
+		return errFileNotFound
 	}
 
 	if currentFilename == newFilename {
-		http.Redirect(w, r, "/file/"+fileID, http.StatusSeeOther)
-		return
+		return nil
+	}
+
+	if err := checkPathAllowed(currentPath); err != nil {
+		return err
 	}
 
-	newPath := filepath.Join(config.UploadDir, newFilename)
+	// Archived files are renamed in place in the archive directory
+	newPath := filepath.Join(filepath.Dir(currentPath), newFilename)
 	if _, err := os.Stat(newPath); !os.IsNotExist(err) {
-		renderError(w, "A file with that name already exists", http.StatusConflict)
-		return
+		return errFileExists
+	}
+	if _, err := os.Stat(filepath.Join(config.UploadDir, newFilename)); err == nil || inArchive(newFilename) {
+		return errFileExists
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE files SET filename=?, path=? WHERE id=?", newFilename, newPath, fileID); err != nil {
+		return fmt.Errorf("failed to update database: %v", err)
 	}
 
 	if err := os.Rename(currentPath, newPath); err != nil {
-		renderError(w, "Failed to rename physical file: "+err.Error(), http.StatusInternalServerError)
-		return
+		return fmt.Errorf("failed to rename physical file: %v", err)
 	}
 
 	thumbOld := filepath.Join(config.UploadDir, "thumbnails", currentFilename+".jpg")
@@ -838,36 +1480,85 @@ func fileRenameHandler(w http.ResponseWriter, r *http.Request, parts []string) {
 	if _, err := os.Stat(thumbOld); err == nil {
 		if err := os.Rename(thumbOld, thumbNew); err != nil {
 			os.Rename(newPath, currentPath)
-			renderError(w, "Failed to rename thumbnail: "+err.Error(), http.StatusInternalServerError)
-			return
+			return fmt.Errorf("failed to rename thumbnail: %v", err)
 		}
 	}
 
-	_, err = db.Exec("UPDATE files SET filename=?, path=? WHERE id=?", newFilename, newPath, fileID)
-	if err != nil {
+	spriteOld := spritePath(config.UploadDir, currentFilename)
+	spriteNew := spritePath(config.UploadDir, newFilename)
+	if _, err := os.Stat(spriteOld); err == nil {
+		if err := os.Rename(spriteOld, spriteNew); err != nil {
+			log.Printf("Warning: Failed to rename preview sprite %s: %v", spriteOld, err)
+		}
+	}
+
+	previewOld := hoverPreviewPath(config.UploadDir, currentFilename)
+	previewNew := hoverPreviewPath(config.UploadDir, newFilename)
+	if _, err := os.Stat(previewOld); err == nil {
+		if err := os.Rename(previewOld, previewNew); err != nil {
+			log.Printf("Warning: Failed to rename preview clip %s: %v", previewOld, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		os.Rename(newPath, currentPath)
 		if _, err := os.Stat(thumbNew); err == nil {
 			os.Rename(thumbNew, thumbOld)
 		}
-		renderError(w, "Failed to update database", http.StatusInternalServerError)
-		return
+		if _, err := os.Stat(spriteNew); err == nil {
+			os.Rename(spriteNew, spriteOld)
+		}
+		if _, err := os.Stat(previewNew); err == nil {
+			os.Rename(previewNew, previewOld)
+		}
+		return fmt.Errorf("failed to update database: %v", err)
 	}
+	invalidateCaches()
 
-	http.Redirect(w, r, "/file/"+fileID, http.StatusSeeOther)
+	// The compact preview is made again under the new name when next shown
+	os.Remove(compactThumbnailPath(currentFilename))
+
+	return nil
+}
+
+// parseCopyPrevious reports whether a tag value asks to copy a previous value,
+// "!" for the most recent or "!N" for N back, and how far back to look
+func parseCopyPrevious(value string) (int, bool) {
+	if value == "!" {
+		return 1, true
+	}
+	if !strings.HasPrefix(value, "!") {
+		return 0, false
+	}
+	back, err := strconv.Atoi(value[1:])
+	if err != nil || back < 1 {
+		return 0, false
+	}
+	return back, true
 }
 
-func getPreviousTagValue(category string, excludeFileID int) (string, error) {
+// getPreviousTagValue returns the value given to category on the file
+// tagged with it back files ago, other than excludeFileID, where 1 is the
+// most recent. Files are ordered by when they were last given a value in
+// the category, and a file given several counts once, with its latest.
+func getPreviousTagValue(ctx context.Context, category string, excludeFileID, back int) (string, error) {
 	var value string
-	err := db.QueryRow(`
+	err := db.QueryRowContext(ctx, `
 		SELECT t.value
-		FROM tags t
-		JOIN categories c ON c.id = t.category_id
-		JOIN file_tags ft ON ft.tag_id = t.id
-		JOIN files f ON f.id = ft.file_id
-		WHERE c.name = ? AND ft.file_id != ?
-		ORDER BY ft.rowid DESC
-		LIMIT 1
-	`, category, excludeFileID).Scan(&value)
+		FROM (
+			SELECT MAX(ft.rowid) AS last
+			FROM file_tags ft
+			JOIN tags t ON t.id = ft.tag_id
+			JOIN categories c ON c.id = t.category_id
+			JOIN files f ON f.id = ft.file_id
+			WHERE c.name = ? AND ft.file_id != ?`+privateFilter(ctx)+`
+			GROUP BY ft.file_id
+			ORDER BY last DESC
+			LIMIT 1 OFFSET ?
+		) recent
+		JOIN file_tags ft ON ft.rowid = recent.last
+		JOIN tags t ON t.id = ft.tag_id
+	`, category, excludeFileID, back-1).Scan(&value)
 
 	if err == sql.ErrNoRows {
 		return "", fmt.Errorf("no previous tag found for category: %s", category)
@@ -879,70 +1570,117 @@ func getPreviousTagValue(category string, excludeFileID int) (string, error) {
 	return value, nil
 }
 
+// getFileTags returns a file's tag values grouped by category
+func getFileTags(ctx context.Context, fileID int) (map[string][]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.name, t.value
+		FROM tags t
+		JOIN categories c ON c.id = t.category_id
+		JOIN file_tags ft ON ft.tag_id = t.id
+		WHERE ft.file_id=?
+		ORDER BY `+fileTagOrder, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string][]string)
+	for rows.Next() {
+		var cat, val string
+		if err := rows.Scan(&cat, &val); err != nil {
+			return nil, err
+		}
+		tags[cat] = append(tags[cat], val)
+	}
+	return tags, rows.Err()
+}
+
 func fileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	idStr := strings.TrimPrefix(r.URL.Path, "/file/")
 	if strings.Contains(idStr, "/") {
 		idStr = strings.SplitN(idStr, "/", 2)[0]
 	}
 
 	var f File
-	err := db.QueryRow("SELECT id, filename, path, COALESCE(description, '') as description FROM files WHERE id=?", idStr).Scan(&f.ID, &f.Filename, &f.Path, &f.Description)
+	err := db.QueryRowContext(ctx, "SELECT id, filename, path, COALESCE(description, '') as description, COALESCE(archived, 0), COALESCE(private, 0), COALESCE(source_url, '') FROM files WHERE id=?", idStr).Scan(&f.ID, &f.Filename, &f.Path, &f.Description, &f.Archived, &f.Private, &f.SourceURL)
 	if err != nil {
 		renderError(w, "File not found", http.StatusNotFound)
 		return
 	}
+	if f.Private && !showPrivate(ctx) {
+		requireLogin(w, r)
+		return
+	}
 
-	f.Tags = make(map[string][]string)
-	rows, _ := db.Query(`
-		SELECT c.name, t.value
-		FROM tags t
-		JOIN categories c ON c.id = t.category_id
-		JOIN file_tags ft ON ft.tag_id = t.id
-		WHERE ft.file_id=?`, f.ID)
-	for rows.Next() {
-		var cat, val string
-		rows.Scan(&cat, &val)
-		f.Tags[cat] = append(f.Tags[cat], val)
+	f.Tags, err = getFileTags(ctx, f.ID)
+	if err != nil {
+		renderError(w, "Failed to load tags", http.StatusInternalServerError)
+		return
 	}
-	rows.Close()
 
 	if r.Method == http.MethodPost {
 		if r.FormValue("action") == "update_description" {
 			description := r.FormValue("description")
-			if len(description) > 2048 {
-				description = description[:2048]
+			if len(description) > maxDescriptionLength {
+				description = description[:maxDescriptionLength]
 			}
 
-			if _, err := db.Exec("UPDATE files SET description = ? WHERE id = ?", description, f.ID); err != nil {
+			if _, err := db.ExecContext(ctx, "UPDATE files SET description = ?, description_draft = NULL WHERE id = ?", description, f.ID); err != nil {
 				renderError(w, "Failed to update description", http.StatusInternalServerError)
 				return
 			}
+			invalidateCaches()
+			http.Redirect(w, r, "/file/"+idStr, http.StatusSeeOther)
+			return
+		}
+		if r.FormValue("action") == "update_source_url" {
+			sourceURL := strings.TrimSpace(r.FormValue("source_url"))
+			if err := validateSourceURL(sourceURL); err != nil {
+				renderError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if _, err := db.ExecContext(ctx, "UPDATE files SET source_url = ? WHERE id = ?", sourceURL, f.ID); err != nil {
+				renderError(w, "Failed to update source URL", http.StatusInternalServerError)
+				return
+			}
+			invalidateCaches()
 			http.Redirect(w, r, "/file/"+idStr, http.StatusSeeOther)
 			return
 		}
 		cat := strings.TrimSpace(r.FormValue("category"))
 		val := strings.TrimSpace(r.FormValue("value"))
 		if cat != "" && val != "" {
-			originalVal := val
-			if val == "!" {
-				previousVal, err := getPreviousTagValue(cat, f.ID)
+			back, copied := parseCopyPrevious(val)
+			if copied {
+				previousVal, err := getPreviousTagValue(ctx, cat, f.ID, back)
 				if err != nil {
-					http.Redirect(w, r, "/file/"+idStr+"?error="+url.QueryEscape("No previous tag found for category: "+cat), http.StatusSeeOther)
+					switch config.CopyPreviousFallback {
+					case "ignore":
+						http.Redirect(w, r, "/file/"+idStr, http.StatusSeeOther)
+					case "prompt":
+						http.Redirect(w, r, "/file/"+idStr+"?prompt_category="+url.QueryEscape(cat), http.StatusSeeOther)
+					default:
+						http.Redirect(w, r, "/file/"+idStr+"?error="+url.QueryEscape("No previous tag found for category: "+cat), http.StatusSeeOther)
+					}
 					return
 				}
 				val = previousVal
 			}
-			_, tagID, err := getOrCreateCategoryAndTag(cat, val)
+			_, tagID, err := getOrCreateCategoryAndTag(ctx, cat, val)
 			if err != nil {
 				http.Redirect(w, r, "/file/"+idStr+"?error="+url.QueryEscape("Failed to create tag: "+err.Error()), http.StatusSeeOther)
 				return
 			}
-			_, err = db.Exec("INSERT OR IGNORE INTO file_tags(file_id, tag_id) VALUES (?, ?)", f.ID, tagID)
+			_, err = db.ExecContext(ctx, "INSERT OR IGNORE INTO file_tags(file_id, tag_id) VALUES (?, ?)", f.ID, tagID)
 			if err != nil {
 				http.Redirect(w, r, "/file/"+idStr+"?error="+url.QueryEscape("Failed to add tag: "+err.Error()), http.StatusSeeOther)
 				return
 			}
-			if originalVal == "!" {
+			invalidateCaches()
+			audit(r, "tag-add", fileTarget(f.ID), cat+":"+val)
+			if copied {
 				http.Redirect(w, r, "/file/"+idStr+"?success="+url.QueryEscape("Tag '"+cat+": "+val+"' copied from previous file"), http.StatusSeeOther)
 				return
 			}
@@ -951,75 +1689,156 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	catRows, _ := db.Query(`
+	var cats []string
+	catRows, err := db.QueryContext(ctx, `
 		SELECT DISTINCT c.name
 		FROM categories c
 		JOIN tags t ON t.category_id = c.id
 		JOIN file_tags ft ON ft.tag_id = t.id
 		ORDER BY c.name
 	`)
-	var cats []string
-	for catRows.Next() {
-		var c string
-		catRows.Scan(&c)
-		cats = append(cats, c)
+	if err != nil {
+		log.Printf("Warning: failed to load categories for file %d: %v", f.ID, err)
+	} else {
+		for catRows.Next() {
+			var c string
+			catRows.Scan(&c)
+			cats = append(cats, c)
+		}
+		catRows.Close()
+	}
+
+	variants, err := getFileVariants(ctx, f.ID)
+	if err != nil {
+		log.Printf("Warning: failed to load variants of file %d: %v", f.ID, err)
 	}
-	catRows.Close()
 
-	pageData := buildPageDataWithIP(f.Filename, struct {
+	var draft string
+	if config.DescriptionDrafts {
+		if draft, err = getDescriptionDraft(ctx, idStr); err != nil {
+			log.Printf("Warning: failed to load description draft of file %d: %v", f.ID, err)
+		}
+	}
+
+	pageData := buildPageDataWithIP(r.Context(), f.Filename, struct {
 		File            File
 		Categories      []string
 		EscapedFilename string
-	}{f, cats, url.PathEscape(f.Filename)})
+		Sprite          *SpriteInfo
+		PromptCategory  string
+		Variants        []File
+		Drafts          bool
+		Draft           string
+	}{f, cats, url.PathEscape(f.Filename), getSpriteInfo(config.UploadDir, f.Filename), r.URL.Query().Get("prompt_category"), variants, config.DescriptionDrafts, draft})
+	pageData.Compact = compactMode(r)
 
 	renderTemplate(w, "file.html", pageData)
 }
 
 func tagActionHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	ctx := r.Context()
 	fileID := parts[2]
 	cat := parts[4]
 	val := parts[5]
 	action := parts[6]
 
 	if action == "delete" && r.Method == http.MethodPost {
-		var tagID int
-		db.QueryRow(`
-			SELECT t.id
-			FROM tags t
-			JOIN categories c ON c.id=t.category_id
-			WHERE c.name=? AND t.value=?`, cat, val).Scan(&tagID)
-		if tagID != 0 {
-			db.Exec("DELETE FROM file_tags WHERE file_id=? AND tag_id=?", fileID, tagID)
+		if tagID, err := lookupTagID(ctx, cat, val); err == nil {
+			removed, err := removeFileTag(ctx, fileID, tagID)
+			if err != nil {
+				http.Redirect(w, r, "/file/"+fileID+"?error="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+				return
+			}
+			if removed {
+				invalidateCaches()
+				audit(r, "tag-remove", fileTarget(fileID), cat+":"+val)
+			}
+		}
+	}
+
+	if (action == "up" || action == "down") && r.Method == http.MethodPost {
+		delta := 1
+		if action == "up" {
+			delta = -1
+		}
+		if err := moveFileTag(ctx, fileID, cat, val, delta); err != nil {
+			http.Redirect(w, r, "/file/"+fileID+"?error="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+			return
 		}
 	}
 	http.Redirect(w, r, "/file/"+fileID, http.StatusSeeOther)
 }
 
+// lookupTagID returns the ID of the tag category:value, or sql.ErrNoRows
+// when there is no such tag
+func lookupTagID(ctx context.Context, category, value string) (int, error) {
+	var tagID int
+	err := db.QueryRowContext(ctx, `
+		SELECT t.id
+		FROM tags t
+		JOIN categories c ON c.id=t.category_id
+		WHERE c.name=? AND t.value=?`, category, value).Scan(&tagID)
+	return tagID, err
+}
+
+// removeFileTag removes a tag from a file, pruning unused tags if
+// configured, and reports whether the file had the tag
+func removeFileTag(ctx context.Context, fileID string, tagID int) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM file_tags WHERE file_id=? AND tag_id=?", fileID, tagID)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove tag: %v", err)
+	}
+	if err := autoPruneUnusedTags(ctx, tx); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// TagsPageData is the data for the tags page
+type TagsPageData struct {
+	Categories []TagCategory
+	Move       bool
+	Success    string
+	Error      string
+}
+
 func tagsHandler(w http.ResponseWriter, r *http.Request) {
-	pageData := buildPageData("All Tags", nil)
-	pageData.Data = pageData.Tags
+	pageData := buildPageData(r.Context(), "All Tags", nil)
+	pageData.Data = TagsPageData{
+		Categories: pageData.Tags,
+		Move:       r.URL.Query().Get("move") == "1",
+		Success:    r.URL.Query().Get("success"),
+		Error:      r.URL.Query().Get("error"),
+	}
 	renderTemplate(w, "tags.html", pageData)
 }
 
 func tagFilterHandler(w http.ResponseWriter, r *http.Request) {
-	pageStr := r.URL.Query().Get("page")
-	page := 1
-	if pageStr != "" {
-		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-			page = p
-		}
+	ctx := r.Context()
+	page, perPage := reportPage(r)
+
+	// The path is a category and value, each further one joined by
+	// /and/tag/ to require it or /not/tag/ to exclude it
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/tag/"), "/")
+	if len(segments) == 3 && segments[2] == "rename" {
+		tagRenameHandler(w, r, segments[0], segments[1])
+		return
 	}
-
-	perPage := 50
-	if config.ItemsPerPage != "" {
-		if pp, err := strconv.Atoi(config.ItemsPerPage); err == nil && pp > 0 {
-			perPage = pp
-		}
+	if len(segments) < 2 || (len(segments)-2)%4 != 0 {
+		renderError(w, "Invalid tag filter path", http.StatusBadRequest)
+		return
 	}
 
-	fullPath := strings.TrimPrefix(r.URL.Path, "/tag/")
-	tagPairs := strings.Split(fullPath, "/and/tag/")
-
 	breadcrumbs := []Breadcrumb{
 		{Name: "Home", URL: "/"},
 		{Name: "Tags", URL: "/tags"},
@@ -1028,9 +1847,19 @@ func tagFilterHandler(w http.ResponseWriter, r *http.Request) {
 	var filters []filter
 	currentPath := "/tag"
 
-	for i, pair := range tagPairs {
-		parts := strings.Split(pair, "/")
-		if len(parts) != 2 {
+	for i := 0; i < len(segments); {
+		joiner := ""
+		if i > 0 {
+			joiner = segments[i]
+			if (joiner != "and" && joiner != "not") || segments[i+1] != "tag" {
+				renderError(w, "Invalid tag filter path", http.StatusBadRequest)
+				return
+			}
+			i += 2
+		}
+		parts := segments[i : i+2]
+		i += 2
+		if parts[0] == "" || parts[1] == "" {
 			renderError(w, "Invalid tag filter path", http.StatusBadRequest)
 			return
 		}
@@ -1039,6 +1868,11 @@ func tagFilterHandler(w http.ResponseWriter, r *http.Request) {
 			Category:   parts[0],
 			Value:      parts[1],
 			IsPreviews: parts[1] == "previews",
+			Exclude:    joiner == "not",
+		}
+		if f.Exclude && f.IsPreviews {
+			renderError(w, "Previews cannot be excluded", http.StatusBadRequest)
+			return
 		}
 
 		// Expand with aliases (unless it's a special tag)
@@ -1049,10 +1883,10 @@ func tagFilterHandler(w http.ResponseWriter, r *http.Request) {
 		filters = append(filters, f)
 
 		// Build breadcrumb path incrementally
-		if i == 0 {
+		if joiner == "" {
 			currentPath += "/" + parts[0] + "/" + parts[1]
 		} else {
-			currentPath += "/and/tag/" + parts[0] + "/" + parts[1]
+			currentPath += "/" + joiner + "/tag/" + parts[0] + "/" + parts[1]
 		}
 
 		// Add category breadcrumb (only if it's the first occurrence)
@@ -1070,9 +1904,13 @@ func tagFilterHandler(w http.ResponseWriter, r *http.Request) {
 			})
 		}
 
-		// Add value breadcrumb
+		// Add value breadcrumb, marking an exclusion
+		name := strings.Title(parts[1])
+		if f.Exclude {
+			name = "Not " + name
+		}
 		breadcrumbs = append(breadcrumbs, Breadcrumb{
-			Name: strings.Title(parts[1]),
+			Name: name,
 			URL:  currentPath,
 		})
 	}
@@ -1088,7 +1926,7 @@ func tagFilterHandler(w http.ResponseWriter, r *http.Request) {
 
 	if hasPreviewFilter {
 		// Handle preview mode
-		files, err := getPreviewFiles(filters)
+		files, err := getPreviewFiles(ctx, filters)
 		if err != nil {
 			renderError(w, "Failed to fetch preview files", http.StatusInternalServerError)
 			return
@@ -1096,109 +1934,58 @@ func tagFilterHandler(w http.ResponseWriter, r *http.Request) {
 
 		var titleParts []string
 		for _, f := range filters {
-			titleParts = append(titleParts, fmt.Sprintf("%s: %s", f.Category, f.Value))
+			titleParts = append(titleParts, f.title())
 		}
 		title := "Tagged: " + strings.Join(titleParts, " + ")
 
-		pageData := buildPageDataWithPagination(title, ListData{
+		pageData := buildPageDataWithPagination(r.Context(), title, ListData{
 			Tagged:      files,
 			Untagged:    nil,
 			Breadcrumbs: []Breadcrumb{},
-		}, 1, len(files), len(files))
+		}, 1, len(files), max(len(files), 1), r.URL.Query())
 		pageData.Breadcrumbs = breadcrumbs
+		prepareGallery(&pageData, r, files)
 
 		renderTemplate(w, "list.html", pageData)
 		return
 	}
 
-	// Build count query (existing logic)
-	countQuery := `SELECT COUNT(DISTINCT f.id) FROM files f WHERE 1=1`
-	countArgs := []interface{}{}
+	sortBy, order, ok := listSort(r)
+	if !ok {
+		renderError(w, "Invalid sort, must be one of: newest, name", http.StatusBadRequest)
+		return
+	}
 
-	for _, f := range filters {
-		if f.Value == "unassigned" {
-			countQuery += `
-				AND NOT EXISTS (
-					SELECT 1
-					FROM file_tags ft
-					JOIN tags t ON ft.tag_id = t.id
-					JOIN categories c ON c.id = t.category_id
-					WHERE ft.file_id = f.id AND c.name = ?
-				)`
-			countArgs = append(countArgs, f.Category)
-		} else {
-			// Build OR clause for aliases
-			placeholders := make([]string, len(f.Values))
-			for i := range f.Values {
-				placeholders[i] = "?"
-			}
+	// Build the conditions shared by the count, list and jump index queries
+	from := `FROM files f WHERE 1=1` + privateFilter(ctx)
+	args := []interface{}{}
 
-			countQuery += fmt.Sprintf(`
-				AND EXISTS (
-					SELECT 1
-					FROM file_tags ft
-					JOIN tags t ON ft.tag_id = t.id
-					JOIN categories c ON c.id = t.category_id
-					WHERE ft.file_id = f.id AND c.name = ? AND t.value IN (%s)
-				)`, strings.Join(placeholders, ","))
-
-			countArgs = append(countArgs, f.Category)
-			for _, v := range f.Values {
-				countArgs = append(countArgs, v)
-			}
-		}
+	for _, f := range filters {
+		condition, conditionArgs := filterCondition(f)
+		from += condition
+		args = append(args, conditionArgs...)
 	}
 
 	var total int
-	err := db.QueryRow(countQuery, countArgs...).Scan(&total)
+	err := db.QueryRowContext(ctx, `SELECT COUNT(DISTINCT f.id) `+from, args...).Scan(&total)
 	if err != nil {
 		renderError(w, "Failed to count files", http.StatusInternalServerError)
 		return
 	}
 
-	// Build main query with pagination (existing logic)
-	query := `SELECT f.id, f.filename, f.path, COALESCE(f.description, '') as description FROM files f WHERE 1=1`
-	args := []interface{}{}
-
-	for _, f := range filters {
-		if f.Value == "unassigned" {
-			query += `
-				AND NOT EXISTS (
-					SELECT 1
-					FROM file_tags ft
-					JOIN tags t ON ft.tag_id = t.id
-					JOIN categories c ON c.id = t.category_id
-					WHERE ft.file_id = f.id AND c.name = ?
-				)`
-			args = append(args, f.Category)
-		} else {
-			// Build OR clause for aliases
-			placeholders := make([]string, len(f.Values))
-			for i := range f.Values {
-				placeholders[i] = "?"
-			}
-
-			query += fmt.Sprintf(`
-				AND EXISTS (
-					SELECT 1
-					FROM file_tags ft
-					JOIN tags t ON ft.tag_id = t.id
-					JOIN categories c ON c.id = t.category_id
-					WHERE ft.file_id = f.id AND c.name = ? AND t.value IN (%s)
-				)`, strings.Join(placeholders, ","))
-
-			args = append(args, f.Category)
-			for _, v := range f.Values {
-				args = append(args, v)
-			}
+	var jumpIndex []JumpLink
+	if sortBy == "name" {
+		if jumpIndex, err = getJumpIndex(ctx, from, args, perPage); err != nil {
+			renderError(w, "Failed to build jump index", http.StatusInternalServerError)
+			return
 		}
 	}
 
 	offset := (page - 1) * perPage
-	query += ` ORDER BY f.id DESC LIMIT ? OFFSET ?`
-	args = append(args, perPage, offset)
+	query := `SELECT f.id, f.filename, f.path, COALESCE(f.description, '') as description ` + from +
+		` ORDER BY ` + order + ` LIMIT ? OFFSET ?`
 
-	files, err := queryFilesWithTags(query, args...)
+	files, err := queryFilesWithTags(ctx, query, append(args, perPage, offset)...)
 	if err != nil {
 		renderError(w, "Failed to fetch files", http.StatusInternalServerError)
 		return
@@ -1206,22 +1993,31 @@ func tagFilterHandler(w http.ResponseWriter, r *http.Request) {
 
 	var titleParts []string
 	for _, f := range filters {
-		titleParts = append(titleParts, fmt.Sprintf("%s: %s", f.Category, f.Value))
+		titleParts = append(titleParts, f.title())
 	}
 	title := "Tagged: " + strings.Join(titleParts, ", ")
 
-	pageData := buildPageDataWithPagination(title, ListData{
+	var tag *filter
+	if len(filters) == 1 && !filters[0].Exclude && filters[0].Value != "unassigned" {
+		tag = &filters[0]
+	}
+
+	pageData := buildPageDataWithPagination(r.Context(), title, ListData{
 		Tagged:      files,
 		Untagged:    nil,
 		Breadcrumbs: []Breadcrumb{},
-	}, page, total, perPage)
+		Sort:        sortBy,
+		JumpIndex:   jumpIndex,
+		Tag:         tag,
+	}, page, total, perPage, r.URL.Query())
 	pageData.Breadcrumbs = breadcrumbs
+	prepareGallery(&pageData, r, files)
 
 	renderTemplate(w, "list.html", pageData)
 }
 
 // getPreviewFiles returns one representative file for each tag value in the specified category
-func getPreviewFiles(filters []filter) ([]File, error) {
+func getPreviewFiles(ctx context.Context, filters []filter) ([]File, error) {
 	// Find the preview filter category
 	var previewCategory string
 	for _, f := range filters {
@@ -1244,7 +2040,7 @@ func getPreviewFiles(filters []filter) ([]File, error) {
 		WHERE c.name = ?
 		ORDER BY t.value`
 
-	tagRows, err := db.Query(tagQuery, previewCategory)
+	tagRows, err := db.QueryContext(ctx, tagQuery, previewCategory)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query tag values: %w", err)
 	}
@@ -1270,7 +2066,7 @@ func getPreviewFiles(filters []filter) ([]File, error) {
 		// Build query for this specific tag value with all filters applied
 		query := `SELECT f.id, f.filename, f.path, COALESCE(f.description, '') as description
 			FROM files f
-			WHERE 1=1`
+			WHERE 1=1` + privateFilter(ctx)
 		args := []interface{}{}
 
 		// Apply all filters (including the preview category with this specific value)
@@ -1286,42 +2082,16 @@ func getPreviewFiles(filters []filter) ([]File, error) {
 						WHERE ft.file_id = f.id AND c.name = ? AND t.value = ?
 					)`
 				args = append(args, filter.Category, tagValue)
-			} else if filter.Value == "unassigned" {
-				query += `
-					AND NOT EXISTS (
-						SELECT 1
-						FROM file_tags ft
-						JOIN tags t ON ft.tag_id = t.id
-						JOIN categories c ON c.id = t.category_id
-						WHERE ft.file_id = f.id AND c.name = ?
-					)`
-				args = append(args, filter.Category)
 			} else {
-				// Normal filter with aliases
-				placeholders := make([]string, len(filter.Values))
-				for i := range filter.Values {
-					placeholders[i] = "?"
-				}
-
-				query += fmt.Sprintf(`
-					AND EXISTS (
-						SELECT 1
-						FROM file_tags ft
-						JOIN tags t ON ft.tag_id = t.id
-						JOIN categories c ON c.id = t.category_id
-						WHERE ft.file_id = f.id AND c.name = ? AND t.value IN (%s)
-					)`, strings.Join(placeholders, ","))
-
-				args = append(args, filter.Category)
-				for _, v := range filter.Values {
-					args = append(args, v)
-				}
+				condition, conditionArgs := filterCondition(filter)
+				query += condition
+				args = append(args, conditionArgs...)
 			}
 		}
 
 		query += ` ORDER BY f.id DESC LIMIT 1`
 
-		files, err := queryFilesWithTags(query, args...)
+		files, err := queryFilesWithTags(ctx, query, args...)
 		if err != nil {
 			return nil, fmt.Errorf("failed to query files for tag %s: %w", tagValue, err)
 		}
@@ -1336,13 +2106,44 @@ func getPreviewFiles(filters []filter) ([]File, error) {
 
 func loadConfig() error {
 	config = Config{
-		DatabasePath: "./database.db",
-		UploadDir:    "uploads",
-		ServerPort:   ":8080",
-		InstanceName: "Taggart",
-		GallerySize:  "400px",
-		ItemsPerPage: "100",
-		TagAliases:   []TagAliasGroup{},
+		DatabasePath:         "./database.db",
+		UploadDir:            "uploads",
+		ServerPort:           ":8080",
+		ReadHeaderTimeout:    10,
+		ReadTimeout:          60,
+		WriteTimeout:         120,
+		IdleTimeout:          120,
+		LongRequestTimeout:   3600,
+		InstanceName:         "Taggart",
+		GallerySize:          "400px",
+		ItemsPerPage:         "100",
+		MaxItemsPerPage:      defaultMaxItemsPerPage,
+		TitleFormat:          "{page} — {instance}",
+		GalleryMinWidth:      "200px",
+		GalleryMaxWidth:      "400px",
+		VideoExtensions:      defaultVideoExtensions,
+		ExportDir:            "export",
+		ExportMode:           "symlink",
+		YtdlpRetries:         3,
+		YtdlpBackoff:         5,
+		YtdlpFormat:          "mp4",
+		DefaultView:          "list",
+		ListSort:             "newest",
+		GalleryFields:        "",
+		HomeSections:         "both",
+		UntaggedNext:         "oldest",
+		CopyPreviousFallback: "error",
+		CORSOrigins:          []string{},
+		CORSMethods:          []string{"GET"},
+		CORSHeaders:          []string{"Content-Type"},
+		AllowedRoots:         []string{},
+		ScanIgnore:           defaultScanIgnore,
+		ArchiveDir:           "archive",
+		ThumbnailBackground:  "#ffffff",
+		ThumbnailMode:        "upload",
+		DuplicateThreshold:   5,
+		BulkOperation:        "add",
+		TagAliases:           []TagAliasGroup{},
 	}
 
 	if data, err := ioutil.ReadFile("config.json"); err == nil {
@@ -1351,9 +2152,68 @@ func loadConfig() error {
 		}
 	}
 
+	// An empty or null list would stop every video being treated as one
+	if len(config.VideoExtensions) == 0 {
+		log.Printf("Warning: video_extensions is empty, using the defaults")
+		config.VideoExtensions = defaultVideoExtensions
+	}
+	if err := validateExtensionList(config.VideoExtensions); err != nil {
+		return err
+	}
+
 	return os.MkdirAll(config.UploadDir, 0755)
 }
 
+var defaultVideoExtensions = []string{".mp4", ".mov", ".avi", ".mkv", ".webm", ".m4v"}
+
+// isVideoFile reports whether a filename has one of the configured video extensions
+func isVideoFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, videoExt := range config.VideoExtensions {
+		if ext == strings.ToLower(videoExt) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExtensionList splits a comma separated list of extensions, lowercasing each
+func parseExtensionList(list string) []string {
+	var exts []string
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext != "" {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+var cssLengthPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)(px|rem|em|vw|%)$`)
+
+// parseCSSLength splits a CSS length such as "200px" into its value and unit
+func parseCSSLength(length string) (float64, string, error) {
+	m := cssLengthPattern.FindStringSubmatch(length)
+	if m == nil {
+		return 0, "", fmt.Errorf("%q is not a valid length, use a value like 200px", length)
+	}
+	value, _ := strconv.ParseFloat(m[1], 64)
+	if value <= 0 {
+		return 0, "", fmt.Errorf("%q must be greater than zero", length)
+	}
+	return value, m[2], nil
+}
+
+// validateExtensionList checks every extension starts with a dot
+func validateExtensionList(exts []string) error {
+	for _, ext := range exts {
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+			return fmt.Errorf("extension %q must start with a dot", ext)
+		}
+	}
+	return nil
+}
+
 func saveConfig() error {
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
@@ -1375,6 +2235,137 @@ func validateConfig(newConfig Config) error {
 		return fmt.Errorf("server port must be in format ':8080'")
 	}
 
+	if newConfig.TitleFormat != "" && !strings.Contains(newConfig.TitleFormat, "{page}") {
+		return fmt.Errorf("title format must contain the {page} placeholder")
+	}
+
+	if len(newConfig.VideoExtensions) == 0 {
+		return fmt.Errorf("at least one video extension is required")
+	}
+	if err := validateExtensionList(newConfig.VideoExtensions); err != nil {
+		return err
+	}
+
+	minValue, minUnit, err := parseCSSLength(newConfig.GalleryMinWidth)
+	if err != nil {
+		return fmt.Errorf("gallery min width: %v", err)
+	}
+	maxValue, maxUnit, err := parseCSSLength(newConfig.GalleryMaxWidth)
+	if err != nil {
+		return fmt.Errorf("gallery max width: %v", err)
+	}
+	if minUnit == maxUnit && minValue > maxValue {
+		return fmt.Errorf("gallery min width cannot be larger than max width")
+	}
+
+	if newConfig.SlowQueryMs < 0 {
+		return fmt.Errorf("slow query threshold cannot be negative")
+	}
+
+	if newConfig.YtdlpRetries < 0 || newConfig.YtdlpRetries > 10 {
+		return fmt.Errorf("yt-dlp retries must be a number between 0 and 10")
+	}
+
+	if newConfig.YtdlpBackoff < 0 || newConfig.YtdlpBackoff > 300 {
+		return fmt.Errorf("yt-dlp backoff must be a number of seconds between 0 and 300")
+	}
+
+	if newConfig.YtdlpFormat == "" {
+		return fmt.Errorf("yt-dlp format cannot be empty")
+	}
+
+	if newConfig.YtdlpCookies != "" {
+		if _, err := os.Stat(newConfig.YtdlpCookies); err != nil {
+			return fmt.Errorf("yt-dlp cookies file not found: %v", err)
+		}
+	}
+
+	if _, ok := defaultViews[newConfig.DefaultView]; !ok {
+		return fmt.Errorf("default view must be one of: list, dashboard, untagged, tags")
+	}
+
+	if _, ok := listSorts[newConfig.ListSort]; !ok {
+		return fmt.Errorf("list sort must be one of: newest, name")
+	}
+
+	if _, err := parseGalleryFields(newConfig.GalleryFields); err != nil {
+		return err
+	}
+
+	if _, ok := homeSections[newConfig.HomeSections]; !ok {
+		return fmt.Errorf("home sections must be one of: both, tagged, untagged")
+	}
+
+	if _, ok := untaggedOrders[newConfig.UntaggedNext]; !ok {
+		return fmt.Errorf("next untagged file order must be one of: oldest, newest, random")
+	}
+
+	switch newConfig.CopyPreviousFallback {
+	case "error", "ignore", "prompt":
+	default:
+		return fmt.Errorf("copy previous fallback must be one of: error, ignore, prompt")
+	}
+
+	if err := validateCORSConfig(newConfig.CORSOrigins, newConfig.CORSMethods); err != nil {
+		return err
+	}
+
+	if err := validateAllowedRoots(newConfig.AllowedRoots); err != nil {
+		return err
+	}
+
+	if err := validateScanIgnore(newConfig.ScanIgnore); err != nil {
+		return err
+	}
+
+	if newConfig.ArchiveDir != "" && filepath.Clean(newConfig.ArchiveDir) == filepath.Clean(newConfig.UploadDir) {
+		return fmt.Errorf("archive directory must be different from the upload directory")
+	}
+
+	if newConfig.MaxImageDimension != 0 && (newConfig.MaxImageDimension < 64 || newConfig.MaxImageDimension > 65535) {
+		return fmt.Errorf("max image dimension must be 0 to disable or between 64 and 65535 pixels")
+	}
+
+	if _, err := parseHexColor(newConfig.ThumbnailBackground); err != nil {
+		return fmt.Errorf("invalid thumbnail background: %v", err)
+	}
+
+	if !thumbnailModes[newConfig.ThumbnailMode] {
+		return fmt.Errorf("thumbnail mode must be one of: upload, background, lazy")
+	}
+
+	if err := validateFallbackThumbnails(newConfig); err != nil {
+		return err
+	}
+
+	if err := validateDescriptionTemplate(newConfig.DescriptionTemplate); err != nil {
+		return fmt.Errorf("invalid description template: %v", err)
+	}
+
+	if newConfig.DuplicateThreshold < 0 || newConfig.DuplicateThreshold > 32 {
+		return fmt.Errorf("duplicate threshold must be between 0 and 32 bits")
+	}
+
+	if !bulkOperations[newConfig.BulkOperation] {
+		return fmt.Errorf("default bulk operation must be 'add' or 'remove'")
+	}
+
+	if err := validateTimeouts(newConfig); err != nil {
+		return err
+	}
+
+	if err := validatePageSizes(newConfig); err != nil {
+		return err
+	}
+
+	if newConfig.ExportDir == "" {
+		return fmt.Errorf("export directory cannot be empty")
+	}
+
+	if newConfig.ExportMode != "symlink" && newConfig.ExportMode != "copy" {
+		return fmt.Errorf("export mode must be 'symlink' or 'copy'")
+	}
+
 	if err := os.MkdirAll(newConfig.UploadDir, 0755); err != nil {
 		return fmt.Errorf("cannot create upload directory: %v", err)
 	}
@@ -1383,215 +2374,312 @@ func validateConfig(newConfig Config) error {
 }
 
 func adminHandler(w http.ResponseWriter, r *http.Request) {
-	// Get orphaned files
-	orphans, _ := getOrphanedFiles(config.UploadDir)
-
-	// Get video files for thumbnails
-	missingThumbnails, _ := getMissingThumbnailVideos()
-
 	switch r.Method {
 	case http.MethodPost:
 		action := r.FormValue("action")
 
 		switch action {
 		case "save", "":
-			handleSaveSettings(w, r, orphans, missingThumbnails)
+			handleSaveSettings(w, r)
 			return
 
 		case "backup":
-			err := backupDatabase(config.DatabasePath)
-			pageData := buildPageData("Admin", struct {
-				Config            Config
-				Error             string
-				Success           string
-				Orphans           []string
-				MissingThumbnails []VideoFile
-			}{
-				Config:            config,
-				Error:             errorString(err),
-				Success:           successString(err, "Database backup created successfully!"),
-				Orphans:           orphans,
-				MissingThumbnails: missingThumbnails,
+			_, err := backupDatabase(openDatabasePath)
+			pageData := buildPageData(r.Context(), "Admin", AdminData{
+				Config:  config,
+				Error:   errorString(err),
+				Success: successString(err, "Database backup created successfully!"),
 			})
 			renderTemplate(w, "admin.html", pageData)
 			return
 
+		case "maintenance":
+			handleMaintenance(w, r)
+			return
+
 		case "vacuum":
-			err := vacuumDatabase(config.DatabasePath)
-			pageData := buildPageData("Admin", struct {
-				Config            Config
-				Error             string
-				Success           string
-				Orphans           []string
-				MissingThumbnails []VideoFile
-			}{
-				Config:            config,
-				Error:             errorString(err),
-				Success:           successString(err, "Database vacuum completed successfully!"),
-				Orphans:           orphans,
-				MissingThumbnails: missingThumbnails,
+			err := vacuumDatabase(openDatabasePath)
+			pageData := buildPageData(r.Context(), "Admin", AdminData{
+				Config:  config,
+				Error:   errorString(err),
+				Success: successString(err, "Database vacuum completed successfully!"),
+			})
+			renderTemplate(w, "admin.html", pageData)
+			return
+
+		case "reindex":
+			msg, err := rebuildSearchIndex(r.Context())
+			pageData := buildPageData(r.Context(), "Admin", AdminData{
+				Config:  config,
+				Error:   errorString(err),
+				Success: msg,
 			})
 			renderTemplate(w, "admin.html", pageData)
 			return
 
 		case "save_aliases":
-			handleSaveAliases(w, r, orphans, missingThumbnails)
+			handleSaveAliases(w, r)
+			return
+
+		case "rename_preview", "rename_apply":
+			handleBulkRename(w, r)
+			return
+
+		case "export_tags":
+			handleExportTags(w, r)
+			return
+
+		case "scan_empty", "delete_empty":
+			handleEmptyFiles(w, r)
+			return
+
+		case "import_sidecars":
+			handleImportSidecars(w, r)
+			return
+
+		case "import_orphans":
+			handleImportOrphans(w, r)
+			return
+
+		case "check_paths":
+			handleCheckPaths(w, r)
+			return
+
+		case "move_tag":
+			handleMoveTag(w, r)
+			return
+
+		case "rename_category":
+			handleRenameCategory(w, r)
+			return
+
+		case "merge_tags":
+			handleMergeTags(w, r)
+			return
+
+		case "backfill_metadata":
+			startJob("backfill_metadata", backfillMetadata)
+			http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+			return
+
+		case "verify_thumbnails":
+			startJob("verify_thumbnails", verifyThumbnails)
+			http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+			return
+
+		case "generate_hover_previews":
+			startJob("generate_hover_previews", generateHoverPreviews)
+			http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+			return
+
+		case "prune_tags":
+			handlePruneTags(w, r)
+			return
+
+		case "export_tags_json":
+			handleExportTagsJSON(w, r)
+			return
+
+		case "import_tags_json":
+			handleImportTagsJSON(w, r)
 			return
 		}
 
 	default:
-		pageData := buildPageData("Admin", struct {
-			Config            Config
-			Error             string
-			Success           string
-			Orphans           []string
-			MissingThumbnails []VideoFile
-		}{
-			Config:            config,
-			Error:             "",
-			Success:           "",
-			Orphans:           orphans,
-			MissingThumbnails: missingThumbnails,
+		pageData := buildPageData(r.Context(), "Admin", AdminData{
+			Config:  config,
+			Error:   "",
+			Success: "",
 		})
 		renderTemplate(w, "admin.html", pageData)
 	}
 }
 
-func handleSaveAliases(w http.ResponseWriter, r *http.Request, orphans []string, missingThumbnails []VideoFile) {
+func handleSaveAliases(w http.ResponseWriter, r *http.Request) {
 	aliasesJSON := r.FormValue("aliases_json")
 
 	var aliases []TagAliasGroup
 	if aliasesJSON != "" {
 		if err := json.Unmarshal([]byte(aliasesJSON), &aliases); err != nil {
-			pageData := buildPageData("Admin", struct {
-				Config            Config
-				Error             string
-				Success           string
-				Orphans           []string
-				MissingThumbnails []VideoFile
-			}{
-				Config:            config,
-				Error:             "Invalid aliases JSON: " + err.Error(),
-				Success:           "",
-				Orphans:           orphans,
-				MissingThumbnails: missingThumbnails,
+			pageData := buildPageData(r.Context(), "Admin", AdminData{
+				Config:  config,
+				Error:   "Invalid aliases JSON: " + err.Error(),
+				Success: "",
 			})
 			renderTemplate(w, "admin.html", pageData)
 			return
 		}
 	}
 
-	config.TagAliases = aliases
+	cleaned, err := cleanTagAliases(aliases)
+	if err != nil {
+		submitted := config
+		submitted.TagAliases = aliases
+		pageData := buildPageData(r.Context(), "Admin", AdminData{
+			Config:  submitted,
+			Error:   "Invalid tag aliases: " + err.Error(),
+			Success: "",
+		})
+		renderTemplate(w, "admin.html", pageData)
+		return
+	}
+	unknown, err := unknownAliasTags(r.Context(), cleaned)
+	if err != nil {
+		log.Printf("Warning: could not check tag aliases against existing tags: %v", err)
+	}
+
+	config.TagAliases = cleaned
 
 	if err := saveConfig(); err != nil {
-		pageData := buildPageData("Admin", struct {
-			Config            Config
-			Error             string
-			Success           string
-			Orphans           []string
-			MissingThumbnails []VideoFile
-		}{
-			Config:            config,
-			Error:             "Failed to save configuration: " + err.Error(),
-			Success:           "",
-			Orphans:           orphans,
-			MissingThumbnails: missingThumbnails,
+		pageData := buildPageData(r.Context(), "Admin", AdminData{
+			Config:  config,
+			Error:   "Failed to save configuration: " + err.Error(),
+			Success: "",
 		})
 		renderTemplate(w, "admin.html", pageData)
 		return
 	}
+	audit(r, "config", "", "tag aliases saved")
 
-	pageData := buildPageData("Admin", struct {
-		Config            Config
-		Error             string
-		Success           string
-		Orphans           []string
-		MissingThumbnails []VideoFile
-	}{
-		Config:            config,
-		Error:             "",
-		Success:           "Tag aliases saved successfully!",
-		Orphans:           orphans,
-		MissingThumbnails: missingThumbnails,
+	success := "Tag aliases saved successfully!"
+	if len(unknown) > 0 {
+		success += " These values are not existing tags: " + strings.Join(unknown, ", ")
+	}
+	pageData := buildPageData(r.Context(), "Admin", AdminData{
+		Config:  config,
+		Error:   "",
+		Success: success,
 	})
 	renderTemplate(w, "admin.html", pageData)
 }
 
-func handleSaveSettings(w http.ResponseWriter, r *http.Request, orphans []string, missingThumbnails []VideoFile) {
+func handleSaveSettings(w http.ResponseWriter, r *http.Request) {
 	newConfig := Config{
-		DatabasePath: strings.TrimSpace(r.FormValue("database_path")),
-		UploadDir:    strings.TrimSpace(r.FormValue("upload_dir")),
-		ServerPort:   strings.TrimSpace(r.FormValue("server_port")),
-		InstanceName: strings.TrimSpace(r.FormValue("instance_name")),
-		GallerySize:  strings.TrimSpace(r.FormValue("gallery_size")),
-		ItemsPerPage: strings.TrimSpace(r.FormValue("items_per_page")),
-		TagAliases:   config.TagAliases, // Preserve existing aliases
+		DatabasePath:         strings.TrimSpace(r.FormValue("database_path")),
+		UploadDir:            strings.TrimSpace(r.FormValue("upload_dir")),
+		ServerPort:           strings.TrimSpace(r.FormValue("server_port")),
+		ReadHeaderTimeout:    formInt(r, "read_header_timeout_seconds"),
+		ReadTimeout:          formInt(r, "read_timeout_seconds"),
+		WriteTimeout:         formInt(r, "write_timeout_seconds"),
+		IdleTimeout:          formInt(r, "idle_timeout_seconds"),
+		LongRequestTimeout:   formInt(r, "long_request_timeout_seconds"),
+		SlowQueryMs:          formInt(r, "slow_query_ms"),
+		InstanceName:         strings.TrimSpace(r.FormValue("instance_name")),
+		GallerySize:          strings.TrimSpace(r.FormValue("gallery_size")),
+		ItemsPerPage:         strings.TrimSpace(r.FormValue("items_per_page")),
+		MaxItemsPerPage:      formInt(r, "max_items_per_page"),
+		TitleFormat:          strings.TrimSpace(r.FormValue("title_format")),
+		GalleryMinWidth:      strings.TrimSpace(r.FormValue("gallery_min_width")),
+		GalleryMaxWidth:      strings.TrimSpace(r.FormValue("gallery_max_width")),
+		VideoExtensions:      parseExtensionList(r.FormValue("video_extensions")),
+		ValidateUploads:      r.FormValue("validate_uploads") == "on",
+		LenientURLUploads:    r.FormValue("lenient_url_uploads") == "on",
+		ExportDir:            strings.TrimSpace(r.FormValue("export_dir")),
+		ExportMode:           r.FormValue("export_mode"),
+		YtdlpRetries:         formInt(r, "ytdlp_retries"),
+		YtdlpBackoff:         formInt(r, "ytdlp_backoff_seconds"),
+		YtdlpFormat:          strings.TrimSpace(r.FormValue("ytdlp_format")),
+		YtdlpCookies:         strings.TrimSpace(r.FormValue("ytdlp_cookies_file")),
+		DefaultView:          r.FormValue("default_view"),
+		ListSort:             r.FormValue("list_sort"),
+		GalleryFields:        strings.TrimSpace(r.FormValue("gallery_fields")),
+		HomeSections:         r.FormValue("home_sections"),
+		UntaggedNext:         r.FormValue("untagged_next"),
+		CopyPreviousFallback: r.FormValue("copy_previous_fallback"),
+		CORSOrigins:          parseList(r.FormValue("cors_allowed_origins")),
+		CORSMethods:          parseList(strings.ToUpper(r.FormValue("cors_allowed_methods"))),
+		CORSHeaders:          parseList(r.FormValue("cors_allowed_headers")),
+		AllowedRoots:         parseList(r.FormValue("allowed_roots")),
+		ScanIgnore:           parseList(r.FormValue("scan_ignore")),
+		ArchiveDir:           strings.TrimSpace(r.FormValue("archive_dir")),
+		MaxImageDimension:    formInt(r, "max_image_dimension"),
+		KeepOriginals:        r.FormValue("keep_originals") == "on",
+		AutoPruneTags:        r.FormValue("auto_prune_tags") == "on",
+		ThumbnailBackground:  strings.TrimSpace(r.FormValue("thumbnail_background")),
+		ThumbnailMode:        r.FormValue("thumbnail_mode"),
+		ThumbnailDedup:       r.FormValue("thumbnail_dedup") == "on",
+		HoverPreviews:        r.FormValue("hover_previews") == "on",
+		FallbackThumbnails:   fallbackThumbnailsFromForm(r),
+		DescriptionTemplate:  strings.TrimSpace(r.FormValue("description_template")),
+		DescriptionDrafts:    r.FormValue("description_drafts") == "on",
+		PerceptualHash:       r.FormValue("perceptual_hash") == "on",
+		DuplicateThreshold:   formInt(r, "duplicate_threshold"),
+		BulkOperation:        r.FormValue("bulk_default_operation"),
+		BulkRemember:         r.FormValue("bulk_remember") == "on",
+		AuditLog:             r.FormValue("audit_log") == "on",
+		AccessPassword:       config.AccessPassword,
+		TagAliases:           config.TagAliases, // Preserve existing aliases
+	}
+
+	// The password is never shown, so an empty field keeps it. Only a
+	// request that can already see private files may change it.
+	if showPrivate(r.Context()) {
+		if password := r.FormValue("access_password"); password != "" {
+			newConfig.AccessPassword = password
+		} else if r.FormValue("clear_access_password") == "on" {
+			newConfig.AccessPassword = ""
+		}
 	}
 
 	if err := validateConfig(newConfig); err != nil {
-		pageData := buildPageData("Admin", struct {
-			Config            Config
-			Error             string
-			Success           string
-			Orphans           []string
-			MissingThumbnails []VideoFile
-		}{
-			Config:            config,
-			Error:             err.Error(),
-			Success:           "",
-			Orphans:           orphans,
-			MissingThumbnails: missingThumbnails,
+		pageData := buildPageData(r.Context(), "Admin", AdminData{
+			Config:  config,
+			Error:   err.Error(),
+			Success: "",
 		})
 		renderTemplate(w, "admin.html", pageData)
 		return
 	}
 
 	needsRestart := (newConfig.DatabasePath != config.DatabasePath ||
-		newConfig.ServerPort != config.ServerPort)
+		newConfig.ServerPort != config.ServerPort ||
+		newConfig.ReadHeaderTimeout != config.ReadHeaderTimeout ||
+		newConfig.ReadTimeout != config.ReadTimeout ||
+		newConfig.WriteTimeout != config.WriteTimeout ||
+		newConfig.IdleTimeout != config.IdleTimeout)
+	wasAuditing := config.AuditLog
 
 	config = newConfig
 	if err := saveConfig(); err != nil {
-		pageData := buildPageData("Admin", struct {
-			Config            Config
-			Error             string
-			Success           string
-			Orphans           []string
-			MissingThumbnails []VideoFile
-		}{
-			Config:            config,
-			Error:             "Failed to save configuration: " + err.Error(),
-			Success:           "",
-			Orphans:           orphans,
-			MissingThumbnails: missingThumbnails,
+		pageData := buildPageData(r.Context(), "Admin", AdminData{
+			Config:  config,
+			Error:   "Failed to save configuration: " + err.Error(),
+			Success: "",
 		})
 		renderTemplate(w, "admin.html", pageData)
 		return
 	}
 
+	// Also record the change that turns the audit log off
+	if wasAuditing || config.AuditLog {
+		writeAudit(r, "config", "", "settings saved")
+	}
+
 	var message string
 	if needsRestart {
-		message = "Settings saved successfully! Please restart the server for database/port changes to take effect."
+		message = "Settings saved successfully! Please restart the server for database, port or timeout changes to take effect."
 	} else {
 		message = "Settings saved successfully!"
 	}
 
-	pageData := buildPageData("Admin", struct {
-		Config            Config
-		Error             string
-		Success           string
-		Orphans           []string
-		MissingThumbnails []VideoFile
-	}{
-		Config:            config,
-		Error:             "",
-		Success:           message,
-		Orphans:           orphans,
-		MissingThumbnails: missingThumbnails,
+	pageData := buildPageData(r.Context(), "Admin", AdminData{
+		Config:  config,
+		Error:   "",
+		Success: message,
 	})
 	renderTemplate(w, "admin.html", pageData)
 }
 
 
+// formInt parses an integer form field, returning -1 if it is missing or invalid
+func formInt(r *http.Request, name string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(r.FormValue(name)))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
 func errorString(err error) string {
 	if err != nil {
 		return err.Error()
@@ -1606,31 +2694,32 @@ func successString(err error, msg string) string {
 	return ""
 }
 
-func backupDatabase(dbPath string) error {
+func backupDatabase(dbPath string) (string, error) {
 	if dbPath == "" {
-		return fmt.Errorf("database path not configured")
+		return "", fmt.Errorf("database path not configured")
 	}
 
 	timestamp := time.Now().Format("20060102_150405")
 	backupPath := fmt.Sprintf("%s_backup_%s.db", strings.TrimSuffix(dbPath, filepath.Ext(dbPath)), timestamp)
-
-	input, err := os.Open(dbPath)
-	if err != nil {
-		return fmt.Errorf("failed to open database: %w", err)
+
+	if _, err := os.Stat(backupPath); err == nil {
+		return "", fmt.Errorf("backup file %s already exists", backupPath)
 	}
-	defer input.Close()
 
-	output, err := os.Create(backupPath)
+	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
-		return fmt.Errorf("failed to create backup file: %w", err)
+		return "", fmt.Errorf("failed to open database: %w", err)
 	}
-	defer output.Close()
+	defer db.Close()
 
-	if _, err := io.Copy(output, input); err != nil {
-		return fmt.Errorf("failed to copy database: %w", err)
+	// VACUUM INTO writes the backup from a single read transaction, so it is
+	// consistent even while other connections are writing, unlike copying
+	// the database file
+	if _, err := db.Exec("VACUUM INTO ?", backupPath); err != nil {
+		return "", fmt.Errorf("backup failed: %w", err)
 	}
 
-	return nil
+	return backupPath, nil
 }
 
 func vacuumDatabase(dbPath string) error {
@@ -1648,70 +2737,150 @@ func vacuumDatabase(dbPath string) error {
 	return nil
 }
 
+// rebuildSearchIndex rebuilds the indexes and query planner statistics for
+// the tables search reads, in one transaction, and drops cached tag data.
+// Search has no full-text table, so there is nothing else derived to rebuild.
+func rebuildSearchIndex(ctx context.Context) (string, error) {
+	start := time.Now()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	tables := []string{"files", "categories", "tags", "file_tags"}
+	counts := make([]string, len(tables))
+	for i, table := range tables {
+		if _, err := tx.ExecContext(ctx, "REINDEX "+table); err != nil {
+			return "", fmt.Errorf("REINDEX %s failed: %v", table, err)
+		}
+		var n int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&n); err != nil {
+			return "", fmt.Errorf("failed to count %s: %v", table, err)
+		}
+		counts[i] = fmt.Sprintf("%d %s", n, table)
+	}
+	if _, err := tx.ExecContext(ctx, "ANALYZE"); err != nil {
+		return "", fmt.Errorf("ANALYZE failed: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit: %v", err)
+	}
+	invalidateCaches()
+
+	return fmt.Sprintf("Search index rebuilt over %s in %s", strings.Join(counts, ", "), time.Since(start).Round(time.Millisecond)), nil
+}
+
 func ytdlpHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Redirect(w, r, "/upload", http.StatusSeeOther)
 		return
 	}
 
-	videoURL := r.FormValue("url")
+	videoURL := strings.TrimSpace(r.FormValue("url"))
 	if videoURL == "" {
 		renderError(w, "No URL provided", http.StatusBadRequest)
 		return
 	}
 
-	outTemplate := filepath.Join(config.UploadDir, "%(title)s.%(ext)s")
-	filenameCmd := exec.Command("yt-dlp", "--playlist-items", "1", "-f", "mp4", "-o", outTemplate, "--get-filename", videoURL)
-	filenameBytes, err := filenameCmd.Output()
+	parsedURL, err := url.ParseRequestURI(videoURL)
+	if err != nil || !(parsedURL.Scheme == "http" || parsedURL.Scheme == "https") {
+		renderError(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+
+	format, ok := ytdlpFormatFor(r.FormValue("quality"))
+	if !ok {
+		renderError(w, "Invalid quality selection", http.StatusBadRequest)
+		return
+	}
+	playlist := r.FormValue("playlist") == "on"
+
+	// yt-dlp writes into a private staging directory so odd titles cannot
+	// produce surprising paths in the upload directory, and so the files it
+	// actually wrote can be found even if they differ from --get-filename
+	stagingDir, err := os.MkdirTemp(config.UploadDir, ".ytdlp-")
 	if err != nil {
-		renderError(w, fmt.Sprintf("Failed to get filename: %v", err), http.StatusInternalServerError)
+		renderError(w, fmt.Sprintf("Failed to create staging directory: %v", err), http.StatusInternalServerError)
 		return
 	}
-	expectedFullPath := strings.TrimSpace(string(filenameBytes))
-	expectedFilename := filepath.Base(expectedFullPath)
+	defer os.RemoveAll(stagingDir)
 
-	finalFilename, finalPath, err := checkFileConflictStrict(expectedFilename)
+	outTemplate := filepath.Join(stagingDir, "%(title)s.%(ext)s")
+	filenameBytes, err := runYtdlp(r.Context(), true, ytdlpArgs(format, playlist, videoURL, "-o", outTemplate, "--get-filename")...)
 	if err != nil {
-		renderError(w, err.Error(), http.StatusConflict)
+		renderError(w, fmt.Sprintf("Failed to get filename: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	downloadCmd := exec.Command("yt-dlp", "--playlist-items", "1", "-f", "mp4", "-o", outTemplate, videoURL)
-	downloadCmd.Stdout = os.Stdout
-	downloadCmd.Stderr = os.Stderr
-	if err := downloadCmd.Run(); err != nil {
-		renderError(w, fmt.Sprintf("Failed to download video: %v", err), http.StatusInternalServerError)
+	var expectedNames []string
+	for _, line := range strings.Split(string(filenameBytes), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			expectedNames = append(expectedNames, sanitizeFilename(filepath.Base(line)))
+		}
+	}
+	if len(expectedNames) == 0 {
+		renderError(w, "yt-dlp did not report any files to download", http.StatusInternalServerError)
 		return
 	}
 
-	if expectedFullPath != finalPath {
-		if err := os.Rename(expectedFullPath, finalPath); err != nil {
-			renderError(w, fmt.Sprintf("Failed to move downloaded file: %v", err), http.StatusInternalServerError)
+	if !playlist {
+		if _, _, err := checkFileConflictStrict(expectedNames[0]); err != nil {
+			renderError(w, err.Error(), http.StatusConflict)
 			return
 		}
 	}
 
-	tempPath := finalPath + ".tmp"
-	if err := os.Rename(finalPath, tempPath); err != nil {
-		renderError(w, fmt.Sprintf("Failed to create temp file for processing: %v", err), http.StatusInternalServerError)
+	if _, err := runYtdlp(r.Context(), false, ytdlpArgs(format, playlist, videoURL, "-o", outTemplate)...); err != nil {
+		renderError(w, fmt.Sprintf("Failed to download video: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	processedPath, warningMsg, err := processVideoFile(tempPath, finalPath)
+	downloaded, err := getYtdlpDownloads(stagingDir, expectedNames)
 	if err != nil {
-		os.Remove(tempPath)
-		renderError(w, fmt.Sprintf("Failed to process video: %v", err), http.StatusInternalServerError)
+		renderError(w, fmt.Sprintf("Failed to read downloaded files: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(downloaded) == 0 {
+		renderError(w, "yt-dlp finished but no downloaded file was found", http.StatusInternalServerError)
 		return
 	}
 
-	id, err := saveFileToDatabase(finalFilename, processedPath)
-	if err != nil {
-		os.Remove(processedPath)
-		renderError(w, err.Error(), http.StatusInternalServerError)
+	if !playlist {
+		if _, _, err := checkFileConflictStrict(sanitizeFilename(filepath.Base(downloaded[0]))); err != nil {
+			renderError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		id, warningMsg, err := importYtdlpFile(downloaded[0], videoURL)
+		if err != nil {
+			renderError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(r, "upload", fileTarget(id), videoURL)
+		redirectWithWarning(w, r, fmt.Sprintf("/file/%d", id), warningMsg)
 		return
 	}
 
-	redirectWithWarning(w, r, fmt.Sprintf("/file/%d", id), warningMsg)
+	var warnings []string
+	for _, downloadedPath := range downloaded {
+		filename := sanitizeFilename(filepath.Base(downloadedPath))
+		if _, _, err := checkFileConflictStrict(filename); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", filename, err))
+			continue
+		}
+		id, warningMsg, err := importYtdlpFile(downloadedPath, videoURL)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", filename, err))
+			continue
+		}
+		audit(r, "upload", fileTarget(id), videoURL)
+		if warningMsg != "" {
+			warnings = append(warnings, warningMsg)
+		}
+	}
+
+	redirectWithWarning(w, r, "/untagged", strings.Join(warnings, "; "))
 }
 
 func parseFileIDRange(rangeStr string) ([]int, error) {
@@ -1768,7 +2937,7 @@ func parseFileIDRange(rangeStr string) ([]int, error) {
 	return result, nil
 }
 
-func validateFileIDs(fileIDs []int) ([]File, error) {
+func validateFileIDs(ctx context.Context, fileIDs []int) ([]File, error) {
 	if len(fileIDs) == 0 {
 		return nil, fmt.Errorf("no file IDs provided")
 	}
@@ -1783,7 +2952,7 @@ func validateFileIDs(fileIDs []int) ([]File, error) {
 	query := fmt.Sprintf("SELECT id, filename, path FROM files WHERE id IN (%s) ORDER BY id",
 		strings.Join(placeholders, ","))
 
-	rows, err := db.Query(query, args...)
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("database error: %v", err)
 	}
@@ -1816,36 +2985,56 @@ func validateFileIDs(fileIDs []int) ([]File, error) {
 	return files, nil
 }
 
-func applyBulkTagOperations(fileIDs []int, category, value, operation string) error {
+// BulkFileResult is what a bulk tag operation did to one file
+type BulkFileResult struct {
+	FileID  int    `json:"file_id"`
+	Changed bool   `json:"changed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// bulkModes are how a bulk tag operation treats a file it cannot change:
+// transactional changes nothing, best_effort changes the other files and
+// reports the ones that failed
+var bulkModes = map[string]bool{"transactional": true, "best_effort": true}
+
+// applyBulkTagOperations adds or removes a tag on every file, returning how
+// many file tags were added or removed and what happened to each file. A
+// file that is missing, hidden or cannot be changed fails the whole
+// operation unless bestEffort is set, when it is reported in its result and
+// the other files are still changed.
+func applyBulkTagOperations(ctx context.Context, fileIDs []int, category, value, operation string, bestEffort bool) (int64, []BulkFileResult, error) {
 	category = strings.TrimSpace(category)
 	value = strings.TrimSpace(value)
 	if category == "" {
-		return fmt.Errorf("category cannot be empty")
+		return 0, nil, fmt.Errorf("category cannot be empty")
+	}
+	if operation != "add" && operation != "remove" {
+		return 0, nil, fmt.Errorf("invalid operation: %s (must be 'add' or 'remove')", operation)
 	}
 
 	if operation == "add" && value == "" {
-		return fmt.Errorf("value cannot be empty when adding tags")
+		return 0, nil, fmt.Errorf("value cannot be empty when adding tags")
 	}
 
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to start transaction: %v", err)
+		return 0, nil, fmt.Errorf("failed to start transaction: %v", err)
 	}
 	defer tx.Rollback()
 
 	var catID int
-	err = tx.QueryRow("SELECT id FROM categories WHERE name=?", category).Scan(&catID)
+	err = tx.QueryRowContext(ctx, "SELECT id FROM categories WHERE name=?", category).Scan(&catID)
 	if err != nil && err != sql.ErrNoRows {
-		return fmt.Errorf("failed to query category: %v", err)
+		return 0, nil, fmt.Errorf("failed to query category: %v", err)
 	}
 
 	if catID == 0 {
 		if operation == "remove" {
-			return fmt.Errorf("cannot remove non-existent category: %s", category)
+			return 0, nil, fmt.Errorf("cannot remove non-existent category: %s", category)
 		}
-		res, err := tx.Exec("INSERT INTO categories(name) VALUES(?)", category)
+		res, err := tx.ExecContext(ctx, "INSERT INTO categories(name) VALUES(?)", category)
 		if err != nil {
-			return fmt.Errorf("failed to create category: %v", err)
+			return 0, nil, fmt.Errorf("failed to create category: %v", err)
 		}
 		cid, _ := res.LastInsertId()
 		catID = int(cid)
@@ -1853,42 +3042,76 @@ func applyBulkTagOperations(fileIDs []int, category, value, operation string) er
 
 	var tagID int
 	if value != "" {
-		err = tx.QueryRow("SELECT id FROM tags WHERE category_id=? AND value=?", catID, value).Scan(&tagID)
+		err = tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE category_id=? AND value=?", catID, value).Scan(&tagID)
 		if err != nil && err != sql.ErrNoRows {
-			return fmt.Errorf("failed to query tag: %v", err)
+			return 0, nil, fmt.Errorf("failed to query tag: %v", err)
 		}
 
 		if tagID == 0 {
 			if operation == "remove" {
-				return fmt.Errorf("cannot remove non-existent tag: %s=%s", category, value)
+				return 0, nil, fmt.Errorf("cannot remove non-existent tag: %s=%s", category, value)
 			}
-			res, err := tx.Exec("INSERT INTO tags(category_id, value) VALUES(?, ?)", catID, value)
+			res, err := tx.ExecContext(ctx, "INSERT INTO tags(category_id, value) VALUES(?, ?)", catID, value)
 			if err != nil {
-				return fmt.Errorf("failed to create tag: %v", err)
+				return 0, nil, fmt.Errorf("failed to create tag: %v", err)
 			}
 			tid, _ := res.LastInsertId()
 			tagID = int(tid)
 		}
 	}
 
+	var affected int64
+	results := make([]BulkFileResult, 0, len(fileIDs))
 	for _, fileID := range fileIDs {
-		if operation == "add" {
-			_, err = tx.Exec("INSERT OR IGNORE INTO file_tags(file_id, tag_id) VALUES (?, ?)", fileID, tagID)
-		} else if operation == "remove" {
-			if value != "" {
-				_, err = tx.Exec("DELETE FROM file_tags WHERE file_id=? AND tag_id=?", fileID, tagID)
-			} else {
-				_, err = tx.Exec(`DELETE FROM file_tags WHERE file_id=? AND tag_id IN (SELECT t.id FROM tags t WHERE t.category_id=?)`, fileID, catID)
+		n, err := applyBulkTagToFile(ctx, tx, fileID, catID, tagID, operation)
+		if err != nil {
+			if !bestEffort {
+				return 0, nil, fmt.Errorf("failed to %s tag for file %d: %v", operation, fileID, err)
 			}
-		} else {
-			return fmt.Errorf("invalid operation: %s (must be 'add' or 'remove')", operation)
+			results = append(results, BulkFileResult{FileID: fileID, Error: err.Error()})
+			continue
 		}
-		if err != nil {
-			return fmt.Errorf("failed to %s tag for file %d: %v", operation, fileID, err)
+		affected += n
+		results = append(results, BulkFileResult{FileID: fileID, Changed: n > 0})
+	}
+
+	if operation == "remove" {
+		if err := autoPruneUnusedTags(ctx, tx); err != nil {
+			return 0, nil, err
 		}
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return affected, results, nil
+}
+
+// applyBulkTagToFile adds or removes the tag on one file of a bulk
+// operation, or every tag of the category when tagID is 0, returning how
+// many file tags changed
+func applyBulkTagToFile(ctx context.Context, tx *sql.Tx, fileID, catID, tagID int, operation string) (int64, error) {
+	var exists int
+	err := tx.QueryRowContext(ctx, "SELECT 1 FROM files f WHERE f.id=?"+privateFilter(ctx), fileID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("file not found")
+	} else if err != nil {
+		return 0, err
+	}
+
+	var res sql.Result
+	switch {
+	case operation == "add":
+		res, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO file_tags(file_id, tag_id) VALUES (?, ?)", fileID, tagID)
+	case tagID != 0:
+		res, err = tx.ExecContext(ctx, "DELETE FROM file_tags WHERE file_id=? AND tag_id=?", fileID, tagID)
+	default:
+		res, err = tx.ExecContext(ctx, `DELETE FROM file_tags WHERE file_id=? AND tag_id IN (SELECT t.id FROM tags t WHERE t.category_id=?)`, fileID, catID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
 type BulkTagFormData struct {
@@ -1896,6 +3119,7 @@ type BulkTagFormData struct {
 	RecentFiles []File
 	Error       string
 	Success     string
+	Failures    []string
 	FormData    struct {
 		FileRange string
 		Category  string
@@ -1903,27 +3127,36 @@ type BulkTagFormData struct {
 		Operation string
 		TagQuery      string
 		SelectionMode string
+		BestEffort    bool
 	}
 }
 
-func getBulkTagFormData() BulkTagFormData {
-	catRows, _ := db.Query("SELECT name FROM categories ORDER BY name")
+func getBulkTagFormData(ctx context.Context) BulkTagFormData {
 	var cats []string
-	for catRows.Next() {
-		var c string
-		catRows.Scan(&c)
-		cats = append(cats, c)
+	catRows, err := db.QueryContext(ctx, "SELECT name FROM categories ORDER BY name")
+	if err != nil {
+		log.Printf("Warning: failed to load categories for bulk tag form: %v", err)
+	} else {
+		for catRows.Next() {
+			var c string
+			catRows.Scan(&c)
+			cats = append(cats, c)
+		}
+		catRows.Close()
 	}
-	catRows.Close()
 
-	recentRows, _ := db.Query("SELECT id, filename FROM files ORDER BY id DESC LIMIT 20")
 	var recentFiles []File
-	for recentRows.Next() {
-		var f File
-		recentRows.Scan(&f.ID, &f.Filename)
-		recentFiles = append(recentFiles, f)
+	recentRows, err := db.QueryContext(ctx, "SELECT id, filename FROM files f WHERE 1=1"+privateFilter(ctx)+" ORDER BY id DESC LIMIT 20")
+	if err != nil {
+		log.Printf("Warning: failed to load recent files for bulk tag form: %v", err)
+	} else {
+		for recentRows.Next() {
+			var f File
+			recentRows.Scan(&f.ID, &f.Filename)
+			recentFiles = append(recentFiles, f)
+		}
+		recentRows.Close()
 	}
-	recentRows.Close()
 
 	return BulkTagFormData{
 		Categories:  cats,
@@ -1935,36 +3168,41 @@ func getBulkTagFormData() BulkTagFormData {
 			Operation string
 			TagQuery      string
 			SelectionMode string
-		}{Operation: "add"},
+			BestEffort    bool
+		}{Operation: config.BulkOperation},
 	}
 }
 
 func bulkTagHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		formData := getBulkTagFormData()
-		pageData := buildPageData("Bulk Tag Editor", formData)
+		formData := getBulkTagFormData(r.Context())
+		restoreBulkForm(r, &formData)
+		pageData := buildPageData(r.Context(), "Bulk Tag Editor", formData)
 		renderTemplate(w, "bulk-tag.html", pageData)
 		return
 	}
 	if r.Method == http.MethodPost {
+		ctx := r.Context()
 		rangeStr := strings.TrimSpace(r.FormValue("file_range"))
 		tagQuery := strings.TrimSpace(r.FormValue("tag_query"))
 		selectionMode := r.FormValue("selection_mode")
 		category := strings.TrimSpace(r.FormValue("category"))
 		value := strings.TrimSpace(r.FormValue("value"))
 		operation := r.FormValue("operation")
+		bestEffort := r.FormValue("best_effort") == "on"
 
-		formData := getBulkTagFormData()
+		formData := getBulkTagFormData(ctx)
 		formData.FormData.FileRange = rangeStr
 		formData.FormData.TagQuery = tagQuery
 		formData.FormData.SelectionMode = selectionMode
 		formData.FormData.Category = category
 		formData.FormData.Value = value
 		formData.FormData.Operation = operation
+		formData.FormData.BestEffort = bestEffort
 
 		createErrorResponse := func(errorMsg string) {
 			formData.Error = errorMsg
-			pageData := buildPageData("Bulk Tag Editor", formData)
+			pageData := buildPageData(r.Context(), "Bulk Tag Editor", formData)
 			renderTemplate(w, "bulk-tag.html", pageData)
 		}
 
@@ -2002,7 +3240,7 @@ func bulkTagHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		} else if selectionMode == "tags" {
-			fileIDs, err = getFileIDsFromTagQuery(tagQuery)
+			fileIDs, err = getFileIDsFromTagQuery(ctx, tagQuery)
 			if err != nil {
 				createErrorResponse(fmt.Sprintf("Tag query error: %v", err))
 				return
@@ -2016,17 +3254,35 @@ func bulkTagHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		validFiles, err := validateFileIDs(fileIDs)
-		if err != nil {
+		// Best effort reports missing files with the others' results instead
+		validFiles, err := validateFileIDs(ctx, fileIDs)
+		if err != nil && !bestEffort {
 			createErrorResponse(fmt.Sprintf("File validation error: %v", err))
 			return
 		}
 
-		err = applyBulkTagOperations(fileIDs, category, value, operation)
+		_, results, err := applyBulkTagOperations(ctx, fileIDs, category, value, operation, bestEffort)
 		if err != nil {
 			createErrorResponse(fmt.Sprintf("Tag operation failed: %v", err))
 			return
 		}
+		failed := make(map[int]bool)
+		for _, res := range results {
+			if res.Error != "" {
+				failed[res.FileID] = true
+				formData.Failures = append(formData.Failures, fmt.Sprintf("File %d: %s", res.FileID, res.Error))
+			}
+		}
+		var changedFiles []File
+		for _, f := range validFiles {
+			if !failed[f.ID] {
+				changedFiles = append(changedFiles, f)
+			}
+		}
+		validFiles = changedFiles
+		invalidateCaches()
+		audit(r, "bulk", "tag:"+category+":"+value, fmt.Sprintf("%s on %d files", operation, len(validFiles)))
+		rememberBulkForm(w, operation, category)
 
 		// Build success message
 		var successMsg string
@@ -2055,14 +3311,16 @@ func bulkTagHandler(w http.ResponseWriter, r *http.Request) {
 		for _, f := range validFiles {
 			filenames = append(filenames, f.Filename)
 		}
-		if len(filenames) <= 5 {
+		if len(filenames) == 0 {
+			// Every file was skipped, and the failures say why
+		} else if len(filenames) <= 5 {
 			successMsg += fmt.Sprintf(": %s", strings.Join(filenames, ", "))
 		} else {
 			successMsg += fmt.Sprintf(": %s and %d more", strings.Join(filenames[:5], ", "), len(filenames)-5)
 		}
 
 		formData.Success = successMsg
-		pageData := buildPageData("Bulk Tag Editor", formData)
+		pageData := buildPageData(r.Context(), "Bulk Tag Editor", formData)
 		renderTemplate(w, "bulk-tag.html", pageData)
 		return
 	}
@@ -2074,56 +3332,39 @@ func bulkTagHandler(w http.ResponseWriter, r *http.Request) {
 //   - "colour:blue" (single tag)
 //   - "colour:blue,size:large" (multiple tags - AND logic)
 //   - "colour:blue OR colour:red" (OR logic)
-func getFileIDsFromTagQuery(query string) ([]int, error) {
-	query = strings.TrimSpace(query)
-	if query == "" {
-		return nil, fmt.Errorf("empty query")
+func getFileIDsFromTagQuery(ctx context.Context, query string) ([]int, error) {
+	operator, tags, err := parseTagQuery(query)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check if query contains OR operator
-	if strings.Contains(strings.ToUpper(query), " OR ") {
-		return getFileIDsFromORQuery(query)
+	if operator == "OR" {
+		// Query database for files matching ANY tag
+		return findFilesWithAnyTag(ctx, tags)
 	}
 
-	// Otherwise treat as AND query (comma-separated or single tag)
-	return getFileIDsFromANDQuery(query)
+	// Query database for files matching ALL tags
+	return findFilesWithAllTags(ctx, tags)
 }
 
-// getFileIDsFromANDQuery handles comma-separated tags (AND logic)
-func getFileIDsFromANDQuery(query string) ([]int, error) {
-	tagPairs := strings.Split(query, ",")
-	var tags []TagPair
-
-	for _, pair := range tagPairs {
-		pair = strings.TrimSpace(pair)
-		if pair == "" {
-			continue
-		}
-
-		parts := strings.SplitN(pair, ":", 2)
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid tag format '%s', expected 'category:value'", pair)
-		}
+var tagQueryORPattern = regexp.MustCompile(`(?i)\s+OR\s+`)
 
-		tags = append(tags, TagPair{
-			Category: strings.TrimSpace(parts[0]),
-			Value:    strings.TrimSpace(parts[1]),
-		})
+// parseTagQuery splits a tag query into its tags and whether they are
+// combined with AND (comma separated) or OR
+func parseTagQuery(query string) (string, []TagPair, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return "", nil, fmt.Errorf("empty query")
 	}
 
-	if len(tags) == 0 {
-		return nil, fmt.Errorf("no valid tags found in query")
+	operator := "AND"
+	tagPairs := strings.Split(query, ",")
+	if tagQueryORPattern.MatchString(query) {
+		operator = "OR"
+		tagPairs = tagQueryORPattern.Split(query, -1)
 	}
 
-	// Query database for files matching ALL tags
-	return findFilesWithAllTags(tags)
-}
-
-// getFileIDsFromORQuery handles OR-separated tags
-func getFileIDsFromORQuery(query string) ([]int, error) {
-	tagPairs := strings.Split(strings.ToUpper(query), " OR ")
 	var tags []TagPair
-
 	for _, pair := range tagPairs {
 		pair = strings.TrimSpace(pair)
 		if pair == "" {
@@ -2132,7 +3373,7 @@ func getFileIDsFromORQuery(query string) ([]int, error) {
 
 		parts := strings.SplitN(pair, ":", 2)
 		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid tag format '%s', expected 'category:value'", pair)
+			return "", nil, fmt.Errorf("invalid tag format '%s', expected 'category:value'", pair)
 		}
 
 		tags = append(tags, TagPair{
@@ -2142,21 +3383,20 @@ func getFileIDsFromORQuery(query string) ([]int, error) {
 	}
 
 	if len(tags) == 0 {
-		return nil, fmt.Errorf("no valid tags found in query")
+		return "", nil, fmt.Errorf("no valid tags found in query")
 	}
 
-	// Query database for files matching ANY tag
-	return findFilesWithAnyTag(tags)
+	return operator, tags, nil
 }
 
 // TagPair represents a category-value pair
 type TagPair struct {
-	Category string
-	Value    string
+	Category string `json:"category"`
+	Value    string `json:"value"`
 }
 
 // findFilesWithAllTags returns file IDs that have ALL the specified tags
-func findFilesWithAllTags(tags []TagPair) ([]int, error) {
+func findFilesWithAllTags(ctx context.Context, tags []TagPair) ([]int, error) {
 	if len(tags) == 0 {
 		return nil, fmt.Errorf("no tags specified")
 	}
@@ -2186,9 +3426,10 @@ func findFilesWithAllTags(tags []TagPair) ([]int, error) {
 	}
 
 	query += strings.Join(conditions, " AND ")
+	query += privateFilter(ctx)
 	query += " ORDER BY f.id"
 
-	rows, err := db.Query(query, args...)
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("database query failed: %w", err)
 	}
@@ -2207,7 +3448,7 @@ func findFilesWithAllTags(tags []TagPair) ([]int, error) {
 }
 
 // findFilesWithAnyTag returns file IDs that have ANY of the specified tags
-func findFilesWithAnyTag(tags []TagPair) ([]int, error) {
+func findFilesWithAnyTag(ctx context.Context, tags []TagPair) ([]int, error) {
 	if len(tags) == 0 {
 		return nil, fmt.Errorf("no tags specified")
 	}
@@ -2233,10 +3474,11 @@ func findFilesWithAnyTag(tags []TagPair) ([]int, error) {
 		argIndex += 2
 	}
 
-	query += strings.Join(conditions, " OR ")
+	query += "(" + strings.Join(conditions, " OR ") + ")"
+	query += privateFilter(ctx)
 	query += " ORDER BY f.id"
 
-	rows, err := db.Query(query, args...)
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("database query failed: %w", err)
 	}
@@ -2272,7 +3514,64 @@ func detectVideoCodec(filePath string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to probe video codec: %v", err)
 	}
-	return strings.TrimSpace(string(out)), nil
+	return parseCodecOutput(string(out)), nil
+}
+
+// parseCodecOutput picks the codec name out of ffprobe's output, which can be
+// empty, "N/A" or span several lines on unusual files. It returns the first
+// usable line, or "" when no codec could be read.
+func parseCodecOutput(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line == "" {
+			continue
+		}
+		if line == "n/a" || line == "unknown" {
+			return ""
+		}
+		return line
+	}
+	return ""
+}
+
+// VideoProbe holds the stream details ffprobe reports for a video
+type VideoProbe struct {
+	Codec    string
+	Width    int
+	Height   int
+	Duration float64
+}
+
+// probeVideo reads the codec, resolution and duration of a video's first stream
+func probeVideo(filePath string) (VideoProbe, error) {
+	var probe VideoProbe
+	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=codec_name,width,height:format=duration", "-of", "json", filePath)
+	out, err := cmd.Output()
+	if err != nil {
+		return probe, fmt.Errorf("failed to probe video: %v", err)
+	}
+
+	var result struct {
+		Streams []struct {
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return probe, fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+	if len(result.Streams) > 0 {
+		probe.Codec = result.Streams[0].CodecName
+		probe.Width = result.Streams[0].Width
+		probe.Height = result.Streams[0].Height
+	}
+	probe.Duration, _ = strconv.ParseFloat(result.Format.Duration, 64)
+	return probe, nil
 }
 
 func reencodeHEVCToH264(inputPath, outputPath string) error {
@@ -2285,9 +3584,13 @@ func reencodeHEVCToH264(inputPath, outputPath string) error {
 }
 
 func processVideoFile(tempPath, finalPath string) (string, string, error) {
+	// A video whose codec cannot be read is kept as it is rather than
+	// transcoded or rejected
 	codec, err := detectVideoCodec(tempPath)
 	if err != nil {
-		return "", "", err
+		log.Printf("Warning: %v, keeping %s without re-encoding", err, filepath.Base(finalPath))
+	} else if codec == "" {
+		log.Printf("Warning: could not determine the codec of %s, keeping it without re-encoding", filepath.Base(finalPath))
 	}
 
 	if codec == "hevc" || codec == "h265" {
@@ -2303,28 +3606,136 @@ func processVideoFile(tempPath, finalPath string) (string, string, error) {
 		return "", "", fmt.Errorf("failed to move file: %v", err)
 	}
 
-	ext := strings.ToLower(filepath.Ext(finalPath))
-	if ext == ".mp4" || ext == ".mov" || ext == ".avi" || ext == ".mkv" || ext == ".webm" || ext == ".m4v" {
-		if err := generateThumbnail(finalPath, config.UploadDir, filepath.Base(finalPath)); err != nil {
-			log.Printf("Warning: could not generate thumbnail: %v", err)
-		}
+	if isVideoFile(finalPath) {
+		uploadVideoThumbnails(finalPath)
 	}
 
 	return finalPath, "", nil
 }
 
-func saveFileToDatabase(filename, path string) (int64, error) {
-	res, err := db.Exec("INSERT INTO files (filename, path, description) VALUES (?, ?, '')", filename, path)
+func saveFileToDatabase(filename, path string, origin fileOrigin) (int64, error) {
+	var hash interface{}
+	if h, err := fileHash(path); err == nil {
+		hash = h
+	}
+	res, err := db.Exec("INSERT INTO files (filename, path, description, hash, source_url) VALUES (?, ?, ?, ?, ?)", filename, path, defaultDescription(origin), hash, origin.URL)
 	if err != nil {
 		return 0, fmt.Errorf("failed to save file to database: %v", err)
 	}
+	invalidateCaches()
 	id, err := res.LastInsertId()
 	if err != nil {
 		return 0, fmt.Errorf("failed to get inserted ID: %v", err)
 	}
+	if m, err := probeFileMetadata(path, filename); err == nil {
+		if err := storeFileMetadata(context.Background(), id, m); err != nil {
+			log.Printf("Warning: %v for %s", err, filename)
+		}
+	}
 	return id, nil
 }
 
+// initSchema creates the tables and adds any columns missing from a
+// database created by an older version
+func initSchema() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		filename TEXT,
+		path TEXT,
+		description TEXT DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS categories (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE COLLATE NOCASE
+	);
+	CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		category_id INTEGER,
+		value TEXT,
+		UNIQUE(category_id, value)
+	);
+	CREATE TABLE IF NOT EXISTS file_tags (
+		file_id INTEGER,
+		tag_id INTEGER,
+		UNIQUE(file_id, tag_id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+	if err := migrateCategoryCase(context.Background()); err != nil {
+		return err
+	}
+
+	if err := ensureColumn("files", "archived", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureColumn("file_tags", "position", "INTEGER"); err != nil {
+		return err
+	}
+	if err := ensureColumn("files", "hash", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn("files", "private", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureColumn("files", "phash", "INTEGER"); err != nil {
+		return err
+	}
+	if err := ensureColumn("files", "source_url", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureColumn("files", "description_draft", "TEXT"); err != nil {
+		return err
+	}
+	for _, c := range metadataColumns {
+		if err := ensureColumn("files", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+	// file_tags is only indexed by file through its UNIQUE constraint, so
+	// counting the files of a tag or category needs one by tag as well
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_file_tags_tag ON file_tags(tag_id)"); err != nil {
+		return err
+	}
+	if err := createAuditTable(); err != nil {
+		return err
+	}
+	if err := createRelatedFilesTable(); err != nil {
+		return err
+	}
+	return createCBZPagesTable()
+}
+
+// ensureColumn adds a column to a table created by an older version
+func ensureColumn(table, column, definition string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
 func getFilesOnDisk(uploadDir string) ([]string, error) {
 	entries, err := os.ReadDir(uploadDir)
 	if err != nil {
@@ -2332,7 +3743,7 @@ func getFilesOnDisk(uploadDir string) ([]string, error) {
 	}
 	var files []string
 	for _, e := range entries {
-		if !e.IsDir() {
+		if !ignoredOnDisk(e) {
 			files = append(files, e.Name())
 		}
 	}
@@ -2375,14 +3786,45 @@ func getOrphanedFiles(uploadDir string) ([]string, error) {
 	return orphans, nil
 }
 
+// reportPage returns the requested page number and page size
+func reportPage(r *http.Request) (int, int) {
+	page := 1
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		page = p
+	}
+	return page, pageSize(r)
+}
+
+// pageBounds returns the slice bounds of one page of total items
+func pageBounds(page, perPage, total int) (int, int) {
+	start := (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
 func orphansHandler(w http.ResponseWriter, r *http.Request) {
-	orphans, err := getOrphanedFiles(config.UploadDir)
+	orphans, err := orphansReport.get()
 	if err != nil {
 		renderError(w, "Error reading orphaned files", http.StatusInternalServerError)
 		return
 	}
 
-	pageData := buildPageData("Orphaned Files", orphans)
+	page, perPage := reportPage(r)
+	start, end := pageBounds(page, perPage, len(orphans))
+	data := struct {
+		Orphans []string
+		Total   int
+		Success string
+		Error   string
+	}{orphans[start:end], len(orphans), r.URL.Query().Get("success"), r.URL.Query().Get("error")}
+
+	pageData := buildPageDataWithPagination(r.Context(), "Orphaned Files", data, page, len(orphans), perPage, r.URL.Query())
 	renderTemplate(w, "orphans.html", pageData)
 }
 
@@ -2393,6 +3835,8 @@ func generateThumbnailAtTime(videoPath, uploadDir, filename, timestamp string) e
 	}
 
 	thumbPath := filepath.Join(thumbDir, filename+".jpg")
+	hash := thumbnailHash(videoPath)
+	unshareThumbnail(thumbPath)
 
 	cmd := exec.Command("ffmpeg", "-y", "-ss", timestamp, "-i", videoPath, "-vframes", "1", "-vf", "scale=400:-1", thumbPath)
 	cmd.Stdout = os.Stdout
@@ -2402,12 +3846,11 @@ func generateThumbnailAtTime(videoPath, uploadDir, filename, timestamp string) e
 		return fmt.Errorf("failed to generate thumbnail at %s: %v", timestamp, err)
 	}
 
+	shareThumbnail(hash, thumbPath, ".jpg")
 	return nil
 }
 
 func getVideoFiles() ([]VideoFile, error) {
-	videoExts := []string{".mp4", ".webm", ".mov", ".avi", ".mkv", ".m4v"}
-
 	rows, err := db.Query(`SELECT id, filename, path FROM files ORDER BY id DESC`)
 	if err != nil {
 		return nil, err
@@ -2421,17 +3864,7 @@ func getVideoFiles() ([]VideoFile, error) {
 			continue
 		}
 
-		// Check if it's a video file
-		isVideo := false
-		ext := strings.ToLower(filepath.Ext(v.Filename))
-		for _, vidExt := range videoExts {
-			if ext == vidExt {
-				isVideo = true
-				break
-			}
-		}
-
-		if !isVideo {
+		if !isVideoFile(v.Filename) {
 			continue
 		}
 
@@ -2466,30 +3899,32 @@ func getMissingThumbnailVideos() ([]VideoFile, error) {
 }
 
 func thumbnailsHandler(w http.ResponseWriter, r *http.Request) {
-	allVideos, err := getVideoFiles()
-	if err != nil {
-		renderError(w, "Failed to get video files: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	missing, err := getMissingThumbnailVideos()
+	missing, err := missingThumbnailsReport.get()
 	if err != nil {
 		renderError(w, "Failed to get video files: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	pageData := buildPageData("Thumbnail Management", struct {
-		AllVideos         []VideoFile
+	page, perPage := reportPage(r)
+	start, end := pageBounds(page, perPage, len(missing))
+	data := struct {
 		MissingThumbnails []VideoFile
+		Total             int
 		Error             string
 		Success           string
 	}{
-		AllVideos:         allVideos,
-		MissingThumbnails: missing,
+		MissingThumbnails: missing[start:end],
+		Total:             len(missing),
 		Error:             r.URL.Query().Get("error"),
 		Success:           r.URL.Query().Get("success"),
-	})
+	}
 
+	// Keep the status messages off the page links
+	params := r.URL.Query()
+	params.Del("error")
+	params.Del("success")
+
+	pageData := buildPageDataWithPagination(r.Context(), "Missing Thumbnails", data, page, len(missing), perPage, params)
 	renderTemplate(w, "thumbnails.html", pageData)
 }
 
@@ -2502,7 +3937,7 @@ func generateThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 	action := r.FormValue("action")
 	redirectTo := r.FormValue("redirect")
 	if redirectTo == "" {
-		redirectTo = "thumbnails"
+		redirectTo = "admin/thumbnails"
 	}
 
 	redirectBase := "/" + redirectTo
@@ -2515,6 +3950,12 @@ func generateThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		images, err := getMissingThumbnailImages()
+		if err != nil {
+			http.Redirect(w, r, redirectBase+"?error="+url.QueryEscape("Failed to get images: "+err.Error()), http.StatusSeeOther)
+			return
+		}
+
 		successCount := 0
 		var errors []string
 
@@ -2526,6 +3967,14 @@ func generateThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 				successCount++
 			}
 		}
+		for _, f := range images {
+			if err := generateImageThumbnail(f.Path, config.UploadDir, f.Filename); err != nil {
+				errors = append(errors, fmt.Sprintf("%s: %v", f.Filename, err))
+			} else {
+				successCount++
+			}
+		}
+		missingThumbnailsReport.Invalidate()
 
 		if len(errors) > 0 {
 			http.Redirect(w, r, redirectBase+"?success="+url.QueryEscape(fmt.Sprintf("Generated %d thumbnails", successCount))+"&error="+url.QueryEscape(fmt.Sprintf("Failed: %s", strings.Join(errors, "; "))), http.StatusSeeOther)
@@ -2542,7 +3991,7 @@ func generateThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		var filename, path string
-		err := db.QueryRow("SELECT filename, path FROM files WHERE id=?", fileID).Scan(&filename, &path)
+		err := db.QueryRowContext(r.Context(), "SELECT filename, path FROM files WHERE id=?", fileID).Scan(&filename, &path)
 		if err != nil {
 			http.Redirect(w, r, redirectBase+"?error="+url.QueryEscape("File not found"), http.StatusSeeOther)
 			return
@@ -2553,13 +4002,31 @@ func generateThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, redirectBase+"?error="+url.QueryEscape("Failed to generate thumbnail: "+err.Error()), http.StatusSeeOther)
 			return
 		}
+		missingThumbnailsReport.Invalidate()
 
-		if redirectTo == "admin" {
-			http.Redirect(w, r, "/admin?success="+url.QueryEscape(fmt.Sprintf("Thumbnail generated for file %s at %s", fileID, timestamp)), http.StatusSeeOther)
+		if strings.HasPrefix(redirectTo, "admin") {
+			http.Redirect(w, r, redirectBase+"?success="+url.QueryEscape(fmt.Sprintf("Thumbnail generated for file %s at %s", fileID, timestamp)), http.StatusSeeOther)
 		} else {
 			http.Redirect(w, r, fmt.Sprintf("/file/%s?success=%s", fileID, url.QueryEscape(fmt.Sprintf("Thumbnail generated at %s", timestamp))), http.StatusSeeOther)
 		}
 
+	case "generate_sprite":
+		fileID := r.FormValue("file_id")
+
+		var filename, path string
+		err := db.QueryRowContext(r.Context(), "SELECT filename, path FROM files WHERE id=?", fileID).Scan(&filename, &path)
+		if err != nil {
+			http.Redirect(w, r, redirectBase+"?error="+url.QueryEscape("File not found"), http.StatusSeeOther)
+			return
+		}
+
+		if err := generateVideoSprite(path, config.UploadDir, filename); err != nil {
+			http.Redirect(w, r, redirectBase+"?error="+url.QueryEscape("Failed to generate preview sprite: "+err.Error()), http.StatusSeeOther)
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/file/%s?success=%s", fileID, url.QueryEscape("Preview sprite generated")), http.StatusSeeOther)
+
 	default:
 		http.Redirect(w, r, redirectBase, http.StatusSeeOther)
 	}
@@ -2572,6 +4039,11 @@ func generateThumbnail(videoPath, uploadDir, filename string) error {
 	}
 
 	thumbPath := filepath.Join(thumbDir, filename+".jpg")
+	hash := thumbnailHash(videoPath)
+	if linkSharedThumbnail(hash, thumbPath, ".jpg") {
+		return nil
+	}
+	unshareThumbnail(thumbPath)
 
 	cmd := exec.Command("ffmpeg", "-y", "-ss", "00:00:05", "-i", videoPath, "-vframes", "1", "-vf", "scale=400:-1", thumbPath)
 	cmd.Stdout = os.Stdout
@@ -2586,5 +4058,6 @@ func generateThumbnail(videoPath, uploadDir, filename string) error {
 		}
 	}
 
+	shareThumbnail(hash, thumbPath, ".jpg")
 	return nil
 }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestDB opens an empty library in a temporary directory as the global
+// database, with the default config, restoring both when the test ends
+func newTestDB(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	oldDB, oldConfig := db, config
+	t.Chdir(dir)
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config.DatabasePath = filepath.Join(dir, "test.db")
+
+	var err error
+	db, err = sql.Open(timedDriverName, config.DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initSchema(); err != nil {
+		t.Fatal(err)
+	}
+	invalidateCaches()
+
+	t.Cleanup(func() {
+		db.Close()
+		db, config = oldDB, oldConfig
+		invalidateCaches()
+	})
+}
+
+// stubTemplate replaces the page templates with a single one named name,
+// so a test can render just the page data it checks
+func stubTemplate(t *testing.T, name, text string) {
+	t.Helper()
+
+	old := tmpl
+	tmpl = template.Must(template.New(name).Parse(text))
+	t.Cleanup(func() { tmpl = old })
+}
+
+// addTestFile adds a file with the given category:value tags, in order,
+// returning its id
+func addTestFile(t *testing.T, filename string, tags ...[2]string) int {
+	t.Helper()
+
+	ctx := context.Background()
+	res, err := db.ExecContext(ctx, "INSERT INTO files(filename, path) VALUES (?, ?)", filename, filepath.Join(config.UploadDir, filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	for _, tag := range tags {
+		tagTestFile(t, int(id), tag[0], tag[1])
+	}
+	return int(id)
+}
+
+// tagTestFile gives a file the tag category:value
+func tagTestFile(t *testing.T, fileID int, category, value string) {
+	t.Helper()
+
+	ctx := context.Background()
+	_, tagID, err := getOrCreateCategoryAndTag(ctx, category, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO file_tags(file_id, tag_id) VALUES (?, ?)", fileID, tagID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchOrderIsRepeatable(t *testing.T) {
+	newTestDB(t)
+	ctx := context.Background()
+
+	// Same names and same scores leave only the tie-breaks to order by
+	for i := 0; i < 3; i++ {
+		id := addTestFile(t, "blue.jpg", [2]string{"colour", "blue"}, [2]string{"size", "big"})
+		tagTestFile(t, id, "colour", fmt.Sprintf("blue%d", i))
+		addTestFile(t, fmt.Sprintf("sky%d.jpg", i), [2]string{"colour", "blue"})
+	}
+	addTestFile(t, "ocean.jpg", [2]string{"mood", "blue"}, [2]string{"colour", "green"})
+
+	for sortBy := range searchSorts {
+		first, err := searchFiles(ctx, "blue", sortBy)
+		if err != nil {
+			t.Fatalf("sort %s: %v", sortBy, err)
+		}
+		if len(first) != 7 {
+			t.Fatalf("sort %s: found %d files, want 7", sortBy, len(first))
+		}
+		second, err := searchFiles(ctx, "blue", sortBy)
+		if err != nil {
+			t.Fatalf("sort %s: %v", sortBy, err)
+		}
+		if !reflect.DeepEqual(first, second) {
+			t.Errorf("sort %s: repeated search differs:\n%+v\n%+v", sortBy, first, second)
+		}
+		if sortBy == "name" {
+			for i := 1; i < 3; i++ {
+				if first[i].ID <= first[i-1].ID {
+					t.Errorf("sort name: files named alike are not ordered by id: %d before %d", first[i-1].ID, first[i].ID)
+				}
+			}
+		}
+	}
+}
+
+func TestParseCodecOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want string
+	}{
+		{"plain", "h264\n", "h264"},
+		{"empty", "", ""},
+		{"blank lines", "\n  \n\t\n", ""},
+		{"crlf", "hevc\r\n", "hevc"},
+		{"multi-line", "h264\nh264\n", "h264"},
+		{"leading blank line", "\nvp9\n", "vp9"},
+		{"n/a", "N/A\n", ""},
+		{"unknown", "unknown\n", ""},
+		{"upper case", "H264\n", "h264"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseCodecOutput(tt.out); got != tt.want {
+				t.Errorf("parseCodecOutput(%q) = %q, want %q", tt.out, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListFilesUntaggedPagination(t *testing.T) {
+	newTestDB(t)
+	stubTemplate(t, "list.html", "{{.Data.Sections.TaggedCount}} {{with .Data.TaggedPagination}}{{.TotalPages}}{{else}}-{{end}} "+
+		"{{.Data.Sections.UntaggedCount}} {{.Data.UntaggedPagination.TotalPages}} {{len .Data.Untagged}}")
+
+	for i := 0; i < 5; i++ {
+		addTestFile(t, fmt.Sprintf("tagged%d.jpg", i), [2]string{"colour", "blue"})
+	}
+	for i := 0; i < 200; i++ {
+		addTestFile(t, fmt.Sprintf("untagged%d.jpg", i))
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// 200 untagged files at 50 a page are 4 pages, whatever the tagged section holds
+		{"?per_page=50", "5 1 200 4 50"},
+		{"?per_page=50&untagged_page=4", "5 1 200 4 50"},
+		{"?per_page=30&untagged_page=7", "5 1 200 7 20"},
+		{"?per_page=50&show=untagged&page=2", "0 - 200 4 50"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		listFilesHandler(w, httptest.NewRequest("GET", "/"+tt.query, nil))
+		if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+			t.Errorf("GET /%s = %q, want %q (tagged count, tagged pages, untagged count, untagged pages, untagged shown)", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSearchHandlerIsRepeatable(t *testing.T) {
+	newTestDB(t)
+	stubTemplate(t, "search.html", "{{range .Files}}{{.ID}} {{.Filename}} {{.Tags}}\n{{end}}"+
+		"{{range .Data.Pages}}page {{.FileID}} {{.Page}}\n{{end}}")
+
+	var comics []int
+	for i := 0; i < 3; i++ {
+		addTestFile(t, "blue.jpg", [2]string{"colour", "blue"}, [2]string{"colour", fmt.Sprintf("navy%d", i)})
+		comics = append(comics, addTestFile(t, "comic.cbz"))
+	}
+	for i := len(comics) - 1; i >= 0; i-- {
+		if err := saveCBZPageNote(context.Background(), CBZPageNote{FileID: comics[i], Page: 0, Note: "blue sky"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func() string {
+		w := httptest.NewRecorder()
+		searchHandler(w, httptest.NewRequest("GET", "/search?q=blue", nil))
+		return w.Body.String()
+	}
+	first := search()
+	for i := 0; i < 5; i++ {
+		if got := search(); got != first {
+			t.Fatalf("repeated search differs:\n%s\nthen:\n%s", first, got)
+		}
+	}
+
+	want := fmt.Sprintf("page %d 0\npage %d 0\npage %d 0\n", comics[0], comics[1], comics[2])
+	if !strings.HasSuffix(first, want) {
+		t.Errorf("pages of files named alike are not in id order:\n%s", first)
+	}
+}
+
+func TestSearchTagAliases(t *testing.T) {
+	newTestDB(t)
+	ctx := context.WithValue(context.Background(), visibilityKey{}, true)
+	config.TagAliases = []TagAliasGroup{{Category: "colour", Aliases: []string{"cyan", "teal"}}}
+
+	addTestFile(t, "a.jpg", [2]string{"colour", "cyan"})
+	addTestFile(t, "b.jpg", [2]string{"colour", "teal"})
+	addTestFile(t, "c.jpg", [2]string{"colour", "red"})
+
+	found := func(query string) []string {
+		t.Helper()
+		files, err := searchFiles(ctx, query, "name")
+		if err != nil {
+			t.Fatalf("search %q: %v", query, err)
+		}
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Filename)
+		}
+		return names
+	}
+
+	want := "a.jpg b.jpg"
+	for _, query := range []string{"cyan", "teal", "TEAL"} {
+		if got := strings.Join(found(query), " "); got != want {
+			t.Errorf("search %q = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestGetPreviousTagValueCountsFiles(t *testing.T) {
+	newTestDB(t)
+	ctx := context.WithValue(context.Background(), visibilityKey{}, true)
+
+	// a.jpg is given two artists, so it holds two of the latest rows but is
+	// still only one file back
+	addTestFile(t, "first.jpg", [2]string{"artist", "Ann"})
+	a := addTestFile(t, "a.jpg")
+	tagTestFile(t, a, "artist", "Bo")
+	addTestFile(t, "b.jpg", [2]string{"artist", "Cy"})
+	tagTestFile(t, a, "artist", "Di")
+	current := addTestFile(t, "current.jpg")
+
+	tests := []struct {
+		back int
+		want string
+	}{
+		{1, "Di"},
+		{2, "Cy"},
+		{3, "Ann"},
+	}
+	for _, tt := range tests {
+		got, err := getPreviousTagValue(ctx, "artist", current, tt.back)
+		if err != nil {
+			t.Fatalf("back %d: %v", tt.back, err)
+		}
+		if got != tt.want {
+			t.Errorf("back %d = %q, want %q", tt.back, got, tt.want)
+		}
+	}
+
+	if _, err := getPreviousTagValue(ctx, "artist", current, 4); err == nil {
+		t.Error("back 4: expected an error, there are only three files")
+	}
+
+	// The file being tagged is never its own previous file
+	if got, err := getPreviousTagValue(ctx, "artist", a, 1); err != nil || got != "Cy" {
+		t.Errorf("excluding a.jpg = %q, %v, want Cy", got, err)
+	}
+}
+
+func TestLoadConfigEmptyVideoExtensions(t *testing.T) {
+	oldConfig := config
+	t.Cleanup(func() { config = oldConfig })
+	t.Chdir(t.TempDir())
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(out) })
+
+	for _, list := range []string{"[]", "null"} {
+		if err := os.WriteFile("config.json", []byte(`{"video_extensions": `+list+`}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(); err != nil {
+			t.Fatalf("video_extensions %s: %v", list, err)
+		}
+		if !reflect.DeepEqual(config.VideoExtensions, defaultVideoExtensions) {
+			t.Errorf("video_extensions %s gave %v, want the defaults", list, config.VideoExtensions)
+		}
+		if !isVideoFile("clip.mp4") {
+			t.Errorf("video_extensions %s: clip.mp4 is not a video", list)
+		}
+	}
+
+	if err := os.WriteFile("config.json", []byte(`{"video_extensions": [".ogv"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !isVideoFile("clip.ogv") || isVideoFile("clip.mp4") {
+		t.Errorf("a configured list was not used as is: %v", config.VideoExtensions)
+	}
+}
@@ -46,6 +46,42 @@ document.addEventListener('DOMContentLoaded', function () {
     radio.addEventListener('change', toggleSelectionMode);
   });
 
+  // Live feedback on the tag query from the validation endpoint
+  const tagQueryInput = document.getElementById('tag_query');
+  const tagQueryFeedback = document.getElementById('tag-query-feedback');
+  let tagQueryTimer = null;
+
+  function checkTagQuery() {
+    const q = tagQueryInput.value.trim();
+    if (!q) {
+      tagQueryFeedback.textContent = '';
+      return;
+    }
+    fetch('/api/tag-query/validate?q=' + encodeURIComponent(q))
+      .then(function (res) { return res.json(); })
+      .then(function (result) {
+        if (tagQueryInput.value.trim() !== q) return;
+        if (!result.valid) {
+          tagQueryFeedback.textContent = 'Invalid query: ' + result.error;
+          return;
+        }
+        const tags = result.tags.map(function (t) { return t.category + ':' + t.value; });
+        tagQueryFeedback.textContent = tags.join(' ' + result.operator + ' ') + ' matches ' +
+          result.count + ' file' + (result.count === 1 ? '' : 's');
+      })
+      .catch(function () {
+        tagQueryFeedback.textContent = '';
+      });
+  }
+
+  if (tagQueryInput && tagQueryFeedback) {
+    tagQueryInput.addEventListener('input', function () {
+      clearTimeout(tagQueryTimer);
+      tagQueryTimer = setTimeout(checkTagQuery, 300);
+    });
+    checkTagQuery();
+  }
+
   // Initialize on page load
   updateValueField();
   toggleSelectionMode();
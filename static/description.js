@@ -24,6 +24,15 @@ function cancelDescriptionEdit() {
     const original = displayDiv.dataset.originalDescription || '';
     textarea.value = original;
 
+    // Cancelling abandons the edit, so its draft goes too
+    clearTimeout(draftTimer);
+    if (textarea.dataset.draftUrl) {
+        const body = new FormData();
+        body.append('action', 'discard');
+        fetch(textarea.dataset.draftUrl, { method: 'POST', body: body });
+        hideDraftNotice();
+    }
+
     displayDiv.style.display = 'block';
     editDiv.style.display = 'none';
 
@@ -31,6 +40,33 @@ function cancelDescriptionEdit() {
     convertFileRefs();
 }
 
+// Restore a draft left from an earlier visit into the edit box
+function restoreDescriptionDraft() {
+    const textarea = document.getElementById('description-textarea');
+    textarea.value = textarea.dataset.draft || '';
+    hideDraftNotice();
+    toggleDescriptionEdit();
+}
+
+function hideDraftNotice() {
+    const notice = document.getElementById('description-draft-notice');
+    if (notice) {
+        notice.style.display = 'none';
+    }
+}
+
+// Save the description as a draft a second after typing stops
+let draftTimer;
+function scheduleDraftSave(textarea) {
+    clearTimeout(draftTimer);
+    draftTimer = setTimeout(function() {
+        const body = new FormData();
+        body.append('description', textarea.value);
+        fetch(textarea.dataset.draftUrl, { method: 'POST', body: body })
+            .catch(function(err) { console.warn('Failed to save description draft:', err); });
+    }, 1000);
+}
+
 // Auto-resize textarea as content changes
 document.addEventListener('DOMContentLoaded', function() {
     const textarea = document.getElementById('description-textarea');
@@ -41,6 +77,15 @@ document.addEventListener('DOMContentLoaded', function() {
             // Set the height to match the content, with a minimum of 6 rows
             const minHeight = parseInt(getComputedStyle(this).lineHeight) * 6;
             this.style.height = Math.max(minHeight, this.scrollHeight) + 'px';
+
+            if (this.dataset.draftUrl) {
+                scheduleDraftSave(this);
+            }
+        });
+
+        // Saving the description clears the draft on the server
+        textarea.form.addEventListener('submit', function() {
+            clearTimeout(draftTimer);
         });
     }
 });
@@ -0,0 +1,27 @@
+// Plays a video's preview clip over its gallery tile while hovered. The
+// clip is only fetched the first time the tile is hovered.
+document.addEventListener("DOMContentLoaded", function() {
+    document.querySelectorAll("video.hover-preview").forEach(function(video) {
+        const tile = video.closest(".gallery-video");
+        if (!tile) {
+            return;
+        }
+
+        tile.addEventListener("mouseenter", function() {
+            if (!video.getAttribute("src")) {
+                video.src = video.dataset.src;
+            }
+            video.currentTime = 0;
+            const playing = video.play();
+            if (playing) {
+                playing.catch(function() {});
+            }
+            video.classList.add("playing");
+        });
+
+        tile.addEventListener("mouseleave", function() {
+            video.pause();
+            video.classList.remove("playing");
+        });
+    });
+});
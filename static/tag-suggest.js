@@ -0,0 +1,44 @@
+// Fills the value datalist of the add tag form with existing values of the
+// chosen category as they are typed.
+document.addEventListener("DOMContentLoaded", function() {
+    const form = document.querySelector("form[data-tag-suggest]");
+    if (!form) {
+        return;
+    }
+    const category = form.querySelector("input[name=category]");
+    const value = form.querySelector("input[name=value]");
+    const list = document.getElementById(value.getAttribute("list"));
+    let timer = null;
+    let latest = 0;
+
+    function suggest() {
+        if (!category.value.trim()) {
+            list.replaceChildren();
+            return;
+        }
+        const params = new URLSearchParams({ category: category.value.trim(), q: value.value.trim() });
+        const request = ++latest;
+        fetch("/api/tags/suggest?" + params)
+            .then(function(response) { return response.ok ? response.json() : []; })
+            .then(function(suggestions) {
+                // An older answer arriving late must not replace a newer one
+                if (request !== latest) {
+                    return;
+                }
+                list.replaceChildren(...suggestions.map(function(s) {
+                    const option = document.createElement("option");
+                    option.value = s.value;
+                    option.label = s.value + " (" + s.count + ")";
+                    return option;
+                }));
+            })
+            .catch(function() {});
+    }
+
+    value.addEventListener("input", function() {
+        clearTimeout(timer);
+        timer = setTimeout(suggest, 150);
+    });
+    value.addEventListener("focus", suggest);
+    category.addEventListener("change", suggest);
+});